@@ -0,0 +1,90 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// baselineEntry is a match recorded via -write-baseline. Matches are
+// identified by their content rather than their position, so that they
+// still match the baseline after unrelated edits to their files.
+type baselineEntry struct {
+	File string `json:"file"`
+	Rule string `json:"rule,omitempty"`
+	Hash string `json:"hash"`
+}
+
+func (m *matcher) baselineEntry(name string, sub submatch) baselineEntry {
+	sum := sha256.Sum256([]byte(singleLinePrint(sub.node)))
+	return baselineEntry{
+		File: filepath.ToSlash(m.position(sub.node.Pos()).Filename),
+		Rule: name,
+		Hash: hex.EncodeToString(sum[:8]),
+	}
+}
+
+// readBaseline reads the entries in a file given via -baseline, counting
+// how many times each appears.
+func readBaseline(path string) (map[baselineEntry]int, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []baselineEntry
+	if err := json.Unmarshal(src, &entries); err != nil {
+		return nil, err
+	}
+	counts := make(map[baselineEntry]int, len(entries))
+	for _, entry := range entries {
+		counts[entry]++
+	}
+	return counts, nil
+}
+
+// newMatches discards the matches of a rule in the baseline. If a match
+// appears more times than in the baseline, the extra ones are kept.
+func (m *matcher) newMatches(name string, subs []submatch) []submatch {
+	var kept []submatch
+	for _, sub := range subs {
+		entry := m.baselineEntry(name, sub)
+		if m.baseline[entry] > 0 {
+			m.baseline[entry]--
+			continue
+		}
+		kept = append(kept, sub)
+	}
+	return kept
+}
+
+// writeBaseline writes the matches of all rules to a file given via
+// -write-baseline, sorted so that the file changes as little as possible.
+func (m *matcher) writeBaseline(path string, rules []*rule) error {
+	entries := []baselineEntry{}
+	for _, r := range rules {
+		for _, sub := range r.all {
+			entries = append(entries, r.m.baselineEntry(r.name, sub))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		x, y := entries[i], entries[j]
+		if x.File != y.File {
+			return x.File < y.File
+		}
+		if x.Rule != y.Rule {
+			return x.Rule < y.Rule
+		}
+		return x.Hash < y.Hash
+	})
+	src, err := json.MarshalIndent(entries, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(src, '\n'), 0o666)
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"sort"
+	"strings"
+)
+
+// The ANSI escape sequences used with -color.
+const (
+	colorReset = "\x1b[0m"
+	colorFile  = "\x1b[35m"
+	colorLine  = "\x1b[32m"
+	colorMatch = "\x1b[1;31m"
+)
+
+// captureColors are given to the wildcards with -color-captures, in the
+// order of their names, starting over if there are more wildcards.
+var captureColors = []string{
+	"\x1b[1;33m",
+	"\x1b[1;34m",
+	"\x1b[1;32m",
+	"\x1b[1;36m",
+	"\x1b[1;35m",
+}
+
+var severityColors = map[string]string{
+	"error":   "\x1b[1;31m",
+	"warning": "\x1b[1;33m",
+	"info":    "\x1b[1;34m",
+}
+
+// posString is like fpos.String, but in color if enabled.
+func (m *matcher) posString(fpos token.Position) string {
+	if !m.colored || fpos.Filename == "" || !fpos.IsValid() {
+		return fpos.String()
+	}
+	return fmt.Sprintf("%s%s%s:%s%d:%d%s", colorFile, fpos.Filename, colorReset,
+		colorLine, fpos.Line, fpos.Column, colorReset)
+}
+
+// contextPosString is like posString, but for a line of context around
+// a match, which has no column and uses dashes like grep.
+func (m *matcher) contextPosString(name string, line int) string {
+	if !m.colored {
+		return fmt.Sprintf("%s-%d-", name, line)
+	}
+	return fmt.Sprintf("%s%s%s-%s%d%s-", colorFile, name, colorReset, colorLine, line, colorReset)
+}
+
+// severityString returns a rule's severity, in color if enabled.
+func (m *matcher) severityString(severity string) string {
+	if !m.colored {
+		return severity
+	}
+	return severityColors[severity] + severity + colorReset
+}
+
+// colorLine returns the source line where a match starts, with the match
+// highlighted up to the end of that line. With -color-captures, each of
+// its wildcards is highlighted on top of it in a different color.
+func (m *matcher) colorLine(sub submatch) string {
+	tf := m.loader.fset.File(sub.node.Pos())
+	if tf == nil {
+		return singleLinePrint(sub.node)
+	}
+	src := m.source(tf)
+	if src == nil {
+		return singleLinePrint(sub.node)
+	}
+	start := tf.Offset(tf.LineStart(tf.Line(sub.node.Pos())))
+	line := src[start:]
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	colors := make([]string, len(line))
+	paint := func(node ast.Node, color string) {
+		if l, ok := node.(nodeList); ok && l.len() == 0 {
+			return
+		}
+		if m.loader.fset.File(node.Pos()) != tf {
+			return
+		}
+		from := tf.Offset(node.Pos()) - start
+		to := tf.Offset(node.End()) - start
+		if from < 0 {
+			from = 0
+		}
+		if to > len(colors) {
+			to = len(colors)
+		}
+		for i := from; i < to; i++ {
+			colors[i] = color
+		}
+	}
+	paint(sub.node, colorMatch)
+	if m.colorCaptures {
+		names := make([]string, 0, len(sub.values))
+		for name := range sub.values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for i, name := range names {
+			paint(sub.values[name], captureColors[i%len(captureColors)])
+		}
+	}
+	first, last := 0, len(line)
+	for first < last && (line[first] == ' ' || line[first] == '\t') {
+		first++
+	}
+	for last > first && (line[last-1] == ' ' || line[last-1] == '\t' || line[last-1] == '\r') {
+		last--
+	}
+	var buf strings.Builder
+	cur := ""
+	for i := first; i < last; i++ {
+		if colors[i] != cur {
+			if cur != "" {
+				buf.WriteString(colorReset)
+			}
+			buf.WriteString(colors[i])
+			cur = colors[i]
+		}
+		buf.WriteByte(line[i])
+	}
+	if cur != "" {
+		buf.WriteString(colorReset)
+	}
+	return buf.String()
+}
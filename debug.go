@@ -0,0 +1,174 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"reflect"
+	"strings"
+)
+
+// trace records the comparisons made while matching a pattern against a
+// single candidate node, as requested via -debug.
+type trace struct {
+	entries []traceEntry
+	depth   int
+
+	// quiet is set when -debug gave no column, to leave out the
+	// candidates which aren't even of the pattern's node kind
+	quiet bool
+}
+
+type traceEntry struct {
+	depth      int
+	expr, node ast.Node
+	ok         bool
+	why        string
+}
+
+// debugTrace returns a new trace if the comparisons against a candidate
+// node should be traced, or nil otherwise. The position given via -debug is
+// either "file:line" or "file:line:col".
+func (m *matcher) debugTrace(node ast.Node) *trace {
+	if m.debugPos == "" {
+		return nil
+	}
+	fpos := m.position(node.Pos())
+	line := fmt.Sprintf("%s:%d", fpos.Filename, fpos.Line)
+	switch m.debugPos {
+	case line:
+		return &trace{quiet: true}
+	case fmt.Sprintf("%s:%d", line, fpos.Column):
+		return &trace{}
+	}
+	return nil
+}
+
+// tracedNode is m.node when tracing. Each comparison is recorded in order,
+// along with why it failed, if it did.
+func (m *matcher) tracedNode(expr, node ast.Node) bool {
+	t := m.trace
+	i := len(t.entries)
+	t.entries = append(t.entries, traceEntry{depth: t.depth, expr: expr, node: node})
+	t.depth++
+	ok := m.nodeOnce(expr, node)
+	t.depth--
+	t.entries[i].ok = ok
+	if !ok {
+		t.entries[i].why = m.mismatch(expr, node, t.depth+1, t.entries[i+1:])
+	}
+	return ok
+}
+
+// printTrace prints the comparisons made against a candidate node, one per
+// line and indented by depth. They go to standard error, so that they don't
+// get mixed up with the matches.
+func (m *matcher) printTrace(cmd exprCmd, node ast.Node) {
+	if t := m.trace; t.quiet && len(t.entries) == 1 && t.entries[0].why == kindMismatch {
+		return
+	}
+	w := m.errOut()
+	fmt.Fprintf(w, "%v: -%s %s against %s\n", m.position(node.Pos()),
+		cmd.name, cmd.src, nodeKind(node))
+	for _, e := range m.trace.entries {
+		result := "ok"
+		if !e.ok {
+			result = e.why
+		}
+		fmt.Fprintf(w, "%s%s vs %s: %s\n", strings.Repeat("  ", e.depth+1),
+			m.traceDesc(e.expr), traceNodeDesc(e.node), result)
+	}
+}
+
+func nodeKind(node ast.Node) string {
+	kind := strings.TrimPrefix(fmt.Sprintf("%T", node), "*ast.")
+	return strings.TrimPrefix(kind, "main.")
+}
+
+func (m *matcher) traceDesc(expr ast.Node) string {
+	if expr == nil {
+		return "nil"
+	}
+	if id := fromWildNode(expr); id >= 0 {
+		return fmt.Sprintf("%s %v", nodeKind(expr), m.info(id))
+	}
+	return nodeDesc(expr)
+}
+
+func traceNodeDesc(node ast.Node) string {
+	if node == nil {
+		return "nil"
+	}
+	return nodeDesc(node)
+}
+
+const kindMismatch = "node kind mismatch"
+
+// mismatch explains why a comparison failed, given the comparisons that
+// were made within it at a depth. If a field holding a token, a name or a literal
+// differs, that is given as the reason. Otherwise, it's the field holding
+// the last child node which failed to match.
+func (m *matcher) mismatch(expr, node ast.Node, depth int, inner []traceEntry) string {
+	switch {
+	case fromWildNode(expr) >= 0:
+		return "wildcard mismatch"
+	case expr == nil || node == nil:
+		return "missing node"
+	case reflect.TypeOf(expr) != reflect.TypeOf(node):
+		return kindMismatch
+	}
+	kind := nodeKind(expr)
+	xv, yv := reflect.ValueOf(expr), reflect.ValueOf(node)
+	if xv.Kind() != reflect.Ptr || xv.Elem().Kind() != reflect.Struct {
+		return "mismatch"
+	}
+	xv, yv = xv.Elem(), yv.Elem()
+	posType := reflect.TypeOf(token.NoPos)
+	for i := 0; i < xv.NumField(); i++ {
+		xf, yf := xv.Field(i), yv.Field(i)
+		if xf.Type() == posType {
+			continue
+		}
+		switch xf.Kind() {
+		case reflect.String, reflect.Int, reflect.Bool:
+			if xf.Interface() != yf.Interface() {
+				return fmt.Sprintf("%s.%s mismatch: %v vs %v", kind,
+					xv.Type().Field(i).Name, xf.Interface(), yf.Interface())
+			}
+		}
+	}
+	var failed ast.Node
+	for _, e := range inner {
+		if e.depth == depth && !e.ok && e.expr != nil {
+			failed = e.expr
+		}
+	}
+	if failed == nil {
+		return "mismatch"
+	}
+	for i := 0; i < xv.NumField(); i++ {
+		if fieldHolds(xv.Field(i), failed) {
+			return fmt.Sprintf("%s.%s mismatch", kind, xv.Type().Field(i).Name)
+		}
+	}
+	return "mismatch"
+}
+
+// fieldHolds reports whether a struct field holds a node, either directly
+// or as an element of a list.
+func fieldHolds(field reflect.Value, node ast.Node) bool {
+	switch field.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return !field.IsNil() && field.Interface() == node
+	case reflect.Slice:
+		for i := 0; i < field.Len(); i++ {
+			if elem := field.Index(i); elem.CanInterface() && elem.Interface() == node {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -10,17 +10,22 @@ import (
 	"go/parser"
 	"go/scanner"
 	"go/token"
+	"path"
 	"regexp"
 	"strconv"
 	"strings"
 	"text/template"
+	"unicode"
 )
 
-func (m *matcher) transformSource(expr string) (string, []posOffset, error) {
+func (m *matcher) transformSource(expr string, ops bool) (string, []posOffset, error) {
 	toks, err := m.tokenize([]byte(expr))
 	if err != nil {
 		return "", nil, fmt.Errorf("cannot tokenize expr: %v", err)
 	}
+	if ops {
+		toks = markOpWildcards(toks, []byte(expr))
+	}
 	var offs []posOffset
 	lbuf := lineColBuffer{line: 1, col: 1}
 	addOffset := func(length int) {
@@ -33,7 +38,12 @@ func (m *matcher) transformSource(expr string) (string, []posOffset, error) {
 	}
 	if len(toks) > 0 && toks[0].tok == tokAggressive {
 		toks = toks[1:]
-		m.aggressive = true
+		if m.norms == nil {
+			m.norms = make(map[string]bool)
+		}
+		for _, name := range aggressiveNorms {
+			m.norms[name] = true
+		}
 	}
 	lastLit := false
 	for _, t := range toks {
@@ -61,18 +71,286 @@ func (m *matcher) transformSource(expr string) (string, []posOffset, error) {
 }
 
 func (m *matcher) parseExpr(expr string) (ast.Node, error) {
-	exprStr, offs, err := m.transformSource(expr)
+	expr = m.expandDefs(expr)
+	exprStr, offs, err := m.transformSource(expr, true)
 	if err != nil {
 		return nil, err
 	}
 	node, err := parseDetectingNode(exprStr)
+	if err != nil && strings.Contains(exprStr, opWildPrefix) {
+		// what looked like an operator wildcard may have been
+		// something else, like in "var $x $t"
+		exprStr, offs, _ = m.transformSource(expr, false)
+		node, err = parseDetectingNode(exprStr)
+	}
+	if perr, ok := err.(*PatternError); ok {
+		perr.Err = subPosOffsets(perr.Err, offs...)
+		perr.setPos(expr)
+		return nil, fmt.Errorf("cannot parse expr: %w", perr)
+	}
 	if err != nil {
-		err = subPosOffsets(err, offs...)
 		return nil, fmt.Errorf("cannot parse expr: %v", err)
 	}
 	return node, nil
 }
 
+// PatternError is an error parsing a pattern, such as a missing closing
+// parenthesis. It's found via errors.As on the errors returned when
+// parsing commands.
+type PatternError struct {
+	// Pattern is the source of the pattern, after expanding any named
+	// patterns given via -def.
+	Pattern string
+
+	// Pos is the position of the first error in Pattern, and Offset
+	// is the same position as a byte offset.
+	Pos    token.Position
+	Offset int
+
+	// Kind is the kind of node being parsed when the error was found,
+	// such as "CallExpr" or "BlockStmt". It may be empty.
+	Kind string
+
+	// Err is the underlying parse error, usually a scanner.ErrorList.
+	Err error
+}
+
+func (e *PatternError) Error() string {
+	msg := e.Err.Error()
+	if list, ok := e.Err.(scanner.ErrorList); ok && len(list) > 0 && e.Pos.IsValid() {
+		msg = fmt.Sprintf("%v: %s", e.Pos, list[0].Msg)
+		if len(list) > 1 {
+			msg += fmt.Sprintf(" (and %d more errors)", len(list)-1)
+		}
+	}
+	if e.Kind == "" {
+		return msg
+	}
+	return fmt.Sprintf("%s (in %s)", msg, e.Kind)
+}
+
+func (e *PatternError) Unwrap() error { return e.Err }
+
+// setPos sets the position of the error within the pattern, which is
+// taken from the first error in the list. Newlines are only kept in the
+// parsed source where they end a statement, so the lines in the error are
+// mapped back to the lines in the pattern.
+func (e *PatternError) setPos(pattern string) {
+	e.Pattern = pattern
+	list, ok := e.Err.(scanner.ErrorList)
+	if !ok || len(list) == 0 {
+		return
+	}
+	lineStarts := []int{0}
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(pattern))
+	var scan scanner.Scanner
+	scan.Init(file, []byte(pattern), nil, 0)
+	for {
+		pos, tok, lit := scan.Scan()
+		if tok == token.EOF {
+			break
+		}
+		if tok == token.SEMICOLON && lit == "\n" {
+			lineStarts = append(lineStarts, file.Offset(pos)+1)
+		}
+	}
+	line := list[0].Pos.Line
+	if line < 1 || line > len(lineStarts) {
+		return
+	}
+	offset := lineStarts[line-1] + list[0].Pos.Column - 1
+	if offset > len(pattern) {
+		// errors like a missing closing brace are found at
+		// the very end of the template
+		offset = len(pattern)
+	}
+	e.Offset = offset
+	e.Pos = token.Position{
+		Offset: offset,
+		Line:   1 + strings.Count(pattern[:offset], "\n"),
+		Column: 1 + offset - (strings.LastIndexByte(pattern[:offset], '\n') + 1),
+	}
+}
+
+// enclosingKind returns the kind of the innermost node around the position
+// of a parse error, ignoring the nodes which replaced the bad syntax.
+func enclosingKind(fset *token.FileSet, f *ast.File, err error) string {
+	list, ok := err.(scanner.ErrorList)
+	if f == nil || !ok || len(list) == 0 || len(f.Decls) == 0 {
+		return ""
+	}
+	fn, ok := f.Decls[len(f.Decls)-1].(*ast.FuncDecl)
+	if !ok || fn.Body == nil {
+		return ""
+	}
+	// the set also holds the files from the earlier parse attempts
+	pos := token.Pos(fset.File(f.Pos()).Base() + list[0].Pos.Offset)
+	kind := ""
+	ast.Inspect(fn.Body, func(node ast.Node) bool {
+		if node == nil || pos < node.Pos() || pos >= node.End() {
+			return false
+		}
+		switch node.(type) {
+		case *ast.BadExpr, *ast.BadStmt, *ast.BadDecl:
+		default:
+			kind = strings.TrimPrefix(fmt.Sprintf("%T", node), "*ast.")
+		}
+		return true
+	})
+	return kind
+}
+
+const opWildPrefix = wildPrefix + "op_"
+
+func isSpace(b byte) bool { return b == ' ' || b == '\t' || b == '\n' }
+
+// wildEnd returns the offset just after the wildcard starting at offs, such
+// as "$x" or "$*x".
+func wildEnd(src []byte, offs int) int {
+	end := offs + 1 // '$'
+	if end < len(src) && src[end] == '*' {
+		end++
+	}
+	for end < len(src) && (src[end] == '_' || unicode.IsLetter(rune(src[end])) ||
+		unicode.IsDigit(rune(src[end]))) {
+		end++
+	}
+	return end
+}
+
+// unaryOperandEnd returns the index of the last token of the operand of a
+// unary operator starting at index i, such as "x.f(y)[z]" or "-x".
+func unaryOperandEnd(toks []fullToken, i int) int {
+	closing := func(i int) int {
+		for depth := 0; i < len(toks); i++ {
+			switch toks[i].tok {
+			case token.LPAREN, token.LBRACK, token.LBRACE:
+				depth++
+			case token.RPAREN, token.RBRACK, token.RBRACE:
+				if depth--; depth == 0 {
+					return i
+				}
+			}
+		}
+		return len(toks) - 1
+	}
+	switch toks[i].tok {
+	case token.NOT, token.SUB, token.ADD, token.XOR, token.MUL,
+		token.AND, token.ARROW:
+		return unaryOperandEnd(toks, i+1)
+	case token.LPAREN:
+		i = closing(i)
+	}
+	// selectors, calls and index expressions bind more tightly
+	for i+1 < len(toks) {
+		switch toks[i+1].tok {
+		case token.PERIOD:
+			if i += 2; i < len(toks) && toks[i].tok == token.LPAREN {
+				i = closing(i) // a type assertion
+			}
+		case token.LPAREN, token.LBRACK:
+			i = closing(i + 1)
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// markOpWildcards finds the wildcards used as operators, like $op in "$x $op
+// $y" or "$op $x", and turns them into valid Go code that the matcher will
+// recognise. Binary ones become "$x || gogrep_op_N || $y", so they bind
+// more loosely than any other operator, and unary ones become composite
+// literals as in "gogrep_op_N{$x}". Unlike calls, those can't be mistaken
+// for declarations like "var x (T)".
+//
+// Operator wildcards must be surrounded by whitespace, as otherwise
+// "func (r T) $m()" would be ambiguous. For the same reason, a pattern can't
+// start with a unary one.
+func markOpWildcards(toks []fullToken, src []byte) []fullToken {
+	spaceAround := func(i int) (before, after bool) {
+		start, end := toks[i].pos.Offset, wildEnd(src, toks[i].pos.Offset)
+		before = start > 0 && isSpace(src[start-1])
+		after = end < len(src) && isSpace(src[end])
+		return
+	}
+	isWild := func(i int) bool {
+		return i >= 0 && i < len(toks) && toks[i].tok == token.IDENT &&
+			isWildName(toks[i].lit)
+	}
+	endsOperand := func(i int) bool {
+		if i < 0 {
+			return false
+		}
+		switch toks[i].tok {
+		case token.IDENT, token.INT, token.FLOAT, token.IMAG, token.CHAR,
+			token.STRING, token.RPAREN, token.RBRACK, token.RBRACE:
+			return true
+		}
+		return false
+	}
+	// startsOperand reports whether a token may start an operand. Unless
+	// unary is set, that includes the operators which are both unary and
+	// binary, as "$x + $y" must not be read as "$x (+$y)".
+	startsOperand := func(i int, unary bool) bool {
+		if i >= len(toks) {
+			return false
+		}
+		switch toks[i].tok {
+		case token.IDENT, token.INT, token.FLOAT, token.IMAG, token.CHAR,
+			token.STRING, token.LPAREN, token.LBRACK, token.FUNC,
+			token.MAP, token.CHAN, token.STRUCT, token.INTERFACE,
+			token.NOT:
+			return true
+		case token.SUB, token.ADD, token.XOR, token.MUL, token.AND,
+			token.ARROW:
+			return !unary
+		}
+		return false
+	}
+	binary := make(map[int]bool)
+	for i := range toks {
+		if !isWild(i) {
+			continue
+		}
+		before, after := spaceAround(i)
+		if before && after && endsOperand(i-1) && startsOperand(i+1, false) {
+			binary[i] = true
+		}
+	}
+	unary := func(i int) bool {
+		// "$x $t" at the start of a pattern is a value spec, and
+		// after "[" it's a type parameter
+		if i == 0 || !isWild(i) || binary[i] || binary[i+1] ||
+			toks[i-1].tok == token.LBRACK {
+			return false
+		}
+		_, after := spaceAround(i)
+		return after && !endsOperand(i-1) && startsOperand(i+1, true)
+	}
+	var res []fullToken
+	closeAt := make(map[int]int) // closing braces to add after a token
+	for i, t := range toks {
+		switch {
+		case binary[i]:
+			t.lit = opWildPrefix + t.lit[len(wildPrefix):]
+			res = append(res, fullToken{t.pos, token.LOR, ""}, t,
+				fullToken{t.pos, token.LOR, ""})
+		case unary(i):
+			t.lit = opWildPrefix + t.lit[len(wildPrefix):]
+			res = append(res, t, fullToken{t.pos, token.LBRACE, ""})
+			closeAt[unaryOperandEnd(toks, i+1)]++
+		default:
+			res = append(res, t)
+		}
+		for ; closeAt[i] > 0; closeAt[i]-- {
+			res = append(res, fullToken{t.pos, token.RBRACE, ""})
+		}
+	}
+	return res
+}
+
 type lineColBuffer struct {
 	bytes.Buffer
 	line, col, offs int
@@ -178,7 +456,11 @@ func parseDetectingNode(src string) (ast.Node, error) {
 		// the best overall error message. Show positions
 		// relative to where the user's code is put in the
 		// template.
-		mainErr = subPosOffsets(err, posOffset{1, 1, 22})
+		kind := enclosingKind(fset, f, err)
+		mainErr = &PatternError{
+			Kind: kind,
+			Err:  subPosOffsets(err, posOffset{1, 1, 22}),
+		}
 	}
 
 	// type expressions not yet picked up, for e.g. chans and interfaces
@@ -237,6 +519,256 @@ type fullToken struct {
 	lit string
 }
 
+// anchors are the "^" and "$" a pattern of statements may start and end
+// with, to only match at the start or end of a list of statements.
+type anchors struct {
+	start, end bool
+}
+
+// splitAnchors finds the anchors in a pattern, replacing them with spaces
+// to keep positions in errors intact. To not be confused with the unary
+// operator, "^" must be followed by whitespace, and what follows must not be
+// an expression, as "^ x" is valid Go; see isComplement.
+func splitAnchors(src string) (string, anchors) {
+	var anc anchors
+	b := []byte(src)
+	start := len(b) - len(strings.TrimLeft(src, " \t\n"))
+	if rest := b[start:]; len(rest) > 1 && rest[0] == '^' &&
+		strings.ContainsRune(" \t\n", rune(rest[1])) && !isComplement(string(rest)) {
+		b[start] = ' '
+		anc.start = true
+	}
+	end := len(strings.TrimRight(string(b), " \t\n")) - 1
+	if end >= 0 && b[end] == '$' {
+		b[end] = ' '
+		anc.end = true
+	}
+	if strings.TrimSpace(string(b)) == "" {
+		return src, anchors{} // nothing to anchor
+	}
+	return string(b), anc
+}
+
+// isComplement reports whether a pattern starting with "^" is a bitwise
+// complement expression, like "^ x" or "^ $x", rather than a statement list
+// with a start anchor, like "^ x; y" or "^ x;".
+func isComplement(src string) bool {
+	// wildcards aren't valid Go, but identifiers parse the same way
+	src = defWildRx.ReplaceAllString(src, "w")
+	_, err := parser.ParseExpr(src)
+	return err == nil
+}
+
+// splitAlternatives splits a pattern by the "\|" separators at its top
+// level, like grep's. A plain "|" is left alone as a bitwise or, since it
+// may appear anywhere in an expression, like in "-x '$x | $y'".
+func splitAlternatives(src string) []string {
+	var s scanner.Scanner
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(src))
+	// errors such as the illegal '$' are left to tokenize
+	s.Init(file, []byte(src), func(token.Position, string) {}, 0)
+
+	var alts []string
+	depth, start := 0, 0
+	for {
+		pos, tok, _ := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		switch tok {
+		case token.LPAREN, token.LBRACK, token.LBRACE:
+			depth++
+		case token.RPAREN, token.RBRACK, token.RBRACE:
+			depth--
+		case token.OR:
+			offs := file.Offset(pos)
+			if depth == 0 && offs > 0 && src[offs-1] == '\\' {
+				alts = append(alts, src[start:offs-1])
+				start = offs + 1
+			}
+		}
+	}
+	return append(alts, src[start:])
+}
+
+// addDef adds a -def pattern of the form "name=pattern". It may use the
+// patterns defined before it, but not alternatives.
+func (m *matcher) addDef(def string) error {
+	i := strings.Index(def, "=")
+	if i < 0 {
+		return fmt.Errorf("-def %s: want name=pattern", def)
+	}
+	name := strings.TrimSpace(def[:i])
+	if !token.IsIdentifier(name) {
+		return fmt.Errorf("-def %s: %q is not a valid name", def, name)
+	}
+	alts := splitAlternatives(def[i+1:])
+	if len(alts) > 1 {
+		return fmt.Errorf("-def %s: cannot use alternatives", def)
+	}
+	if m.defs == nil {
+		m.defs = make(map[string]namedPattern)
+	}
+	src := m.expandDefs(alts[0])
+	m.defs[name] = namedPattern{src, defPrec(src)}
+	return nil
+}
+
+// namedPattern is a pattern given via -def.
+type namedPattern struct {
+	src string
+
+	// prec is the precedence of the operator of an expression pattern,
+	// such as token.UnaryPrec for "-$x", or zero if it needs no
+	// parentheses, like "f($x)" or a list of statements
+	prec int
+}
+
+var defWildRx = regexp.MustCompile(`\$[*?+]*`)
+
+// defPrec returns the precedence of a -def pattern; see namedPattern.
+func defPrec(src string) int {
+	// wildcards aren't valid Go, but identifiers parse the same way
+	src = defWildRx.ReplaceAllString(src, "w")
+	expr, err := parser.ParseExpr(src)
+	if err != nil {
+		return 0
+	}
+	switch x := expr.(type) {
+	case *ast.BinaryExpr:
+		return x.Op.Precedence()
+	case *ast.UnaryExpr, *ast.StarExpr:
+		return token.UnaryPrec
+	}
+	return 0
+}
+
+// expandDefs replaces the identifiers in a pattern which name a -def pattern
+// with its source. The names of dollar expressions are left alone. An
+// expression is parenthesized if the operators around it would otherwise
+// take its operands, so that "-def sum=a + b" makes "sum * 2" match
+// "(a + b) * 2" and not "a + b*2".
+func (m *matcher) expandDefs(src string) string {
+	if len(m.defs) == 0 {
+		return src
+	}
+	var s scanner.Scanner
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(src))
+	s.Init(file, []byte(src), func(token.Position, string) {}, 0)
+
+	type scanned struct {
+		pos token.Pos
+		tok token.Token
+		lit string
+	}
+	var toks []scanned
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		toks = append(toks, scanned{pos, tok, lit})
+	}
+	tokAt := func(i int) token.Token {
+		if i < 0 || i >= len(toks) {
+			return token.ILLEGAL
+		}
+		return toks[i].tok
+	}
+	// endsOperand reports whether the token at i may end an operand,
+	// making an operator after it binary
+	endsOperand := func(i int) bool {
+		switch tokAt(i) {
+		case token.IDENT, token.INT, token.FLOAT, token.IMAG, token.CHAR,
+			token.STRING, token.RPAREN, token.RBRACK, token.RBRACE:
+			return true
+		}
+		return false
+	}
+
+	var buf bytes.Buffer
+	last := 0
+	wild := false
+	// brackets holds the brackets open at each token, and cases the number
+	// of them where a case clause's expressions start, to tell a colon
+	// ending those or in an index apart from one after a label or a key
+	var brackets []token.Token
+	var cases []int
+	for i, t := range toks {
+		switch t.tok {
+		case token.LPAREN, token.LBRACK, token.LBRACE:
+			brackets = append(brackets, t.tok)
+		case token.RPAREN, token.RBRACK, token.RBRACE:
+			if len(brackets) > 0 {
+				brackets = brackets[:len(brackets)-1]
+			}
+		case token.CASE:
+			cases = append(cases, len(brackets))
+		case token.COLON:
+			if n := len(cases); n > 0 && cases[n-1] == len(brackets) {
+				cases = cases[:n-1]
+			}
+		}
+		if t.tok == token.ILLEGAL && t.lit == "$" {
+			wild = true
+			continue
+		}
+		if t.tok != token.IDENT {
+			continue
+		}
+		if wild {
+			// the name in "$x", "$*x" or "$?x"
+			wild = false
+			continue
+		}
+		def, ok := m.defs[t.lit]
+		if !ok {
+			continue
+		}
+		switch tokAt(i - 1) {
+		case token.PERIOD:
+			continue // a selector, like "x.name"
+		case token.GOTO, token.BREAK, token.CONTINUE:
+			continue // a label
+		}
+		if tokAt(i+1) == token.COLON {
+			n := len(brackets)
+			inIndex := n > 0 && brackets[n-1] == token.LBRACK
+			inCase := len(cases) > 0 && cases[len(cases)-1] == n
+			if !inIndex && !inCase {
+				continue // a label, or a key in a composite literal
+			}
+		}
+		parens := false
+		if def.prec > 0 {
+			switch prev, next := tokAt(i-1), tokAt(i+1); {
+			case next == token.PERIOD, next == token.LBRACK, next == token.LPAREN:
+				parens = true // selectors, indexing and calls bind tighter
+			case next.Precedence() > def.prec:
+				parens = true
+			case prev == token.NOT, prev == token.ARROW:
+				parens = true
+			case prev.Precedence() > 0 && !endsOperand(i-2):
+				parens = true // a unary operator
+			case prev.Precedence() >= def.prec:
+				parens = true // binary operators are left-associative
+			}
+		}
+		offs := file.Offset(t.pos)
+		buf.WriteString(src[last:offs])
+		if parens {
+			buf.WriteString("(" + def.src + ")")
+		} else {
+			buf.WriteString(def.src)
+		}
+		last = offs + len(t.lit)
+	}
+	buf.WriteString(src[last:])
+	return buf.String()
+}
+
 type caseStatus uint
 
 const (
@@ -246,7 +778,6 @@ const (
 )
 
 func (m *matcher) tokenize(src []byte) ([]fullToken, error) {
-	m.typed = false
 	var s scanner.Scanner
 	fset := token.NewFileSet()
 	file := fset.AddFile("", fset.Base(), len(src))
@@ -255,6 +786,7 @@ func (m *matcher) tokenize(src []byte) ([]fullToken, error) {
 	onError := func(pos token.Position, msg string) {
 		switch msg { // allow certain extra chars
 		case `illegal character U+0024 '$'`:
+		case `illegal character U+003F '?'`: // as in "$?x"
 		case `illegal character U+007E '~'`:
 		default:
 			err = fmt.Errorf("%v: %s", pos, msg)
@@ -274,13 +806,16 @@ func (m *matcher) tokenize(src []byte) ([]fullToken, error) {
 
 	var toks []fullToken
 	for t := next(); t.tok != token.EOF; t = next() {
-		switch t.lit {
-		case "$": // continues below
-		case "~":
+		if len(toks) == 0 && (t.tok == token.TILDE || t.lit == "~") {
+			// Go 1.18 added "~" as a token for constraints
+			// like "~int", so only use it at the very start
 			toks = append(toks, fullToken{t.pos, tokAggressive, ""})
 			continue
-		case "switch", "select", "case":
-			if t.lit == "case" {
+		}
+		switch t.lit {
+		case "$": // continues below
+		case "switch", "select", "case", "default":
+			if t.lit == "case" || t.lit == "default" {
 				caseStat = caseNone
 			} else {
 				caseStat = caseNeedBlock
@@ -313,9 +848,17 @@ func (m *matcher) wildcard(pos token.Position, next func() fullToken, src []byte
 	wt := fullToken{pos, token.IDENT, wildPrefix}
 	t := next()
 	var info varInfo
-	if t.tok == token.MUL {
+	switch {
+	case t.tok == token.MUL:
 		t = next()
 		info.any = true
+		if t.tok == token.ADD {
+			t = next()
+			info.greedy = true
+		}
+	case t.tok == token.ILLEGAL && t.lit == "?":
+		t = next()
+		info.any, info.opt = true, true
 	}
 	if t.tok != token.IDENT {
 		return wt, fmt.Errorf("%v: $ must be followed by ident, got %v",
@@ -329,7 +872,7 @@ func (m *matcher) wildcard(pos token.Position, next func() fullToken, src []byte
 }
 
 type typeCheck struct {
-	op   string // "type", "asgn", "conv"
+	op   string // "type", "asgn", "conv", "impl"
 	expr ast.Expr
 }
 
@@ -337,8 +880,113 @@ type attribute interface{}
 
 type typProperty string
 
+// typUnderlying is a kind of underlying type, such as "slice". The basic
+// types are further split into kinds like "string", "int" for any integer,
+// or "signed" and "unsigned" for integers with and without a sign; "uint"
+// is the same as "unsigned".
 type typUnderlying string
 
+// rangeKind is the kind of value a range loop iterates over.
+type rangeKind string
+
+// objKind is the kind of object a name refers to, such as "const".
+type objKind string
+
+// nodeProperty is a property of a node that isn't just about its type,
+// such as where it is found.
+type nodeProperty string
+
+type missingField string
+
+// negAttr is an attribute prefixed with "!", which holds when the inner
+// attribute does not.
+type negAttr struct {
+	attr attribute
+}
+
+// directive matches declarations with a directive comment such as
+// "//go:embed" or "//go:noinline", whose text without the leading slashes
+// matches a regular expression.
+type directive struct {
+	rx *regexp.Regexp
+}
+
+// wildAttr applies an attribute to the node captured by a wildcard, instead
+// of the current node.
+type wildAttr struct {
+	info varInfo
+	attr attribute
+}
+
+// subPattern matches nodes which match a pattern as a whole. Its wildcards
+// must match the same nodes captured by the previous commands, if any.
+type subPattern struct {
+	node ast.Node
+}
+
+// docMatch matches declarations whose doc comment contains a regular
+// expression, such as "Deprecated: ". The text is that of
+// ast.CommentGroup.Text, without the comment markers nor directives.
+type docMatch struct {
+	rx *regexp.Regexp
+}
+
+// commentMatch matches nodes with a comment, attached to them or to any of
+// their children, whose text without the comment markers contains a regular
+// expression, such as "TODO".
+type commentMatch struct {
+	rx *regexp.Regexp
+}
+
+// tagMatch matches struct fields with a tag key whose value matches a
+// regular expression, as in `json:"-"`. A field is matched either directly
+// or via one of its names.
+type tagMatch struct {
+	key string
+	rx  *regexp.Regexp
+}
+
+// typeName matches expressions whose type, as printed by
+// types.TypeString, matches a regular expression. Packages are qualified
+// by their name, as in "*sql.NullString", or by their path, as in
+// "*database/sql.NullString".
+type typeName struct {
+	rx *regexp.Regexp
+}
+
+// pkgMatch matches names, selectors and calls referring to an object
+// declared in a package. As with -imports, the path may end in "/...".
+type pkgMatch string
+
+// fileGlob matches nodes in a file whose path, relative to the current
+// directory when possible, matches a glob. A glob without slashes matches
+// the base name, as in "*_test.go", and one ending in "/..." matches the
+// files under a directory, as in "internal/...".
+type fileGlob string
+
+// fileRx matches nodes in a file whose path, as with fileGlob, matches a
+// regular expression.
+type fileRx struct {
+	rx *regexp.Regexp
+}
+
+// funcMatch matches function declarations, and the nodes within them, whose
+// name or signature matches a regular expression. Methods are named after their
+// receiver type, as in "T.Close", and the signature is printed as in
+// "func (t *T) Close() error".
+type funcMatch struct {
+	rx *regexp.Regexp
+}
+
+// lenCheck compares a size of a node with a number. The size is either
+// its number of elements, its number of statements including nested ones,
+// or the number of lines it spans.
+type lenCheck struct {
+	of string      // "len", "stmts" or "lines"
+	op token.Token // token.EQL, token.LSS, etc
+	n  int
+}
+
 func (m *matcher) parseAttrs(src string) (attribute, error) {
 	toks, err := m.tokenize([]byte(src))
 	if err != nil {
@@ -353,14 +1001,45 @@ func (m *matcher) parseAttrs(src string) (attribute, error) {
 		return fullToken{tok: token.EOF, pos: t.pos}
 	}
 	t = next()
+	if t.tok == token.IDENT && isWildName(t.lit) {
+		// "$x:attr" applies attr to the node captured by $x
+		info := m.info(fromWildName(t.lit))
+		if t = next(); t.tok != token.COLON {
+			return nil, fmt.Errorf("%v: wanted :", t.pos)
+		}
+		attr, err := m.parseAttrs(src[t.pos.Offset+1:])
+		if err != nil {
+			return nil, err
+		}
+		return wildAttr{info, attr}, nil
+	}
+	neg := t.tok == token.NOT
+	if neg {
+		t = next()
+	}
 	op := t.lit
 	switch op { // the ones that don't take args
-	case "comp", "addr":
+	case "comp", "addr", "const", "isnil", "nilable":
 		m.typed = true
+		// no semicolon is added after keywords like "const"
+		if t = next(); t.tok != token.SEMICOLON && t.tok != token.EOF {
+			return nil, fmt.Errorf("%v: wanted EOF, got %v", t.pos, t.tok)
+		}
+		return negateAttr(typProperty(op), neg), nil
+	case "inloop", "unusedresult", "fmtconcat", "noopconv", "loopvar",
+		"narrowable", "boxing", "zeroinit", "hasdefault", "field",
+		"exported", "pure", "toplevel", "indefer", "intest", "def", "use",
+		"methodexpr", "methodvalue", "methodcall":
+		switch op {
+		case "inloop", "hasdefault", "field", "exported", "toplevel",
+			"indefer", "intest":
+		default:
+			m.typed = true
+		}
 		if t = next(); t.tok != token.SEMICOLON {
 			return nil, fmt.Errorf("%v: wanted EOF, got %v", t.pos, t.tok)
 		}
-		return typProperty(op), nil
+		return negateAttr(nodeProperty(op), neg), nil
 	}
 	opPos := t.pos
 	if t = next(); t.tok != token.LPAREN {
@@ -368,24 +1047,53 @@ func (m *matcher) parseAttrs(src string) (attribute, error) {
 	}
 	var attr attribute
 	switch op {
-	case "rx":
+	case "file":
 		t = next()
-		rxStr, err := strconv.Unquote(t.lit)
+		glob, err := strconv.Unquote(t.lit)
 		if err != nil {
 			return nil, fmt.Errorf("%v: %v", t.pos, err)
 		}
-		if !strings.HasPrefix(rxStr, "^") {
-			rxStr = "^" + rxStr
+		if _, err := path.Match(strings.TrimSuffix(glob, "/..."), ""); err != nil {
+			return nil, fmt.Errorf("%v: %v", t.pos, err)
 		}
-		if !strings.HasSuffix(rxStr, "$") {
-			rxStr = rxStr + "$"
+		attr = fileGlob(glob)
+	case "rx", "directive", "doc", "comment", "typename", "filerx", "infunc":
+		t = next()
+		rxStr, err := strconv.Unquote(t.lit)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", t.pos, err)
+		}
+		if op == "doc" || op == "comment" {
+			// comments are often many lines long, so only look
+			// for the expression within them
+			rxStr = "(?m)" + rxStr
+		} else {
+			rxStr = anchorRx(rxStr)
 		}
 		rx, err := regexp.Compile(rxStr)
 		if err != nil {
 			return nil, fmt.Errorf("%v: %v", t.pos, err)
 		}
 		attr = rx
-	case "type", "asgn", "conv":
+		switch op {
+		case "directive":
+			m.directives = true
+			attr = directive{rx}
+		case "doc":
+			m.docs = true
+			attr = docMatch{rx}
+		case "comment":
+			m.comments = append(m.comments, rx)
+			attr = commentMatch{rx}
+		case "typename":
+			m.typed = true
+			attr = typeName{rx}
+		case "filerx":
+			attr = fileRx{rx}
+		case "infunc":
+			attr = funcMatch{rx}
+		}
+	case "type", "asgn", "conv", "impl", "match", "pkg":
 		t = next()
 		start := t.pos.Offset
 		for open := 1; open > 0; t = next() {
@@ -399,24 +1107,103 @@ func (m *matcher) parseAttrs(src string) (attribute, error) {
 			}
 		}
 		end := t.pos.Offset - 1
-		typeStr := strings.TrimSpace(string(src[start:end]))
+		i -= 2 // since we went past RPAREN above
+		if op == "match" {
+			node, err := m.parseExpr(src[start:end])
+			if err != nil {
+				return nil, err
+			}
+			attr = subPattern{node}
+			break
+		}
+		if op == "pkg" {
+			path := strings.TrimSpace(src[start:end])
+			if unq, err := strconv.Unquote(path); err == nil {
+				path = unq
+			}
+			attr = pkgMatch(path)
+			m.typed = true
+			break
+		}
+		typeStr := quotePaths(strings.TrimSpace(string(src[start:end])))
 		typeExpr, err := parser.ParseExpr(typeStr)
 		if err != nil {
 			return nil, err
 		}
 		attr = typeCheck{op, typeExpr}
 		m.typed = true
-		i -= 2 // since we went past RPAREN above
 	case "is":
 		switch t = next(); t.lit {
 		case "basic", "array", "slice", "struct", "interface",
-			"pointer", "func", "map", "chan":
+			"pointer", "func", "map", "chan",
+			"bool", "string", "int", "uint", "signed", "unsigned",
+			"float", "complex":
 		default:
 			return nil, fmt.Errorf("%v: unknown type: %q", t.pos,
 				t.lit)
 		}
 		attr = typUnderlying(t.lit)
 		m.typed = true
+	case "range":
+		switch t = next(); t.lit {
+		case "slice", "array", "map", "chan", "string", "int", "func":
+		default:
+			return nil, fmt.Errorf("%v: unknown range kind: %q", t.pos,
+				t.lit)
+		}
+		attr = rangeKind(t.lit)
+		m.typed = true
+	case "obj":
+		switch t = next(); t.lit {
+		case "var", "const", "func", "type", "pkgname", "label":
+		default:
+			return nil, fmt.Errorf("%v: unknown object kind: %q", t.pos,
+				t.lit)
+		}
+		attr = objKind(t.lit)
+		m.typed = true
+	case "missing":
+		if t = next(); t.tok != token.IDENT {
+			return nil, fmt.Errorf("%v: wanted field name, got %v",
+				t.pos, t.tok)
+		}
+		attr = missingField(t.lit)
+		m.typed = true
+	case "tag":
+		t = next()
+		key, err := strconv.Unquote(t.lit)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", t.pos, err)
+		}
+		if t = next(); t.tok != token.COMMA {
+			return nil, fmt.Errorf("%v: wanted ,", t.pos)
+		}
+		t = next()
+		rxStr, err := strconv.Unquote(t.lit)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", t.pos, err)
+		}
+		rx, err := regexp.Compile(anchorRx(rxStr))
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", t.pos, err)
+		}
+		attr = tagMatch{key, rx}
+	case "len", "stmts", "lines":
+		lc := lenCheck{of: op, op: token.EQL}
+		switch t = next(); t.tok {
+		case token.EQL, token.NEQ, token.LSS, token.LEQ, token.GTR, token.GEQ:
+			lc.op = t.tok
+			t = next()
+		}
+		if t.tok != token.INT {
+			return nil, fmt.Errorf("%v: wanted length, got %v", t.pos, t.tok)
+		}
+		n, err := strconv.Atoi(t.lit)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", t.pos, err)
+		}
+		lc.n = n
+		attr = lc
 	default:
 		return nil, fmt.Errorf("%v: unknown op %q", opPos, op)
 	}
@@ -426,7 +1213,26 @@ func (m *matcher) parseAttrs(src string) (attribute, error) {
 	if t = next(); t.tok != token.SEMICOLON {
 		return nil, fmt.Errorf("%v: wanted EOF, got %v", t.pos, t.tok)
 	}
-	return attr, nil
+	return negateAttr(attr, neg), nil
+}
+
+// anchorRx makes a regular expression match whole strings only, unless it
+// was already anchored.
+func anchorRx(rxStr string) string {
+	if !strings.HasPrefix(rxStr, "^") {
+		rxStr = "^" + rxStr
+	}
+	if !strings.HasSuffix(rxStr, "$") {
+		rxStr = rxStr + "$"
+	}
+	return rxStr
+}
+
+func negateAttr(attr attribute, neg bool) attribute {
+	if neg {
+		return negAttr{attr}
+	}
+	return attr
 }
 
 // using a prefix is good enough for now
@@ -440,7 +1246,8 @@ func fromWildName(s string) int {
 	if !isWildName(s) {
 		return -1
 	}
-	n, err := strconv.Atoi(s[len(wildPrefix):])
+	s = strings.TrimPrefix(s, opWildPrefix)
+	n, err := strconv.Atoi(strings.TrimPrefix(s, wildPrefix))
 	if err != nil {
 		return -1
 	}
@@ -0,0 +1,202 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"fmt"
+	"go/scanner"
+	"go/token"
+	"html/template"
+	"sort"
+	"strings"
+)
+
+// htmlReport is what htmlTemplate is executed with for -format html.
+type htmlReport struct {
+	Total    int
+	Packages []*htmlPackage
+}
+
+type htmlPackage struct {
+	Path    string
+	Matches []htmlMatch
+}
+
+type htmlMatch struct {
+	jsonMatch
+
+	// Snippet is the first source line of the match, and Context the
+	// lines around it
+	Snippet template.HTML
+	Context []htmlLine
+}
+
+type htmlLine struct {
+	Number int
+	Code   template.HTML
+	Match  bool // part of the match
+}
+
+var htmlTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>gogrep report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+h2 { font-size: 1.1em; border-bottom: 1px solid #ccc; }
+.match { margin: 0.5em 0 1em; }
+.pos { font-family: monospace; color: #555; }
+.rule { font-weight: bold; }
+.error { color: #c00; }
+.warning { color: #b60; }
+.info { color: #06c; }
+summary { cursor: pointer; }
+code, pre { font-family: monospace; }
+pre { background: #f6f6f6; padding: 0.5em; margin: 0.3em 0; overflow-x: auto; }
+.hit { background: #fff3b0; display: inline-block; width: 100%; }
+.ln { color: #999; display: inline-block; width: 4em; text-align: right; margin-right: 1em; user-select: none; }
+.kw { color: #00c; }
+.str { color: #080; }
+.num { color: #a0a; }
+.com { color: #888; font-style: italic; }
+</style>
+</head>
+<body>
+<h1>gogrep report</h1>
+<p>{{.Total}} matches in {{len .Packages}} packages</p>
+{{- range .Packages}}
+<section>
+<h2>{{.Path}} ({{len .Matches}})</h2>
+{{- range .Matches}}
+<div class="match">
+<div class="pos">{{.File}}:{{.Start.Line}}:{{.Start.Column}}
+{{- with .Severity}} <span class="{{.}}">{{.}}</span>{{end}}
+{{- with .Rule}} <span class="rule">{{.}}</span>{{end}}
+{{- with .Message}}: {{.}}{{end}}</div>
+<details>
+<summary><code>{{.Snippet}}</code></summary>
+<pre>
+{{- range .Context}}<span{{if .Match}} class="hit"{{end}}><span class="ln">{{.Number}}</span>{{.Code}}</span>
+{{end -}}
+</pre>
+</details>
+</div>
+{{- end}}
+</section>
+{{- end}}
+</body>
+</html>
+`))
+
+// printHTML prints the matches of all rules as a standalone HTML report,
+// grouped by package, where each match shows its first line and expands to
+// the lines around it. The lines of context are given via -A, -B or -C, or
+// three by default.
+func (m *matcher) printHTML(rules []*rule, pkgs []loadPkg) error {
+	before, after := m.before, m.after
+	if before == 0 && after == 0 {
+		before, after = 3, 3
+	}
+	byFile := make(map[*token.File]*htmlPackage)
+	var report htmlReport
+	for _, pkg := range pkgs {
+		path := pkg.path
+		if path == "" {
+			// files given directly, like the go tool does
+			path = "command-line-arguments"
+		}
+		hpkg := &htmlPackage{Path: path}
+		for _, node := range pkg.nodes {
+			byFile[m.loader.fset.File(node.Pos())] = hpkg
+		}
+		report.Packages = append(report.Packages, hpkg)
+	}
+	for _, r := range rules {
+		for _, sub := range r.all {
+			tf := m.loader.fset.File(sub.node.Pos())
+			hpkg := byFile[tf]
+			if hpkg == nil {
+				continue
+			}
+			hm := htmlMatch{jsonMatch: m.jsonMatch(r, sub)}
+			hm.Snippet = highlightGo(hm.Match)
+			if src := m.source(tf); src != nil {
+				start, end := hm.Start.Line, tf.Line(sub.node.End())
+				from, to := start-before, end+after
+				if from < 1 {
+					from = 1
+				}
+				if n := tf.LineCount(); to > n {
+					to = n
+				}
+				for line := from; line <= to; line++ {
+					hm.Context = append(hm.Context, htmlLine{
+						Number: line,
+						Code:   highlightGo(sourceLine(tf, src, line)),
+						Match:  line >= start && line <= end,
+					})
+				}
+				hm.Snippet = highlightGo(strings.TrimSpace(sourceLine(tf, src, start)))
+			}
+			hpkg.Matches = append(hpkg.Matches, hm)
+			report.Total++
+		}
+	}
+	kept := report.Packages[:0]
+	for _, hpkg := range report.Packages {
+		if len(hpkg.Matches) == 0 {
+			continue
+		}
+		sort.SliceStable(hpkg.Matches, func(i, j int) bool {
+			mi, mj := hpkg.Matches[i], hpkg.Matches[j]
+			if mi.File != mj.File {
+				return mi.File < mj.File
+			}
+			return mi.Start.Offset < mj.Start.Offset
+		})
+		kept = append(kept, hpkg)
+	}
+	report.Packages = kept
+	return htmlTemplate.Execute(m.out, report)
+}
+
+// highlightGo returns a line of Go source as HTML, with its keywords,
+// literals and comments wrapped in spans classed by kind. Lines are scanned
+// on their own, so tokens spanning many lines may not be recognised.
+func highlightGo(line string) template.HTML {
+	fset := token.NewFileSet()
+	file := fset.AddFile("", -1, len(line))
+	var s scanner.Scanner
+	s.Init(file, []byte(line), func(token.Position, string) {}, scanner.ScanComments)
+	var buf strings.Builder
+	last := 0
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		class := ""
+		switch {
+		case tok.IsKeyword():
+			class = "kw"
+		case tok == token.STRING || tok == token.CHAR:
+			class = "str"
+		case tok == token.INT || tok == token.FLOAT || tok == token.IMAG:
+			class = "num"
+		case tok == token.COMMENT:
+			class = "com"
+		}
+		off := file.Offset(pos)
+		end := off + len(lit)
+		if class == "" || off < last || end > len(line) {
+			continue
+		}
+		buf.WriteString(template.HTMLEscapeString(line[last:off]))
+		fmt.Fprintf(&buf, `<span class="%s">%s</span>`, class, template.HTMLEscapeString(line[off:end]))
+		last = end
+	}
+	buf.WriteString(template.HTMLEscapeString(line[last:]))
+	return template.HTML(buf.String())
+}
@@ -4,12 +4,14 @@
 package main
 
 import (
+	"fmt"
 	"go/ast"
 	"go/build"
 	"go/parser"
 	"go/token"
 	"go/types"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/kisielk/gotool"
@@ -20,20 +22,121 @@ type nodeLoader struct {
 	wd   string
 	ctx  *build.Context
 	fset *token.FileSet
+
+	// imports, if any, are the import paths that a file must all
+	// import to be loaded; see importMatches
+	imports []string
+}
+
+// wantFile reports whether a file imports all the paths in l.imports.
+func (l nodeLoader) wantFile(f *ast.File) bool {
+	for _, want := range l.imports {
+		found := false
+		for _, imp := range f.Imports {
+			path, err := strconv.Unquote(imp.Path.Value)
+			if err == nil && importMatches(want, path) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// importMatches reports whether an import path matches a pattern, which is
+// either an exact import path or a path prefix ending in "/...". As with Go
+// package patterns, "net/..." matches both "net" and "net/http".
+func importMatches(pattern, path string) bool {
+	if prefix := strings.TrimSuffix(pattern, "/..."); prefix != pattern {
+		return path == prefix || strings.HasPrefix(path, prefix+"/")
+	}
+	return path == pattern
 }
 
 type loadPkg struct {
 	path  string
 	nodes []ast.Node
 	info  types.Info
+	tpkg  *types.Package // only when typed
 }
 
-func (l nodeLoader) untyped(args []string, recurse bool) ([]loadPkg, error) {
+// importPaths expands the package patterns and file globs in args. Unlike
+// gotool, it errors on arguments that match nothing.
+func (l nodeLoader) importPaths(args []string) ([]string, error) {
 	gctx := gotool.Context{BuildContext: *l.ctx}
-	paths := gctx.ImportPaths(args)
+	if len(args) == 0 {
+		return gctx.ImportPaths(args), nil
+	}
+	var paths []string
+	for _, arg := range args {
+		if !strings.ContainsAny(arg, "*?[") {
+			expanded := gctx.ImportPaths([]string{arg})
+			if len(expanded) == 0 {
+				return nil, fmt.Errorf("%s: matched no packages", arg)
+			}
+			paths = append(paths, expanded...)
+			continue
+		}
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", arg, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("%s: matched no files", arg)
+		}
+		for _, match := range matches {
+			if !strings.HasSuffix(match, ".go") && !filepath.IsAbs(match) &&
+				!build.IsLocalImport(match) {
+				// a directory, which must be a local import
+				match = "." + string(filepath.Separator) + match
+			}
+			paths = append(paths, match)
+		}
+	}
+	return paths, nil
+}
+
+func (l nodeLoader) untyped(args []string, recurse bool) ([]loadPkg, error) {
 	var pkgs []loadPkg
+	err := l.untypedEach(args, recurse, func(pkg loadPkg) error {
+		pkgs = append(pkgs, pkg)
+		return nil
+	})
+	return pkgs, err
+}
+
+// untypedEach is like untyped, but calls fn with each package as soon as it
+// is loaded, so that they don't all need to be kept in memory at once. Loading
+// stops at the first error returned by fn, which is returned.
+func (l nodeLoader) untypedEach(args []string, recurse bool, fn func(loadPkg) error) error {
+	paths, err := l.importPaths(args)
+	if err != nil {
+		return err
+	}
 	var cur loadPkg
+	// files may be reached via multiple arguments, like "./..." and
+	// "./foo.go"
+	doneFiles := map[string]bool{}
 	addFile := func(path string) error {
+		if abs, err := filepath.Abs(path); err == nil {
+			if doneFiles[abs] {
+				return nil
+			}
+			doneFiles[abs] = true
+		}
+		if len(l.imports) > 0 {
+			// only parse the imports first, as it's much cheaper
+			f, err := parser.ParseFile(token.NewFileSet(), path, nil, parser.ImportsOnly)
+			if err != nil {
+				return err
+			}
+			if !l.wantFile(f) {
+				return nil
+			}
+		}
 		f, err := parser.ParseFile(l.fset, path, nil, parser.ParseComments)
 		if err != nil {
 			return err
@@ -49,9 +152,11 @@ func (l nodeLoader) untyped(args []string, recurse bool) ([]loadPkg, error) {
 		}
 		done[path] = true
 		if len(cur.nodes) > 0 {
-			pkgs = append(pkgs, cur)
-			cur = loadPkg{path: path}
+			if err := fn(cur); err != nil {
+				return err
+			}
 		}
+		cur = loadPkg{path: path}
 		pkg, err := l.ctx.Import(path, l.wd, 0)
 		if err != nil {
 			return err
@@ -85,23 +190,25 @@ func (l nodeLoader) untyped(args []string, recurse bool) ([]loadPkg, error) {
 	for _, path := range paths {
 		if strings.HasSuffix(path, ".go") {
 			if err := addFile(path); err != nil {
-				return nil, err
+				return err
 			}
 			continue
 		}
 		if err := addPkg(path, true); err != nil {
-			return nil, err
+			return err
 		}
 	}
 	if len(cur.nodes) > 0 {
-		pkgs = append(pkgs, cur)
+		return fn(cur)
 	}
-	return pkgs, nil
+	return nil
 }
 
 func (l nodeLoader) typed(args []string, recurse bool) ([]loadPkg, error) {
-	gctx := gotool.Context{BuildContext: *l.ctx}
-	paths := gctx.ImportPaths(args)
+	paths, err := l.importPaths(args)
+	if err != nil {
+		return nil, err
+	}
 	conf := loader.Config{Fset: l.fset, Cwd: l.wd, Build: l.ctx}
 	if _, err := conf.FromArgs(paths, true); err != nil {
 		return nil, err
@@ -129,9 +236,13 @@ func (l nodeLoader) typed(args []string, recurse bool) ([]loadPkg, error) {
 		}
 		done[path] = true
 		pkg := prog.Package(path)
-		lpkg := loadPkg{path: path, info: pkg.Info}
+		lpkg := loadPkg{path: path, info: pkg.Info, tpkg: pkg.Pkg}
 		for _, file := range pkg.Files {
-			lpkg.nodes = append(lpkg.nodes, file)
+			// packages are type-checked as a whole, so we can
+			// only skip walking the files
+			if l.wantFile(file) {
+				lpkg.nodes = append(lpkg.nodes, file)
+			}
 		}
 		pkgs = append(pkgs, lpkg)
 		if !recurse {
@@ -7,6 +7,7 @@ import (
 	"bytes"
 	"fmt"
 	"go/build"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -111,6 +112,794 @@ func TestLoad(t *testing.T) {
 			[]string{"-x", "1, 2, 3, 4, 5", "testdata/exprlist.go"},
 			`testdata/exprlist.go:3:13: 1, 2, 3, 4, 5`,
 		},
+		{
+			[]string{
+				"-x", "$ch := make(chan $_)", "-p", "func",
+				"-g", "$ch <- $_", "-v", "go $_($*_)", "-v", "select { $*_ }",
+				"testdata/chans.go",
+			},
+			`
+				testdata/chans.go:3:1: func sendNoReceiver() { ch := make(chan int); ch <- 1; }
+				testdata/chans.go:27:1: func sendShadowed(out chan int) { ch := make(chan int); { ch := out; ch <- 1; }; _ = ch; }
+			`,
+		},
+		{
+			[]string{
+				"-equal", "typed",
+				"-x", "$ch := make(chan $_)", "-p", "func",
+				"-g", "$ch <- $_", "-v", "go $_($*_)", "-v", "select { $*_ }",
+				"testdata/chans.go",
+			},
+			`testdata/chans.go:3:1: func sendNoReceiver() { ch := make(chan int); ch <- 1; }`,
+		},
+		{
+			[]string{"-x", "var _ = $x", "testdata/two/*.go"},
+			`
+				testdata/two/file1.go:3:1: var _ = "file1"
+				testdata/two/file2.go:3:1: var _ = "file2"
+			`,
+		},
+		{
+			[]string{"-x", "var _ = $x", "testdata/imports/u*.go", "testdata/imports/utf8.go"},
+			`
+				testdata/imports/unicode.go:8:1: var _ = strings.Repeat(string(unicode.MaxASCII), 2)
+				testdata/imports/utf8.go:5:1: var _ = utf8.RuneError
+			`,
+		},
+		{
+			[]string{"-x", "var _ = $x", "p1/p2", "p1/...", "testdata/src/p1/p2/file1.go"},
+			`
+				testdata/src/p1/file1.go:3:1: var _ = "file1"
+				testdata/src/p1/p2/file1.go:3:1: var _ = "file1"
+				testdata/src/p1/p2/file2.go:3:1: var _ = "file2"
+				testdata/src/p1/p3/testp/file1.go:3:1: var _ = "file1"
+				testdata/src/p1/testp/file1.go:3:1: var _ = "file1"
+			`,
+		},
+		{
+			[]string{"-x", "var _ = $x", "testdata/src/p1/p*"},
+			`
+				testdata/src/p1/p2/file1.go:3:1: var _ = "file1"
+				testdata/src/p1/p2/file2.go:3:1: var _ = "file2"
+			`,
+		},
+		{
+			[]string{"-x", "var _ = $x", "testdata/two/*.go", "testdata/nomatch*.go"},
+			fmt.Errorf("testdata/nomatch*.go: matched no files"),
+		},
+		{
+			[]string{"-x", "var _ = $x", "p1/nomatch/..."},
+			fmt.Errorf("p1/nomatch/...: matched no packages"),
+		},
+		{
+			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "type(string)", "testdata/imports/u*.go"},
+			`
+				testdata/imports/unicode.go:8:9: strings.Repeat(string(unicode.MaxASCII), 2)
+			`,
+		},
+		{
+			[]string{"-x", "go $_($*_)", "-a", "loopvar", "testdata/loopvar.go"},
+			`testdata/loopvar.go:7:3: go func() { use(v); }()`,
+		},
+		{
+			[]string{"-x", "func() { $*_ }", "-a", "loopvar", "testdata/loopvar.go"},
+			`
+				testdata/loopvar.go:7:6: func() { use(v); }
+				testdata/loopvar.go:13:9: func() { use(i); }
+			`,
+		},
+		{
+			[]string{"-x", "$x", "-a", "narrowable", "testdata/narrow.go"},
+			`
+				testdata/narrow.go:5:16: rw
+				testdata/narrow.go:18:19: v
+			`,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-collect", "x", "p1/..."},
+			`
+				$x 4 "file1"
+				$x 1 "file2"
+			`,
+		},
+		{
+			[]string{"-x", "var _ = $f($*a)", "-collect", "$f", "-collect", "$*a", "testdata/exprlist.go", "testdata/imports/unicode.go"},
+			`
+				$f 1 foo
+				$f 1 strings.Repeat
+				$a 1 1, 2, 3, 4, 5
+				$a 1 string(unicode.MaxASCII), 2
+			`,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-collect", "y", "p1/..."},
+			fmt.Errorf("-collect y: $y was not captured"),
+		},
+		{
+			[]string{"-x", "var _ = $f($*a)", "-o", "$f", "testdata/exprlist.go", "testdata/imports/unicode.go"},
+			`
+				testdata/exprlist.go:3:1: foo
+				testdata/imports/unicode.go:8:1: strings.Repeat
+			`,
+		},
+		{
+			[]string{"-x", "var _ = $f($*a)", "-o", "$*a -> $f", "testdata/exprlist.go"},
+			`testdata/exprlist.go:3:1: 1, 2, 3, 4, 5 -> foo`,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-o", "$y", "p1/..."},
+			fmt.Errorf("-o $y: $y was not captured"),
+		},
+		{
+			[]string{"-x", "var _ = $x", "-limit", "3", "p1/..."},
+			`
+				testdata/src/p1/file1.go:3:1: var _ = "file1"
+				testdata/src/p1/p2/file1.go:3:1: var _ = "file1"
+				testdata/src/p1/p2/file2.go:3:1: var _ = "file2"
+			`,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-sample", "4", "-count", "all", "p1/..."},
+			`4`,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-count", "all", "p1/..."},
+			`5`,
+		},
+		{
+			[]string{"-c", "-x", "var _ = $x", "p1/..."},
+			`5`,
+		},
+		{
+			[]string{"-c", "-count", "file", "-x", "var _ = $x", "p1/p2"},
+			`
+				testdata/src/p1/p2/file1.go: 1
+				testdata/src/p1/p2/file2.go: 1
+			`,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-count", "package", "p1/..."},
+			`
+				p1: 1
+				p1/p2: 2
+				p1/p3/testp: 1
+				p1/testp: 1
+			`,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-count", "file", "p1/p2"},
+			`
+				testdata/src/p1/p2/file1.go: 1
+				testdata/src/p1/p2/file2.go: 1
+			`,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-count", "package", "testdata/exprlist.go", "testdata/imports/unicode.go"},
+			`command-line-arguments: 2`,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-count", "dir", "p1/..."},
+			fmt.Errorf(`-count must be all, file or package, got "dir"`),
+		},
+		{
+			[]string{"-x", "var $_ $_", "-a", `directive("go:embed .*")`, "-comments", "testdata/directives/directives.go"},
+			`
+				testdata/directives/directives.go:7:1: //go:embed directives.go
+				testdata/directives/directives.go:8:1: var self string
+			`,
+		},
+		{
+			[]string{"-x", "selfBytes", "-p", "1", "-a", `directive("go:embed .*")`, "-comments", "testdata/directives/directives.go"},
+			`
+				testdata/directives/directives.go:14:2: //go:embed directives.go
+				testdata/directives/directives.go:15:2: selfBytes []byte
+			`,
+		},
+		{
+			[]string{"-x", "func $_() {}", "-a", `directive("go:noinline")`, "-comments", "testdata/directives/directives.go"},
+			`
+				testdata/directives/directives.go:18:1: //go:noinline
+				testdata/directives/directives.go:19:1: func noInline() { }
+				testdata/directives/directives.go:26:1: //go:noinline
+				testdata/directives/directives.go:27:1: func documented() { }
+			`,
+		},
+		{
+			[]string{"-x", "type $_ $_", "-a", `!directive("go:generate.*")`, "testdata/directives/directives.go"},
+			``,
+		},
+		{
+			[]string{"-x", "panic($_)", "-a", "intest", "testdata/intest/*.go"},
+			`testdata/intest/intest_test.go:7:3: panic("wrong")`,
+		},
+		{
+			[]string{"-x", "panic($_)", "-a", "!intest", "testdata/intest/*.go"},
+			`testdata/intest/intest.go:6:2: panic(compute())`,
+		},
+		{
+			[]string{"-x", "panic($_)", "-a", `!file("*_test.go")`, "testdata/intest/*.go"},
+			`testdata/intest/intest.go:6:2: panic(compute())`,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-a", `file("p1/p2/...")`, "p1/..."},
+			``,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-a", `file("*/src/p1/p2/...")`, "p1/..."},
+			`
+				testdata/src/p1/p2/file1.go:3:1: var _ = "file1"
+				testdata/src/p1/p2/file2.go:3:1: var _ = "file2"
+			`,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-a", `file("testdata/src/p1/*/file1.go")`, "p1/..."},
+			`
+				testdata/src/p1/p2/file1.go:3:1: var _ = "file1"
+				testdata/src/p1/testp/file1.go:3:1: var _ = "file1"
+			`,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-a", `filerx(".*/p[23]/.*")`, "p1/..."},
+			`
+				testdata/src/p1/p2/file1.go:3:1: var _ = "file1"
+				testdata/src/p1/p2/file2.go:3:1: var _ = "file2"
+				testdata/src/p1/p3/testp/file1.go:3:1: var _ = "file1"
+			`,
+		},
+		{
+			[]string{"-x", "$f()", "-group", "testdata/group/group.go"},
+			`
+				testdata/group/group.go:5:1: func (t *T) Close() error
+				  testdata/group/group.go:6:2: flush()
+				testdata/group/group.go:10:1: func flush()
+				  testdata/group/group.go:11:2: sync()
+				  testdata/group/group.go:12:2: sync()
+				testdata/group/group.go:15:1: var x, y
+				  testdata/group/group.go:15:12: sync()
+				testdata/group/group.go:17:1: func TestFlush()
+				  testdata/group/group.go:18:2: flush()
+			`,
+		},
+		{
+			[]string{"-x", "$f()", "-a", `infunc("T.*|Test.*")`, "testdata/group/group.go"},
+			`
+				testdata/group/group.go:6:2: flush()
+				testdata/group/group.go:18:2: flush()
+			`,
+		},
+		{
+			[]string{"-x", "$f()", "-a", "infunc(`func .*\\) error`)", "testdata/group/group.go"},
+			`testdata/group/group.go:6:2: flush()`,
+		},
+		{
+			[]string{"-x", "func $_($*_) { $*_ }", "-a", `!infunc("T.*|Test.*|sync")`, "testdata/group/group.go"},
+			`testdata/group/group.go:10:1: func flush() { sync(); sync(); }`,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-a", `file("[")`, "p1/..."},
+			fmt.Errorf("syntax error in pattern"),
+		},
+		{
+			[]string{"-x", "var $x = $_", "-a", "$x:type(scope/a.Handle)", "scope/c"},
+			`testdata/src/scope/c/c.go:5:1: var h = b.Get()`,
+		},
+		{
+			[]string{"-x", "var $x = $_", "-a", "$x:type(a.Handle)", "scope/c"},
+			`testdata/src/scope/c/c.go:5:1: var h = b.Get()`,
+		},
+		{
+			[]string{"-x", "var $x = $_", "-a", "$x:type(scope/nomatch.Handle)", "scope/c"},
+			``,
+		},
+		{
+			[]string{"-x", "var $x = $_", "-a", "$x:type(*encoding/json.Decoder)", "scope/c"},
+			``,
+		},
+		{
+			[]string{"-x", "func $_() {}", "-a", `directive("nolint.*")`, "-comments", "testdata/directives/nolint.go"},
+			`
+				testdata/directives/nolint.go:3:1: //nolint:errcheck // always nil
+				testdata/directives/nolint.go:4:1: func unchecked() { }
+			`,
+		},
+		{
+			[]string{"-x", "$_", "-a", `directive("go:build.*")`, "-comments", "-p", "0", "testdata/directives/directives.go"},
+			`
+				testdata/directives/directives.go:1:1: //go:build !nodirectives
+				testdata/directives/directives.go:3:1: package directives; import _ "embed"; var self string; var ( plain = 1; selfBytes []byte; ); func noInline() { }; type generated struct{}; func documented() { }
+			`,
+		},
+		{
+			[]string{"-x", "func $_() {}", "-a", `doc("^Deprecated: ")`, "-comments", "testdata/docs/docs.go"},
+			`
+				testdata/docs/docs.go:3:1: // Old does something.
+				testdata/docs/docs.go:4:1: //
+				testdata/docs/docs.go:5:1: // Deprecated: use New instead.
+				testdata/docs/docs.go:6:1: func Old() { }
+			`,
+		},
+		{
+			[]string{"-x", "func $_() {}", "-a", `doc("^Deprecated: ")`, "testdata/docs/docs.go"},
+			`testdata/docs/docs.go:6:1: func Old() { }`,
+		},
+		{
+			[]string{"-x", "func $_() {}", "-a", `doc("TODO\\(\\w+\\):")`, "-comments", "testdata/docs/docs.go"},
+			`
+				testdata/docs/docs.go:11:1: // TODO(someone): document this.
+				testdata/docs/docs.go:12:1: func undocumented() { }
+			`,
+		},
+		{
+			[]string{"-x", "$x", "-a", `doc("^Deprecated:")`, "-comments", "testdata/docs/docs.go"},
+			`
+				testdata/docs/docs.go:3:1: // Old does something.
+				testdata/docs/docs.go:4:1: //
+				testdata/docs/docs.go:5:1: // Deprecated: use New instead.
+				testdata/docs/docs.go:6:1: func Old() { }
+				testdata/docs/docs.go:15:2: // Deprecated: use T.
+				testdata/docs/docs.go:16:2: OldT int
+				testdata/docs/docs.go:22:1: /* Block is documented with a block comment. Deprecated: use nothing. */
+				testdata/docs/docs.go:27:1: var Block int
+				testdata/docs/docs.go:22:1: /* Block is documented with a block comment. Deprecated: use nothing. */
+				testdata/docs/docs.go:27:5: Block int
+			`,
+		},
+		{
+			[]string{"-x", "$_ = $_", "-a", `comment("^ ?TODO")`, "-comments", "testdata/comments/comments.go"},
+			`
+				testdata/comments/comments.go:4:2: // TODO: handle the error
+				testdata/comments/comments.go:5:2: _ = g()
+			`,
+		},
+		{
+			[]string{"-x", "h()", "-a", `comment("TODO")`, "-comments", "testdata/comments/comments.go"},
+			`
+				testdata/comments/comments.go:7:6: // TODO(someone): remove
+				testdata/comments/comments.go:7:2: h()
+				testdata/comments/comments.go:12:2: /* FIXME: not a TODO */
+				testdata/comments/comments.go:13:2: h()
+			`,
+		},
+		{
+			[]string{"-x", "h()", "-a", `!comment("TODO")`, "testdata/comments/comments.go"},
+			`testdata/comments/comments.go:10:2: h()`,
+		},
+		{
+			[]string{"-x", "func $_() { $*_ }", "-a", `comment("TODO\\(\\w+\\)")`, "-comments", "testdata/comments/comments.go"},
+			`
+				testdata/comments/comments.go:7:6: // TODO(someone): remove
+				testdata/comments/comments.go:3:1: func f() { _ = g(); h(); h(); h(); }
+			`,
+		},
+		{
+			[]string{"-x", "func $f() { $*_ }", "-a", "lines(>2)", "testdata/sizes/sizes.go"},
+			`
+				testdata/sizes/sizes.go:5:1: func long() { println(1); println(2); println(3); }
+			`,
+		},
+		{
+			[]string{"-x", "func $f() { $*body }", "-a", "$*body:lines(<3)", "-a", "$*body:stmts(>0)", "testdata/sizes/sizes.go"},
+			`testdata/sizes/sizes.go:3:1: func short() { println(); }`,
+		},
+		{
+			[]string{"-vars", "-x", "foo($x, $*args, $_, $x)", "-g", "bar()", "-s", "bar($x, $*args)"},
+			`
+				-x $x $*args
+				-g
+				-s $x $*args
+			`,
+		},
+		{
+			[]string{"-vars", "-x", "for $*init; $cond; $*_ { $*body }", "-a", "inloop", "-p", "1"},
+			`-x $*init $cond $*body`,
+		},
+		{
+			[]string{"-explain", "-x", "foo($x, $*args, 1, $?y)", "-a", "$x:!is(slice)", "-s", "bar($?y)", "-p", "1"},
+			`
+				-x foo($x, $*args, 1, $?y)
+				  CallExpr
+				    Ident foo
+				    Ident $x: wildcard
+				    Ident $*args: list wildcard
+				    BasicLit 1
+				    Ident $?y: optional wildcard
+				-a $x:!is(slice)
+				  on $x: not typUnderlying slice
+				-s bar($?y)
+				  CallExpr
+				    Ident bar
+				    Ident $?y: optional wildcard
+				-p 1
+			`,
+		},
+		{
+			[]string{"-explain", "-x", "if $c { $*+_ }; x++", "-a", "match($f($_))"},
+			`
+				-x if $c { $*+_ }; x++
+				  stmtList (2)
+				    IfStmt
+				      Ident $c: wildcard
+				      BlockStmt
+				        ExprStmt $*+_: greedy list wildcard
+				    IncDecStmt ++
+				      Ident x
+				-a match($f($_))
+				  subPattern
+				    CallExpr
+				      Ident $f: wildcard
+				      Ident $_: wildcard
+			`,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-imports", "unicode/utf8", "./testdata/imports"},
+			`testdata/imports/utf8.go:5:1: var _ = utf8.RuneError`,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-imports", "unicode/utf", "./testdata/imports"},
+			``,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-imports", "unicode/...", "./testdata/imports"},
+			`
+				testdata/imports/unicode.go:8:1: var _ = strings.Repeat(string(unicode.MaxASCII), 2)
+				testdata/imports/utf8.go:5:1: var _ = utf8.RuneError
+			`,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-imports", "unicode/...", "-imports", "strings", "./testdata/imports"},
+			`testdata/imports/unicode.go:8:1: var _ = strings.Repeat(string(unicode.MaxASCII), 2)`,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-imports", "strings", "testdata/imports/utf8.go", "testdata/imports/unicode.go"},
+			`testdata/imports/unicode.go:8:1: var _ = strings.Repeat(string(unicode.MaxASCII), 2)`,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "type(string)", "-imports", "unicode/utf8", "./testdata/imports"},
+			``,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "type(string)", "-imports", "unicode", "./testdata/imports"},
+			`testdata/imports/unicode.go:8:9: strings.Repeat(string(unicode.MaxASCII), 2)`,
+		},
+		{
+			[]string{"-f", "testdata/rules/calls.gogrep", "testdata/group/group.go"},
+			`
+				testdata/group/group.go:6:2: flushes: flush()
+				testdata/group/group.go:18:2: flushes: flush()
+				testdata/group/group.go:11:2: syncs: sync()
+				testdata/group/group.go:12:2: syncs: sync()
+				testdata/group/group.go:15:5: syncs: x, y = sync(), 3
+			`,
+		},
+		{
+			[]string{"-count", "all", "-f", "testdata/rules/calls.gogrep", "testdata/group/group.go"},
+			`
+				flushes: 2
+				syncs: 3
+			`,
+		},
+		{
+			[]string{"-f", "testdata/rules/lint.gogrep", "testdata/group/group.go"},
+			`
+				testdata/group/group.go:6:2: warning: flush: do not call flush directly
+				testdata/group/group.go:18:2: warning: flush: do not call flush directly
+				testdata/group/group.go:11:2: info: sync: sync()
+				testdata/group/group.go:12:2: info: sync: sync()
+				testdata/group/group.go:15:12: info: sync: sync()
+			`,
+		},
+		{
+			[]string{"-f", "testdata/rules/badfield.gogrep", "testdata/group/group.go"},
+			fmt.Errorf(`testdata/rules/badfield.gogrep:3: unknown severity "fatal"`),
+		},
+		{
+			[]string{"-f", "testdata/rules/badmsg.gogrep", "testdata/group/group.go"},
+			fmt.Errorf("rule a: message: $y was not captured"),
+		},
+		{
+			[]string{"-x", "flush()", "testdata/suppress/suppress.go"},
+			`
+				testdata/suppress/suppress.go:5:2: flush()
+				testdata/suppress/suppress.go:6:2: flush()
+				testdata/suppress/suppress.go:7:2: flush()
+				testdata/suppress/suppress.go:8:2: flush()
+				testdata/suppress/suppress.go:13:2: flush()
+			`,
+		},
+		{
+			[]string{"-f", "testdata/rules/flush.gogrep", "testdata/suppress/suppress.go"},
+			`
+				testdata/suppress/suppress.go:5:2: flush: flush()
+				testdata/suppress/suppress.go:8:2: flush: flush()
+			`,
+		},
+		{
+			[]string{"-suppressed", "-f", "testdata/rules/flush.gogrep", "testdata/suppress/suppress.go"},
+			`
+				testdata/suppress/suppress.go:4:2: flush: flush()
+				testdata/suppress/suppress.go:6:2: flush: flush()
+				testdata/suppress/suppress.go:7:2: flush: flush()
+				testdata/suppress/suppress.go:13:2: flush: flush()
+			`,
+		},
+		{
+			[]string{"-f", "testdata/rules/calls.gogrep", "-x", "foo()", "testdata/group/group.go"},
+			fmt.Errorf("-f cannot be used with commands"),
+		},
+		{
+			[]string{"-f", "testdata/rules/bad.gogrep", "testdata/group/group.go"},
+			fmt.Errorf("testdata/rules/bad.gogrep:1: command outside of a rule"),
+		},
+		{
+			[]string{"-f", "testdata/rules/twice.gogrep", "testdata/group/group.go"},
+			fmt.Errorf("testdata/rules/twice.gogrep:3: rule a is defined twice"),
+		},
+		{
+			[]string{"-json", "-x", "$f()", "-limit", "1", "testdata/group/group.go"},
+			`{"file":"testdata/group/group.go","start":{"line":6,"column":2,"offset":61},"end":{"line":6,"column":9,"offset":68},"match":"flush()","captures":{"f":"flush"}}`,
+		},
+		{
+			[]string{"-json", "-x", `sync() \| return $x`, "-limit", "2", "testdata/group/group.go"},
+			`
+				{"file":"testdata/group/group.go","start":{"line":7,"column":2,"offset":70},"end":{"line":7,"column":12,"offset":80},"match":"return nil","captures":{"x":"nil"},"alternative":2}
+				{"file":"testdata/group/group.go","start":{"line":11,"column":2,"offset":100},"end":{"line":11,"column":8,"offset":106},"match":"sync()","alternative":1}
+			`,
+		},
+		{
+			[]string{"-json", "-f", "testdata/rules/lint.gogrep", "testdata/group/group.go"},
+			`
+				{"file":"testdata/group/group.go","start":{"line":6,"column":2,"offset":61},"end":{"line":6,"column":9,"offset":68},"match":"flush()","rule":"flush","message":"do not call flush directly","severity":"warning","captures":{"f":"flush"}}
+				{"file":"testdata/group/group.go","start":{"line":18,"column":2,"offset":160},"end":{"line":18,"column":9,"offset":167},"match":"flush()","rule":"flush","message":"do not call flush directly","severity":"warning","captures":{"f":"flush"}}
+				{"file":"testdata/group/group.go","start":{"line":11,"column":2,"offset":100},"end":{"line":11,"column":8,"offset":106},"match":"sync()","rule":"sync","severity":"info"}
+				{"file":"testdata/group/group.go","start":{"line":12,"column":2,"offset":108},"end":{"line":12,"column":8,"offset":114},"match":"sync()","rule":"sync","severity":"info"}
+				{"file":"testdata/group/group.go","start":{"line":15,"column":12,"offset":129},"end":{"line":15,"column":18,"offset":135},"match":"sync()","rule":"sync","severity":"info"}
+			`,
+		},
+		{
+			[]string{"-json", "-f", "testdata/rules/files.gogrep", "p1/..."},
+			`
+				{"file":"testdata/src/p1/file1.go","start":{"line":3,"column":9,"offset":20},"end":{"line":3,"column":16,"offset":27},"match":"\"file1\"","rule":"file1"}
+				{"file":"testdata/src/p1/p2/file1.go","start":{"line":3,"column":9,"offset":20},"end":{"line":3,"column":16,"offset":27},"match":"\"file1\"","rule":"file1"}
+				{"file":"testdata/src/p1/p2/file2.go","start":{"line":3,"column":9,"offset":20},"end":{"line":3,"column":16,"offset":27},"match":"\"file2\"","rule":"file2"}
+				{"file":"testdata/src/p1/p3/testp/file1.go","start":{"line":3,"column":9,"offset":23},"end":{"line":3,"column":16,"offset":30},"match":"\"file1\"","rule":"file1"}
+				{"file":"testdata/src/p1/testp/file1.go","start":{"line":3,"column":9,"offset":23},"end":{"line":3,"column":16,"offset":30},"match":"\"file1\"","rule":"file1"}
+			`,
+		},
+		{
+			[]string{"-format", "sarif", "-x", "flush()", "-limit", "1", "testdata/group/group.go"},
+			`
+				{
+				  "version": "2.1.0",
+				  "$schema": "https://json.schemastore.org/sarif-2.1.0.json",
+				  "runs": [
+				    {
+				      "tool": {
+				        "driver": {
+				          "name": "gogrep",
+				          "informationUri": "https://github.com/mvdan/gogrep",
+				          "rules": [
+				            {
+				              "id": "query",
+				              "shortDescription": {
+				                "text": "query"
+				              },
+				              "defaultConfiguration": {
+				                "level": "warning"
+				              }
+				            }
+				          ]
+				        }
+				      },
+				      "results": [
+				        {
+				          "ruleId": "query",
+				          "ruleIndex": 0,
+				          "level": "warning",
+				          "message": {
+				            "text": "flush()"
+				          },
+				          "locations": [
+				            {
+				              "physicalLocation": {
+				                "artifactLocation": {
+				                  "uri": "testdata/group/group.go"
+				                },
+				                "region": {
+				                  "startLine": 6,
+				                  "startColumn": 2,
+				                  "endLine": 6,
+				                  "endColumn": 9
+				                }
+				              }
+				            }
+				          ]
+				        }
+				      ]
+				    }
+				  ]
+				}
+			`,
+		},
+		{
+			[]string{"-format", "checkstyle", "-f", "testdata/rules/lint.gogrep", "testdata/group/group.go"},
+			`
+				<?xml version="1.0" encoding="UTF-8"?>
+				<checkstyle version="5.0">
+				  <file name="testdata/group/group.go">
+				    <error line="6" column="2" severity="warning" message="do not call flush directly" source="gogrep.flush"></error>
+				    <error line="11" column="2" severity="info" message="sync()" source="gogrep.sync"></error>
+				    <error line="12" column="2" severity="info" message="sync()" source="gogrep.sync"></error>
+				    <error line="15" column="12" severity="info" message="sync()" source="gogrep.sync"></error>
+				    <error line="18" column="2" severity="warning" message="do not call flush directly" source="gogrep.flush"></error>
+				  </file>
+				</checkstyle>
+			`,
+		},
+		{
+			[]string{"-format", "vimgrep", "-x", "func $f() { $*_ }", "testdata/group/group.go"},
+			`
+				testdata/group/group.go:10:1: func flush() {
+				testdata/group/group.go:17:1: func TestFlush() {
+			`,
+		},
+		{
+			[]string{"-color", "always", "-x", "sync()", "-limit", "1", "testdata/group/group.go"},
+			"\x1b[35mtestdata/group/group.go\x1b[0m:\x1b[32m11:2\x1b[0m: \x1b[1;31msync()\x1b[0m",
+		},
+		{
+			[]string{"-color", "always", "-color-captures", "-x", "var $a, $b = $c, 3", "testdata/group/group.go"},
+			"\x1b[35mtestdata/group/group.go\x1b[0m:\x1b[32m15:1\x1b[0m: " +
+				"\x1b[1;31mvar \x1b[0m\x1b[1;33mx\x1b[0m\x1b[1;31m, \x1b[0m\x1b[1;34my\x1b[0m" +
+				"\x1b[1;31m = \x1b[0m\x1b[1;32msync()\x1b[0m\x1b[1;31m, 3\x1b[0m",
+		},
+		{
+			[]string{"-color", "sometimes", "-x", "sync()", "testdata/group/group.go"},
+			fmt.Errorf(`-color must be auto, always or never, got "sometimes"`),
+		},
+		{
+			[]string{"-C", "1", "-x", "sync()", "testdata/group/group.go"},
+			`
+				testdata/group/group.go-10-func flush() {
+				testdata/group/group.go:11:2: sync()
+				testdata/group/group.go:12:2: sync()
+				testdata/group/group.go-13-}
+				testdata/group/group.go-14-
+				testdata/group/group.go:15:12: sync()
+				testdata/group/group.go-16-
+			`,
+		},
+		{
+			[]string{"-B", "2", "-x", "func $f() { $*_ }", "testdata/group/group.go"},
+			`
+				testdata/group/group.go-8-}
+				testdata/group/group.go-9-
+				testdata/group/group.go:10:1: func flush() { sync(); sync(); }
+				--
+				testdata/group/group.go-15-var x, y = sync(), 3
+				testdata/group/group.go-16-
+				testdata/group/group.go:17:1: func TestFlush() { flush(); }
+			`,
+		},
+		{
+			[]string{"-C", "-1", "-x", "sync()", "testdata/group/group.go"},
+			fmt.Errorf(`-C must not be negative, got -1`),
+		},
+		{
+			[]string{"-format-tmpl", `{{.File}}:{{.Line}} {{.Capture "c"}} {{.Match}}`, "-x", "var $a, $b = $c, 3", "testdata/group/group.go"},
+			`testdata/group/group.go:15 sync() var x, y = sync(), 3`,
+		},
+		{
+			[]string{"-format-tmpl", `{{.Alternative}} {{.Match}}`, "-x", `flush() \| sync()`, "testdata/group/group.go"},
+			`
+				1 flush()
+				2 sync()
+				2 sync()
+				2 sync()
+				1 flush()
+			`,
+		},
+		{
+			[]string{"-format-tmpl", `{{.Severity}}/{{.Rule}}{{with .Message}}: {{.}}{{end}}{{"\n"}}`, "-f", "testdata/rules/lint.gogrep", "testdata/group/group.go"},
+			`
+				warning/flush: do not call flush directly
+				warning/flush: do not call flush directly
+				info/sync
+				info/sync
+				info/sync
+			`,
+		},
+		{
+			[]string{"-format-tmpl", "{{.Foo}}", "-x", "sync()", "testdata/group/group.go"},
+			fmt.Errorf(`can't evaluate field Foo`),
+		},
+		{
+			[]string{"-format-tmpl", "{{.File}}", "-format", "json", "-x", "sync()", "testdata/group/group.go"},
+			fmt.Errorf(`-format-tmpl cannot be used with -format or -json`),
+		},
+		{
+			[]string{"-l", "-x", "flush()", "testdata/suppress/suppress.go", "testdata/group/group.go", "testdata/chans.go"},
+			`
+				testdata/group/group.go
+				testdata/suppress/suppress.go
+			`,
+		},
+		{
+			[]string{"-l", "-0", "-x", "flush()", "testdata/suppress/suppress.go", "testdata/group/group.go"},
+			"testdata/group/group.go\x00testdata/suppress/suppress.go\x00",
+		},
+		{
+			[]string{"-0", "-x", "flush()", "testdata/group/group.go"},
+			fmt.Errorf(`-0 requires -l`),
+		},
+		{
+			[]string{"-l", "-json", "-x", "flush()", "testdata/group/group.go"},
+			fmt.Errorf(`-l cannot be used with -format, -format-tmpl or -json`),
+		},
+		{
+			[]string{"-types", "-x", "$f()", "-limit", "2", "testdata/group/group.go"},
+			`
+				testdata/group/group.go:6:2: flush()
+				  flush(): ()
+				  $f = flush: func()
+				testdata/group/group.go:11:2: sync()
+				  sync(): int
+				  $f = sync: func() int
+			`,
+		},
+		{
+			[]string{"-types", "-x", "var $a, $b = $c, $d", "testdata/group/group.go"},
+			`
+				testdata/group/group.go:15:1: var x, y = sync(), 3
+				  $a = x: int
+				  $b = y: int
+				  $c = sync(): int
+				  $d = 3: int
+			`,
+		},
+		{
+			[]string{"-format", "ast", "-types", "-x", "sync()", "-limit", "1", "testdata/group/group.go"},
+			`
+				testdata/group/group.go:11:2:
+				     0  *ast.CallExpr {
+				     1  .  Fun: *ast.Ident {
+				     2  .  .  NamePos: testdata/group/group.go:11:2
+				     3  .  .  Name: "sync"
+				     4  .  }
+				     5  .  Lparen: testdata/group/group.go:11:6
+				     6  .  Ellipsis: -
+				     7  .  Rparen: testdata/group/group.go:11:7
+				     8  }
+				types:
+				  11:2: sync(): int
+				  11:2: sync: func() int
+			`,
+		},
+		{
+			[]string{"-format", "csv", "-f", "testdata/rules/lint.gogrep", "testdata/group/group.go"},
+			`
+				file,line,col,rule,match,$f
+				testdata/group/group.go,6,2,flush,flush(),flush
+				testdata/group/group.go,18,2,flush,flush(),flush
+				testdata/group/group.go,11,2,sync,sync(),
+				testdata/group/group.go,12,2,sync,sync(),
+				testdata/group/group.go,15,12,sync,sync(),
+			`,
+		},
+		{
+			[]string{"-format", "csv", "-x", "var $a, $b = $c, 3", "testdata/group/group.go"},
+			`
+				file,line,col,rule,match,$a,$b,$c
+				testdata/group/group.go,15,1,,"var x, y = sync(), 3",x,y,sync()
+			`,
+		},
+		{
+			[]string{"-format", "yaml", "-x", "flush()", "testdata/group/group.go"},
+			fmt.Errorf(`unknown -format "yaml"`),
+		},
+		{
+			[]string{"-equal", "exact", "-x", "$x", "testdata/chans.go"},
+			fmt.Errorf(`-equal must be syntax or typed, got "exact"`),
+		},
 	}
 	for i, tc := range tests {
 		t.Run(fmt.Sprintf("%02d", i), func(t *testing.T) {
@@ -141,3 +930,164 @@ func TestLoad(t *testing.T) {
 		})
 	}
 }
+
+func TestBaseline(t *testing.T) {
+	m := matcher{ctx: &build.Default}
+	path := filepath.Join(t.TempDir(), "baseline.json")
+	var buf bytes.Buffer
+	m.out = &buf
+	args := []string{"-x", "sync()", "-write-baseline", path, "testdata/group/group.go"}
+	if err := m.fromArgs(args); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() > 0 {
+		t.Fatalf("wanted no output when writing a baseline, got:\n%s", buf.String())
+	}
+	args = []string{"-x", "$_()", "-baseline", path, "testdata/group/group.go"}
+	if err := m.fromArgs(args); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.TrimSpace(`
+testdata/group/group.go:6:2: flush()
+testdata/group/group.go:18:2: flush()
+`)
+	if got := strings.TrimSpace(buf.String()); got != want {
+		t.Fatalf("wanted:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	m := matcher{ctx: &build.Default}
+	tests := []struct {
+		args  []string
+		found bool
+	}{
+		{[]string{"-q", "-x", "sync()", "testdata/group/group.go"}, true},
+		{[]string{"-q", "-x", "nosuch()", "testdata/group/group.go"}, false},
+		{[]string{"-q", "-e", "-x", "sync()", "testdata/group/group.go"}, true},
+		{[]string{"-q", "-x", "sync()", "-limit", "0", "testdata/group/group.go"}, false},
+	}
+	for _, tc := range tests {
+		var buf bytes.Buffer
+		m.out = &buf
+		if err := m.fromArgs(tc.args); err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() > 0 {
+			t.Fatalf("%v: wanted no output, got:\n%s", tc.args, buf.String())
+		}
+		if m.found != tc.found {
+			t.Fatalf("%v: wanted found to be %v", tc.args, tc.found)
+		}
+	}
+}
+
+// TestDebug checks that the comparisons traced by -debug are printed to
+// standard error, apart from the matches.
+func TestDebug(t *testing.T) {
+	m := matcher{ctx: &build.Default}
+	tests := []struct {
+		args       []string
+		trace, out string
+	}{
+		{
+			[]string{"-debug", "testdata/debug/debug.go:4:9", "-x", "foo($x, $x)", "testdata/debug/debug.go"},
+			`
+				testdata/debug/debug.go:4:9: -x foo($x, $x) against exprList
+				  CallExpr vs exprList: node kind mismatch
+				testdata/debug/debug.go:4:9: -x foo($x, $x) against CallExpr
+				  CallExpr vs CallExpr: CallExpr.Args mismatch
+				    Ident foo vs Ident foo: ok
+				    Ident $x vs Ident a: ok
+				    Ident $x vs Ident b: wildcard mismatch
+				      Ident a vs Ident b: Ident.Name mismatch: a vs b
+				testdata/debug/debug.go:4:9: -x foo($x, $x) against Ident
+				  CallExpr vs Ident foo: node kind mismatch
+			`,
+			``,
+		},
+		{
+			[]string{"-debug", "testdata/debug/debug.go:7", "-x", "$x != $_", "testdata/debug/debug.go"},
+			`
+				testdata/debug/debug.go:7:34: -x $x != $_ against BinaryExpr
+				  BinaryExpr != vs BinaryExpr ==: BinaryExpr.Op mismatch: != vs ==
+			`,
+			``,
+		},
+		{
+			[]string{"-debug", "testdata/debug/debug.go:7", "-x", "$x == $x", "testdata/debug/debug.go"},
+			`
+				testdata/debug/debug.go:7:34: -x $x == $x against BinaryExpr
+				  BinaryExpr == vs BinaryExpr ==: BinaryExpr.Y mismatch
+				    Ident $x vs Ident a: ok
+				    Ident $x vs Ident b: wildcard mismatch
+				      Ident a vs Ident b: Ident.Name mismatch: a vs b
+			`,
+			``,
+		},
+		{
+			[]string{"-debug", "testdata/debug/debug.go:7", "-x", "$x == $_", "testdata/debug/debug.go"},
+			`
+				testdata/debug/debug.go:7:34: -x $x == $_ against BinaryExpr
+				  BinaryExpr == vs BinaryExpr ==: ok
+				    Ident $x vs Ident a: ok
+				    Ident $_ vs Ident b: ok
+			`,
+			`testdata/debug/debug.go:7:34: a == b`,
+		},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%02d", i), func(t *testing.T) {
+			var out, trace bytes.Buffer
+			m.out, m.stderr = &out, &trace
+			if err := m.fromArgs(tc.args); err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range []struct {
+				name      string
+				want, got string
+			}{
+				{"trace", tc.trace, trace.String()},
+				{"output", tc.out, out.String()},
+			} {
+				want := strings.TrimSpace(strings.Replace(c.want, "\t", "", -1))
+				if got := strings.TrimSpace(c.got); want != got {
+					t.Fatalf("wanted %s:\n%s\ngot:\n%s", c.name, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestHTML(t *testing.T) {
+	m := matcher{ctx: &build.Default}
+	var buf bytes.Buffer
+	m.out = &buf
+	args := []string{"-format", "html", "-B", "1", "-f", "testdata/rules/lint.gogrep", "testdata/group/group.go"}
+	if err := m.fromArgs(args); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+	for _, want := range []string{
+		`<p>5 matches in 1 packages</p>`,
+		`<h2>command-line-arguments (5)</h2>`,
+		`<div class="pos">testdata/group/group.go:6:2 <span class="warning">warning</span> <span class="rule">flush</span>: do not call flush directly</div>`,
+		`<span><span class="ln">5</span><span class="kw">func</span> (t *T) Close() error {</span>`,
+		`<span class="hit"><span class="ln">6</span>` + "\t" + `flush()</span>`,
+		`<summary><code><span class="kw">var</span> x, y = sync(), <span class="num">3</span></code></summary>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("wanted output to contain:\n%s\ngot:\n%s", want, got)
+		}
+	}
+
+	// errors writing the report are not lost
+	m.out = failWriter{}
+	if err := m.fromArgs(args); err == nil {
+		t.Fatal("wanted an error writing the report, got none")
+	}
+}
+
+type failWriter struct{}
+
+func (failWriter) Write([]byte) (int, error) { return 0, fmt.Errorf("write failed") }
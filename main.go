@@ -4,7 +4,9 @@
 package main // import "mvdan.cc/gogrep"
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"go/ast"
@@ -14,10 +16,12 @@ import (
 	"go/types"
 	"io"
 	"os"
+	"reflect"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"text/template"
 )
 
 var usage = func() {
@@ -26,16 +30,158 @@ var usage = func() {
 gogrep performs a query on the given Go packages.
 
   -r   match all dependencies recursively too
+  -I   interactively confirm each substitution before applying it
+  -q   don't print anything, and stop at the first match if not writing
+  -e   invert the exit status, failing if there were any matches; see below
+  -l   print the names of the files with matches instead of the matches
+  -0   end each name printed by -l with a NUL byte instead of a newline,
+       for xargs -0
+  -f file
+                run the named rules in a file instead of the commands given
+                as arguments, loading the packages only once; see below
+  -baseline file
+                only print the matches not recorded in a baseline file, to
+                find those which are new; a match recorded once is only
+                discarded once
+  -write-baseline file
+                instead of printing the matches, record them in a baseline
+                file, by file, rule name and a hash of their source
+  -suppressed   only print the matches suppressed by a comment like
+                //gogrep:ignore; see below
+  -vars  list the wildcards captured by each pattern, without matching
+  -explain
+                print how each command was parsed, such as the tree of node
+                kinds of a pattern and its wildcards, without matching
+  -debug file:line[:col]
+                print each comparison made when matching -x patterns against
+                the nodes at a position, and why those failing did so, to
+                standard error
+  -o template   instead of printing each match, print a template where
+                the dollar expressions are replaced by the values they
+                captured, like '$x' or '$f($*args)'
+  -json         print each match as a JSON object on its own line, with its
+                file, start and end positions, source, rule name, message
+                and severity, and the values of its wildcards as "captures";
+                the matches are printed as each file is searched, and
+                unless type information is needed, each package is only
+                loaded once the previous one has been searched
+  -format name  print the matches in a format other than "text", the default;
+                "json" is like -json, "sarif" prints a SARIF 2.1.0 log with
+                the rules, their severities and messages, "checkstyle" prints
+                a checkstyle XML report, "vimgrep" prints the first line of
+                each match for quickfix lists, "ast" prints the syntax tree
+                of each match, and "csv" or "tsv" print a table with the
+                file, line, column, rule and source of each match, and a
+                column for each wildcard; "html" prints a standalone report
+                grouped by package, where each match expands to show the
+                lines around it, three by default or as given via -A, -B
+                or -C
+  -types        print the type of each match and of the wildcards it
+                captured on the lines after it, as "expr: type"; with
+                -format ast, print the type of each expression in the matches
+  -comments     print the comments which the directive, doc and comment
+                attributes found before each match, such as its doc comment
+  -format-tmpl template
+                print each match by executing a text/template with its
+                File, Line, Column, EndLine, EndColumn, Match, Rule, Message,
+                Severity and Alternative; {{.Capture "x"}} gives the value
+                of $x
+  -group        print the matches grouped by the top-level declaration
+                containing them, each introduced by the declaration's
+                position and signature or names
+  -color when   print each match as its source line, with the match itself
+                highlighted; "auto", the default, does so when printing to
+                a terminal, and "always" or "never" force it on or off
+  -color-captures
+                also give each wildcard of a colored match its own color
+  -A n, -B n, -C n
+                print n lines of source after, before, or around each match,
+                like grep; nearby matches share their lines of context
+  -c            instead of printing the matches, print how many there were,
+                like -count all
+  -count mode   instead of printing the matches, print how many there were
+                in total with "all", or per file or package with "file" or
+                "package"
+  -collect name
+                instead of printing the matches, print the distinct values
+                a wildcard took and how many times; may be repeated
+  -def name=pattern
+                define a pattern which the patterns may then use by its
+                name, as if its source was in its place, parenthesized if
+                it's an expression the operators around it would split;
+                may be repeated
+  -imports path
+                only match files importing a package; a path ending in
+                "/..." matches any package under it, and using the flag
+                multiple times requires all of the imports
+
+  -equal mode   how repeated dollar expressions are compared; "syntax"
+                (the default) or "typed", which requires identifiers to
+                refer to the same object, also within larger expressions
+  -boolean-normalize
+                compare boolean expressions after applying De Morgan's
+                laws, removing double negations and flipping negated
+                == and != comparisons; this is a syntactic rewrite, not
+                a full equivalence check
+  -commutative  also match binary expressions with their operands swapped,
+                if the operator is symmetric like == or *; + is only
+                swapped if the operands aren't known to be strings
+  -norm list    comma-separated normalizations to apply before matching;
+                may be repeated. paren ignores parentheses, conv ignores
+                conversions of a value to the type it already has, keyed
+                ignores the order of keyed composite literal elements, blank
+                matches a missing node with _, decl lets a name match a
+                declaration of many names, assign lets = match := and var
+                declarations, and block lets a block match the statements
+                of a clause. A pattern starting with '~' enables the last
+                four.
+  -constval     match basic literals like 1024 by their constant value, so
+                that they also match 1<<10, 0x400 or a constant's name
+  -aliases      match selectors like fmt.Println by the name of the
+                imported package, so that they also match the package
+                imported under another name or with a dot
+  -promoted     match selectors through embedded fields like s.File.Close
+                as if they were written against the embedding type, like
+                s.Close
 
 A command is one of the following:
 
   -x pattern    find all nodes matching a pattern
+  -children pattern
+                find the direct children matching a pattern
   -g pattern    discard nodes not matching a pattern
   -v pattern    discard nodes matching a pattern
+  -in pattern   discard nodes not within a node matching a pattern
+  -notin pattern
+                discard nodes within a node matching a pattern
+  -follows pattern
+                discard nodes not after a statement matching a pattern,
+                earlier in the same block or in one around it
+  -notfollows pattern
+                discard nodes after a statement matching a pattern
+  -precedes pattern
+                discard nodes not before a statement matching a pattern,
+                later in the same block or in one around it
+  -notprecedes pattern
+                discard nodes before a statement matching a pattern
   -a attribute  discard nodes without an attribute
+  -u name       discard nodes where a wildcard captured the same value as
+                in an earlier node, keeping one node per distinct value
   -s pattern    substitute with a given syntax tree
+  -outermost    discard nodes within any of the other nodes
+  -innermost    discard nodes containing any of the other nodes
+  -limit number discard the nodes after a number of them, stopping the
+                search early once reached
+  -sample number
+                keep a random sample of a number of nodes; it must be the
+                last command
   -p number     navigate up a number of node parents
+  -p func       navigate up to the enclosing function
   -w            write the entire source code back
+  -( commands -or commands -)
+                keep the nodes resulting from any of the groups of commands,
+                each applied to the same nodes; -or may also be used without
+                parentheses to separate whole groups of commands
 
 A pattern is a piece of Go code which may include dollar expressions. It can be
 a number of statements, a number of expressions, a declaration, or an entire
@@ -50,33 +196,246 @@ If '*' is before the name, it will match any number of nodes. Example:
 
        -x 'fmt.Fprintf(os.Stdout, $*_)' # all Fprintfs on stdout
 
+It matches as few nodes as possible, taking more only if the rest of the
+pattern doesn't match otherwise. If '*+' is used instead, it takes as many
+nodes as possible first, giving them back one at a time. Example:
+
+       -x 'f($*+x, nil, $*_)' # $x is the arguments before the last nil
+
+If '?' is before the name instead, it will match zero or one nodes. Example:
+
+       -x 'errors.New($_, $?_)' # calls with at most two arguments
+
+An attribute may be prefixed with '!' to discard the nodes that have it
+instead. Example:
+
+       -x '$x == $_' -x '$x' -a '!comp' # comparisons that may panic
+
+A pattern of statements may start with '^ ' to only match at the start of a
+block, and end with '$' to only match at its end. As '^ x' alone is a bitwise
+complement, a single statement is anchored with a semicolon, like '^ x;'.
+Example:
+
+       -x '^ $*_; return $_ $' # a whole block ending in a return
+
+An attribute may be prefixed with a wildcard and ':' to apply to the node it
+captured, and match(pattern) discards the nodes not matching a pattern. Example:
+
+       -x 'f($x)' -a '$x:!match(len($_))' # calls to f without len
+
+A pattern may consist of alternatives separated by '\|' at its top level, like
+with grep, in which case nodes matching any of them are found. Which one
+matched is given as "alternative" with -json, counting from 1. Example:
+
+       -x '$x.Lock() \| $x.RLock()' # any kind of lock
+
+A plain '|' is always a bitwise or, so '$x.Lock() | $x.RLock()' is a single
+pattern which only matches an or of two such calls.
+
+A dollar expression surrounded by spaces may also be used in place of a binary
+or unary operator, which it captures. It binds looser than any other operator.
+Example:
+
+       -x '$x $op $y' -a '$op:rx("==|!=")' # equality comparisons
+
+A file given via -f holds any number of rules, each starting with its name and
+a colon on a line of its own, followed by indented lines with a command or an
+option each. Values go after a space and are not quoted. The matches of each
+rule are printed with its name, which is also its ID. Lines starting with '#' are
+ignored. A rule may also have a message, printed instead of each match, where
+dollar expressions are replaced as with -o, and a severity of error, warning or
+info, printed before its name. Example:
+
+       unwrapped:
+               -x return $*_, $err
+               -v return $*_, fmt.Errorf($*_)
+               message: $err is returned without wrapping
+               severity: warning
+
+Matches are not printed if a comment on the line where they start, or a
+directive in the doc comment of the declaration containing them, is
+//gogrep:ignore or //nolint:gogrep. The former may be followed by the names of
+the rules to ignore, like "//gogrep:ignore unwrapped", and in the latter
+"gogrep:unwrapped" may be used instead.
+
 By default, the resulting nodes will be printed one per line to standard output.
 To update the input files, use -w.
+
+The exit status is 0 if there were any matches, 1 if there were none, and 2 if
+there was an error. With -e, the first two are swapped, for use as a linter.
 `)
 }
 
 func main() {
 	m := matcher{
 		out: os.Stdout,
+		in:  os.Stdin,
 		ctx: &build.Default,
 	}
 	err := m.fromArgs(os.Args[1:])
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if matching := !m.listVars && !m.explain; matching && m.found == m.failOnMatch {
 		os.Exit(1)
 	}
 }
 
 type matcher struct {
 	out io.Writer
+	in  io.Reader
 	ctx *build.Context
 
+	// stderr is where the prompts of -I go, so that they don't mix with
+	// the output; see errOut
+	stderr io.Writer
+
+	// inBuf reads answers from in when confirming substitutions
+	inBuf *bufio.Reader
+
 	loader nodeLoader
 
 	parents map[ast.Node]ast.Node
 
-	recursive         bool
-	typed, aggressive bool
+	// commentMaps caches the comment maps of the files being matched,
+	// used by the comment attribute
+	commentMaps map[*ast.File]ast.CommentMap
+
+	recursive   bool
+	typed       bool
+	interactive bool
+	listVars    bool
+	explain     bool
+
+	// quiet discards the output, and found is whether there were any
+	// matches, which failOnMatch turns into a failure; see main
+	quiet, found, failOnMatch bool
+
+	// rulesFile is the file given via -f; see loadRules
+	rulesFile string
+
+	// baselinePath is the file given via -baseline, whose matches are
+	// in baseline, and writeBaselinePath the one given via
+	// -write-baseline; see newMatches
+	baselinePath, writeBaselinePath string
+	baseline                        map[baselineEntry]int
+
+	// listSuppressed makes the matches suppressed by comments the only
+	// ones kept, instead of the only ones discarded; see suppressed
+	listSuppressed bool
+
+	// debugPos is the position given via -debug, where the candidate
+	// nodes have their comparisons traced into trace
+	debugPos string
+	trace    *trace
+
+	// rangeLimit is how many nodes -x or -children may find before stopping,
+	// when followed by -limit, or -1 otherwise
+	rangeLimit int
+
+	// literal is set while matching a pattern without dollar
+	// expressions; see exprCmd.literal
+	literal bool
+
+	// alt is set by topNode to which alternative of a pattern matched,
+	// starting at 1, or zero if it had none; see submatch.alt
+	alt int
+
+	// imports is the list of paths given via -imports
+	imports []string
+
+	// directives and docs are whether any directive or doc attributes
+	// were used, in which case -comments prints the directives or doc
+	// comments along with each match
+	directives, docs bool
+
+	// comments are the expressions of the comment attributes used, if
+	// any, as -comments prints the comments matching them with each match
+	comments []*regexp.Regexp
+
+	// printComments is whether to print the comments found by the
+	// directive, doc and comment attributes, via -comments
+	printComments bool
+
+	// defs are the patterns given via -def, by name; see expandDefs
+	defs map[string]namedPattern
+
+	// collect is the list of wildcard names given via -collect
+	collect []string
+
+	// json is whether to print the matches as JSON; see jsonMatch
+	json bool
+
+	// showTypes is whether to print the types of each match and its
+	// captured expressions, which requires type-checking
+	showTypes bool
+
+	// listFiles prints the names of the files with matches instead of the
+	// matches, separated by NUL bytes if nulSep is set
+	listFiles, nulSep bool
+
+	// format is the output format given via -format, if any
+	format string
+
+	// formatTmpl is the template given via -format-tmpl, if any, executed
+	// for each match; see tmplMatch
+	formatTmpl *template.Template
+
+	// color is the mode given via -color, and colored is whether it
+	// resolved to printing the matches in color; see colorLine
+	color   string
+	colored bool
+
+	// colorCaptures gives each wildcard of a colored match its own color
+	colorCaptures bool
+
+	// sources caches the contents of the files whose lines are printed
+	// in color or as context; see source
+	sources map[string][]byte
+
+	// before and after are how many lines of context to print before and
+	// after each match, given via -B, -A or -C
+	before, after int
+
+	// group is whether to group the printed matches by their enclosing
+	// top-level declaration
+	group bool
+
+	// count is the mode given via -count, if any; see printCount
+	count string
+
+	// output is the template given via -o, printed for each match
+	// instead of the match itself; see fillOutput
+	output string
+
+	// typedEqual makes repeated wildcards compare identifiers by the
+	// objects they refer to, instead of by name
+	typedEqual bool
+
+	// boolNormalize makes boolean expressions match up to simple
+	// rewrites of their negations; see normBool
+	boolNormalize bool
+
+	// norms are the normalizations given via -norm, by name; see
+	// normNames
+	norms map[string]bool
+
+	// constVal makes basic literals match any expression with the same
+	// constant value; see sameConst
+	constVal bool
+
+	// aliases makes selectors like "fmt.Println" match the package by
+	// its name, even if imported under another name or with a dot
+	aliases bool
+
+	// promoted makes selectors match through embedded fields, as if
+	// the selected field or method was promoted; see promotes
+	promoted bool
+
+	// commutative makes binary expressions with symmetric operators
+	// match with their operands swapped; see commutes
+	commutative bool
 
 	// information about variables (wildcards), by id (which is an
 	// integer starting at 0)
@@ -88,12 +447,34 @@ type matcher struct {
 	scope  *types.Scope
 
 	types.Info
+	pkg         *types.Package // the package being matched, if typed
 	stdImporter types.Importer
 }
 
 type varInfo struct {
 	name string
 	any  bool
+
+	// opt is whether the wildcard matches zero or one nodes, as in
+	// "$?x"; any is set too, as it also captures a list
+	opt bool
+
+	// greedy is whether a list wildcard first takes as many nodes as
+	// possible, as in "$*+x"; by default, they take as few as possible
+	greedy bool
+}
+
+func (v varInfo) String() string {
+	if v.opt {
+		return "$?" + v.name
+	}
+	if v.greedy {
+		return "$*+" + v.name
+	}
+	if v.any {
+		return "$*" + v.name
+	}
+	return "$" + v.name
 }
 
 func (m *matcher) info(id int) varInfo {
@@ -104,9 +485,14 @@ func (m *matcher) info(id int) varInfo {
 }
 
 type exprCmd struct {
-	name  string
-	src   string
-	value interface{}
+	name    string
+	src     string
+	value   interface{}
+	anchors anchors
+
+	// literal is whether the pattern has no dollar expressions, in
+	// which case it can be matched without keeping track of values
+	literal bool
 }
 
 type strCmdFlag struct {
@@ -120,6 +506,15 @@ func (o *strCmdFlag) Set(val string) error {
 	return nil
 }
 
+// stringsFlag is a flag that may be given multiple times.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return "" }
+func (f *stringsFlag) Set(val string) error {
+	*f = append(*f, val)
+	return nil
+}
+
 type boolCmdFlag struct {
 	name string
 	cmds *[]exprCmd
@@ -140,16 +535,107 @@ func (m *matcher) fromArgs(args []string) error {
 	if err != nil {
 		return err
 	}
+	if m.quiet {
+		out := m.out
+		m.out = io.Discard
+		defer func() { m.out = out }()
+	}
+	m.found = false
+	rules := []*rule{{m: m, cmds: cmds}}
+	if m.rulesFile != "" {
+		if len(cmds) > 0 {
+			return fmt.Errorf("-f cannot be used with commands")
+		}
+		rules, err = m.loadRules(m.rulesFile, args[:len(args)-len(paths)])
+		if err != nil {
+			return err
+		}
+	}
+	if m.listVars {
+		for _, r := range rules {
+			r.printName()
+			for _, cmd := range r.cmds {
+				node, ok := cmd.value.(ast.Node)
+				if !ok {
+					continue
+				}
+				fmt.Fprintf(m.out, "-%s", cmd.name)
+				for _, info := range r.m.patternVars(node) {
+					fmt.Fprintf(m.out, " %v", info)
+				}
+				fmt.Fprintln(m.out)
+			}
+		}
+		return nil
+	}
+	if m.explain {
+		for _, r := range rules {
+			r.printName()
+			for _, cmd := range r.cmds {
+				r.m.explainCmd(cmd)
+			}
+		}
+		return nil
+	}
+	m.baseline = nil
+	if m.baselinePath != "" {
+		if m.baseline, err = readBaseline(m.baselinePath); err != nil {
+			return err
+		}
+	}
+	if m.interactive {
+		if f, ok := m.in.(*os.File); m.in == nil || (ok && !isTerminal(f)) {
+			return fmt.Errorf("-I requires an interactive terminal")
+		}
+		m.inBuf = bufio.NewReader(m.in)
+	}
 	fset := token.NewFileSet()
 	wd, err := os.Getwd()
 	if err != nil {
 		return err
 	}
-	m.loader = nodeLoader{wd, m.ctx, fset}
+	m.loader = nodeLoader{wd, m.ctx, fset, m.imports}
+	typed := false
+	for _, r := range rules {
+		r.m.loader, r.m.inBuf = m.loader, m.inBuf
+		typed = typed || r.m.typed
+	}
+	for _, r := range rules {
+		// a sample must be taken from the matches in all packages,
+		// not per package
+		if last := r.cmds[len(r.cmds)-1]; last.name == "sample" {
+			r.sample, r.cmds = &last, r.cmds[:len(r.cmds)-1]
+		}
+	}
+	// with -q, the first match is enough unless the files are written
+	stopEarly := m.quiet
+	for _, r := range rules {
+		for _, cmd := range r.cmds {
+			stopEarly = stopEarly && cmd.name != "w"
+		}
+	}
+	stream := m.writeBaselinePath == ""
+	for _, r := range rules {
+		stream = stream && r.streaming()
+	}
 	var pkgs []loadPkg
-	if !m.typed {
+	switch {
+	case stream && !typed:
+		// nothing is kept once printed, so load each package only
+		// when the previous one is done with
+		err = m.loader.untypedEach(paths, m.recursive, func(pkg loadPkg) error {
+			if stopEarly && m.found {
+				return errStopped
+			}
+			m.matchPkg(rules, pkg, -1)
+			return nil
+		})
+		if err == errStopped {
+			err = nil
+		}
+	case !typed:
 		pkgs, err = m.loader.untyped(paths, m.recursive)
-	} else {
+	default:
 		pkgs, err = m.loader.typed(paths, m.recursive)
 	}
 	if err != nil {
@@ -158,31 +644,361 @@ func (m *matcher) fromArgs(args []string) error {
 	sort.Slice(pkgs, func(i, j int) bool {
 		return pkgs[i].path < pkgs[j].path
 	})
-	var all []ast.Node
-	for _, pkg := range pkgs {
-		m.Info = pkg.info
-		all = append(all, m.matches(cmds, pkg.nodes)...)
+	for _, r := range rules {
+		r.perPkg = make([]int, len(pkgs))
+	}
+	for i, pkg := range pkgs {
+		if stopEarly && m.found {
+			break
+		}
+		m.matchPkg(rules, pkg, i)
+	}
+	if m.writeBaselinePath != "" {
+		return m.writeBaseline(m.writeBaselinePath, rules)
+	}
+	for _, r := range rules {
+		if r.sample != nil {
+			r.all = r.m.cmdSample(*r.sample, r.all)
+		}
 	}
-	for _, n := range all {
-		fpos := m.loader.fset.Position(n.Pos())
-		if strings.HasPrefix(fpos.Filename, wd) {
-			fpos.Filename = fpos.Filename[len(wd)+1:]
+	if m.listFiles {
+		m.printFiles(rules)
+		return nil
+	}
+	switch m.format {
+	case "sarif":
+		m.printSARIF(rules)
+		return nil
+	case "checkstyle":
+		m.printCheckstyle(rules)
+		return nil
+	case "csv":
+		m.printCSV(rules, ',')
+		return nil
+	case "tsv":
+		m.printCSV(rules, '\t')
+		return nil
+	case "html":
+		return m.printHTML(rules, pkgs)
+	}
+	for _, r := range rules {
+		if r.streaming() {
+			continue // already printed
 		}
-		fmt.Fprintf(m.out, "%v: %s\n", fpos, singleLinePrint(n))
+		r.m.printMatches(r, pkgs)
 	}
 	return nil
 }
 
+// errStopped stops loading packages once no more matches are needed.
+var errStopped = errors.New("stopped")
+
+// matchPkg runs the rules on the i-th loaded package, or on one that isn't
+// kept around if i is negative. The matches of streaming rules are printed
+// as each file is matched, while the rest are kept until all the packages
+// have been searched.
+func (m *matcher) matchPkg(rules []*rule, pkg loadPkg, i int) {
+	for _, r := range rules {
+		if limitReached(r.cmds) {
+			continue
+		}
+		r.m.Info, r.m.pkg = pkg.info, pkg.tpkg
+		stream := m.writeBaselinePath == "" && r.streaming()
+		nodes := [][]ast.Node{pkg.nodes}
+		if stream {
+			nodes = nodes[:0]
+			for _, node := range pkg.nodes {
+				nodes = append(nodes, []ast.Node{node})
+			}
+		}
+		count := 0
+		for _, nodes := range nodes {
+			subs := r.m.suppressions(r.name, r.m.matches(r.cmds, nodes))
+			if m.baseline != nil {
+				subs = m.newMatches(r.name, subs)
+			}
+			r.m.annotate(subs)
+			// the maps would keep all the syntax trees loaded until
+			// the matches are printed
+			r.m.parents, r.m.commentMaps = nil, nil
+			count += len(subs)
+			if stream {
+				r.m.printJSON(r, subs)
+			} else {
+				r.all = append(r.all, subs...)
+			}
+		}
+		if i >= 0 {
+			r.perPkg[i] = count
+		}
+		m.found = m.found || count > 0
+	}
+}
+
+// printMatches prints the matches of a rule, or what was asked instead of
+// them, like their count. When running many rules, the output is qualified
+// by the rule's name.
+func (m *matcher) printMatches(r *rule, pkgs []loadPkg) {
+	prefix := ""
+	if r.name != "" {
+		prefix = r.name + ": "
+	}
+	if r.severity != "" {
+		prefix = m.severityString(r.severity) + ": " + prefix
+	}
+	if m.count != "" {
+		m.printCount(prefix, r.all, pkgs, r.perPkg)
+		return
+	}
+	if len(m.collect) > 0 {
+		m.printCollected(prefix, r.all)
+		return
+	}
+	if m.format == "vimgrep" {
+		m.printVimgrep(r.all)
+		return
+	}
+	if m.format == "ast" {
+		m.printAST(r.all, pkgs)
+		return
+	}
+	if m.formatTmpl != nil {
+		m.printTemplate(r, r.all)
+		return
+	}
+	var ctx *contextPrinter
+	if m.before > 0 || m.after > 0 {
+		ctx = &contextPrinter{m: m}
+		defer ctx.flush()
+	}
+	var lastDecl ast.Decl
+	for _, sub := range r.all {
+		if ctx != nil {
+			ctx.before(sub.node)
+		}
+		indent := ""
+		if m.group {
+			decl := sub.decl
+			if decl != nil && decl != lastDecl {
+				fmt.Fprintf(m.out, "%s: %s%s\n", m.posString(m.position(decl.Pos())), prefix, declHeader(decl))
+			}
+			if lastDecl = decl; decl != nil {
+				indent = "  "
+			}
+		}
+		for _, c := range sub.comments {
+			text := strings.Join(strings.Fields(c.Text), " ")
+			fmt.Fprintf(m.out, "%s%s: %s%s\n", indent, m.posString(m.position(c.Pos())), prefix, text)
+		}
+		fpos := m.position(sub.node.Pos())
+		var text string
+		switch {
+		case r.message != "":
+			text = fillTemplate(r.message, sub.values)
+		case m.output != "":
+			text = fillTemplate(m.output, sub.values)
+		case m.colored:
+			text = m.colorLine(sub)
+		default:
+			text = singleLinePrint(sub.node)
+		}
+		fmt.Fprintf(m.out, "%s%s: %s%s\n", indent, m.posString(fpos), prefix, text)
+		if m.showTypes {
+			m.printTypes(indent+"  ", sub, pkgs)
+		}
+		if ctx != nil {
+			ctx.after(sub.node)
+		}
+	}
+}
+
+// annotate records what printMatches needs to know about the parents of
+// each match, such as its enclosing declaration with -group, as the parents
+// are only kept while matching the package it's in.
+func (m *matcher) annotate(subs []submatch) {
+	if !m.group && !m.printComments {
+		return
+	}
+	for i := range subs {
+		sub := &subs[i]
+		if m.group {
+			sub.decl = m.enclosingDecl(sub.node)
+		}
+		if !m.printComments {
+			continue
+		}
+		switch {
+		case m.docs:
+			if doc := m.docOf(sub.node); doc != nil {
+				sub.comments = doc.List
+			}
+		case m.directives:
+			sub.comments = m.directivesOf(sub.node)
+		case len(m.comments) > 0:
+			for _, c := range m.commentsOf(sub.node) {
+				for _, rx := range m.comments {
+					if rx.MatchString(commentText(c)) {
+						sub.comments = append(sub.comments, c)
+						break
+					}
+				}
+			}
+		}
+	}
+}
+
+// printCount prints the number of matches as requested via -count. The
+// files and packages without any matches are omitted.
+func (m *matcher) printCount(prefix string, all []submatch, pkgs []loadPkg, perPkg []int) {
+	switch m.count {
+	case "all":
+		fmt.Fprintf(m.out, "%s%d\n", prefix, len(all))
+	case "file":
+		counts := make(map[string]int)
+		var files []string
+		for _, sub := range all {
+			name := m.position(sub.node.Pos()).Filename
+			if counts[name] == 0 {
+				files = append(files, name)
+			}
+			counts[name]++
+		}
+		sort.Strings(files)
+		for _, name := range files {
+			fmt.Fprintf(m.out, "%s%s: %d\n", prefix, name, counts[name])
+		}
+	case "package":
+		for i, pkg := range pkgs {
+			if perPkg[i] == 0 {
+				continue
+			}
+			path := pkg.path
+			if path == "" {
+				// files given directly, like the go tool does
+				path = "command-line-arguments"
+			}
+			fmt.Fprintf(m.out, "%s%s: %d\n", prefix, path, perPkg[i])
+		}
+	}
+}
+
+// rxOutputVar matches the dollar expressions in a -o template.
+var rxOutputVar = regexp.MustCompile(`\$[*?+]*(\w+)`)
+
+// fillTemplate replaces the dollar expressions in a template, like the one
+// given via -o, with the values they captured in a match. Those not
+// captured, like an optional "$?x" which matched nothing, are replaced by
+// nothing.
+func fillTemplate(tmpl string, values map[string]ast.Node) string {
+	return rxOutputVar.ReplaceAllStringFunc(tmpl, func(s string) string {
+		name := rxOutputVar.FindStringSubmatch(s)[1]
+		if value, ok := values[name]; ok {
+			return singleLinePrint(value)
+		}
+		return ""
+	})
+}
+
+// printCollected prints the distinct values each of the -collect wildcards
+// took across all matches, sorted and with the number of times they were
+// seen. Matches where a wildcard wasn't captured are skipped.
+func (m *matcher) printCollected(prefix string, all []submatch) {
+	for _, name := range m.collect {
+		counts := make(map[string]int)
+		for _, sub := range all {
+			if value, ok := sub.values[name]; ok {
+				counts[singleLinePrint(value)]++
+			}
+		}
+		values := make([]string, 0, len(counts))
+		for value := range counts {
+			values = append(values, value)
+		}
+		sort.Strings(values)
+		for _, value := range values {
+			fmt.Fprintf(m.out, "%s$%s %d %s\n", prefix, name, counts[value], value)
+		}
+	}
+}
+
+// position is like token.FileSet.Position, but with filenames relative to
+// the working directory when possible.
+func (m *matcher) position(pos token.Pos) token.Position {
+	fpos := m.loader.fset.Position(pos)
+	if wd := m.loader.wd; wd != "" && strings.HasPrefix(fpos.Filename, wd) {
+		fpos.Filename = fpos.Filename[len(wd)+1:]
+	}
+	return fpos
+}
+
+// errOut returns where to write the text that isn't part of the output,
+// like prompts, which is standard error by default.
+func (m *matcher) errOut() io.Writer {
+	if m.stderr != nil {
+		return m.stderr
+	}
+	return os.Stderr
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
 func (m *matcher) parseCmds(args []string) ([]exprCmd, []string, error) {
 	flagSet := flag.NewFlagSet("gogrep", flag.ExitOnError)
 	flagSet.Usage = usage
 	flagSet.BoolVar(&m.recursive, "r", false, "match all dependencies recursively too")
+	flagSet.BoolVar(&m.interactive, "I", false, "confirm each substitution")
+	flagSet.BoolVar(&m.quiet, "q", false, "don't print anything")
+	flagSet.BoolVar(&m.failOnMatch, "e", false, "exit with status 1 if there are matches")
+	flagSet.BoolVar(&m.listVars, "vars", false, "list the wildcards of each pattern")
+	flagSet.StringVar(&m.rulesFile, "f", "", "run the rules in a file")
+	flagSet.StringVar(&m.baselinePath, "baseline", "", "only print the matches not in a baseline")
+	flagSet.StringVar(&m.writeBaselinePath, "write-baseline", "", "record the matches in a baseline")
+	flagSet.BoolVar(&m.listSuppressed, "suppressed", false, "only keep the suppressed matches")
+	flagSet.BoolVar(&m.explain, "explain", false, "print how each command was parsed")
+	flagSet.StringVar(&m.debugPos, "debug", "", "trace the matching at a position")
+	m.imports = nil
+	flagSet.Var((*stringsFlag)(&m.imports), "imports", "only match files importing a package")
+	m.collect = nil
+	flagSet.Var((*stringsFlag)(&m.collect), "collect", "list the distinct values of a wildcard")
+	flagSet.BoolVar(&m.json, "json", false, "print the matches as JSON")
+	flagSet.StringVar(&m.format, "format", "", "the format to print the matches in")
+	formatTmpl := flagSet.String("format-tmpl", "", "a template to print each match with")
+	flagSet.BoolVar(&m.listFiles, "l", false, "print the files with matches")
+	flagSet.BoolVar(&m.showTypes, "types", false, "print the types of the expressions")
+	flagSet.BoolVar(&m.printComments, "comments", false, "print the comments found by attributes")
+	flagSet.BoolVar(&m.nulSep, "0", false, "separate the files with NUL bytes")
+	flagSet.BoolVar(&m.group, "group", false, "group the matches by declaration")
+	flagSet.StringVar(&m.color, "color", "auto", "when to print the matches in color")
+	flagSet.BoolVar(&m.colorCaptures, "color-captures", false, "color each wildcard")
+	flagSet.IntVar(&m.after, "A", -1, "lines of context after each match")
+	flagSet.IntVar(&m.before, "B", -1, "lines of context before each match")
+	context := flagSet.Int("C", 0, "lines of context around each match")
+	flagSet.StringVar(&m.count, "count", "", "print the number of matches")
+	countAll := flagSet.Bool("c", false, "print the number of matches")
+	flagSet.StringVar(&m.output, "o", "", "print a template of the captured values")
+	flagSet.BoolVar(&m.boolNormalize, "boolean-normalize", false, "match boolean expressions up to simple rewrites")
+	flagSet.BoolVar(&m.commutative, "commutative", false, "match symmetric binary expressions with swapped operands")
+	flagSet.BoolVar(&m.aliases, "aliases", false, "match qualified identifiers by their package")
+	flagSet.BoolVar(&m.promoted, "promoted", false, "match selectors through embedded fields")
+	flagSet.BoolVar(&m.constVal, "constval", false, "match literals by constant value")
+	equal := flagSet.String("equal", "syntax", "how to compare repeated wildcards")
+	var norms []string
+	flagSet.Var((*stringsFlag)(&norms), "norm", "normalizations to apply")
+	var defs []string
+	flagSet.Var((*stringsFlag)(&defs), "def", "define a named pattern")
 
 	var cmds []exprCmd
 	flagSet.Var(&strCmdFlag{
 		name: "x",
 		cmds: &cmds,
 	}, "x", "")
+	flagSet.Var(&strCmdFlag{
+		name: "children",
+		cmds: &cmds,
+	}, "children", "")
 	flagSet.Var(&strCmdFlag{
 		name: "g",
 		cmds: &cmds,
@@ -191,18 +1007,58 @@ func (m *matcher) parseCmds(args []string) ([]exprCmd, []string, error) {
 		name: "v",
 		cmds: &cmds,
 	}, "v", "")
+	flagSet.Var(&strCmdFlag{
+		name: "in",
+		cmds: &cmds,
+	}, "in", "")
+	flagSet.Var(&strCmdFlag{
+		name: "notin",
+		cmds: &cmds,
+	}, "notin", "")
+	for _, name := range []string{"follows", "notfollows", "precedes", "notprecedes"} {
+		flagSet.Var(&strCmdFlag{
+			name: name,
+			cmds: &cmds,
+		}, name, "")
+	}
 	flagSet.Var(&strCmdFlag{
 		name: "a",
 		cmds: &cmds,
 	}, "a", "")
+	flagSet.Var(&strCmdFlag{
+		name: "u",
+		cmds: &cmds,
+	}, "u", "")
 	flagSet.Var(&strCmdFlag{
 		name: "s",
 		cmds: &cmds,
 	}, "s", "")
+	flagSet.Var(&strCmdFlag{
+		name: "limit",
+		cmds: &cmds,
+	}, "limit", "")
+	flagSet.Var(&strCmdFlag{
+		name: "sample",
+		cmds: &cmds,
+	}, "sample", "")
 	flagSet.Var(&strCmdFlag{
 		name: "p",
 		cmds: &cmds,
 	}, "p", "")
+	flagSet.Var(&boolCmdFlag{
+		name: "outermost",
+		cmds: &cmds,
+	}, "outermost", "")
+	flagSet.Var(&boolCmdFlag{
+		name: "innermost",
+		cmds: &cmds,
+	}, "innermost", "")
+	for _, name := range []string{"(", "or", ")"} {
+		flagSet.Var(&boolCmdFlag{
+			name: name,
+			cmds: &cmds,
+		}, name, "")
+	}
 	flagSet.Var(&boolCmdFlag{
 		name: "w",
 		cmds: &cmds,
@@ -210,14 +1066,108 @@ func (m *matcher) parseCmds(args []string) ([]exprCmd, []string, error) {
 	flagSet.Parse(args)
 	paths := flagSet.Args()
 
-	if len(cmds) < 1 {
+	if len(cmds) < 1 && m.rulesFile == "" {
 		return nil, nil, fmt.Errorf("need at least one command")
 	}
+	m.typed = false
+	m.directives, m.docs = false, false
+	m.comments = nil
+	switch *equal {
+	case "syntax":
+		m.typedEqual = false
+	case "typed":
+		m.typedEqual = true
+		m.typed = true
+	default:
+		return nil, nil, fmt.Errorf("-equal must be syntax or typed, got %q", *equal)
+	}
+	switch m.format {
+	case "", "text":
+	case "json":
+		m.json = true
+	case "sarif", "checkstyle", "vimgrep", "ast", "csv", "tsv", "html":
+	default:
+		return nil, nil, fmt.Errorf("unknown -format %q", m.format)
+	}
+	m.formatTmpl = nil
+	if *formatTmpl != "" {
+		if m.format != "" || m.json {
+			return nil, nil, fmt.Errorf("-format-tmpl cannot be used with -format or -json")
+		}
+		tmpl, err := template.New("format").Parse(*formatTmpl)
+		if err == nil {
+			// catch unknown fields early, before any matching
+			err = tmpl.Execute(io.Discard, tmplMatch{})
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("-format-tmpl: %v", err)
+		}
+		m.formatTmpl = tmpl
+	}
+	if m.listFiles && (m.format != "" || m.json || m.formatTmpl != nil) {
+		return nil, nil, fmt.Errorf("-l cannot be used with -format, -format-tmpl or -json")
+	}
+	if m.nulSep && !m.listFiles {
+		return nil, nil, fmt.Errorf("-0 requires -l")
+	}
+	switch m.color {
+	case "auto":
+		f, ok := m.out.(*os.File)
+		m.colored = ok && isTerminal(f) && os.Getenv("NO_COLOR") == ""
+	case "always":
+		m.colored = true
+	case "never":
+		m.colored = false
+	default:
+		return nil, nil, fmt.Errorf("-color must be auto, always or never, got %q", m.color)
+	}
+	if *context < 0 {
+		return nil, nil, fmt.Errorf("-C must not be negative, got %d", *context)
+	}
+	if m.after < 0 {
+		m.after = *context
+	}
+	if m.before < 0 {
+		m.before = *context
+	}
+	if *countAll && m.count == "" {
+		m.count = "all"
+	}
+	switch m.count {
+	case "", "all", "file", "package":
+	default:
+		return nil, nil, fmt.Errorf("-count must be all, file or package, got %q", m.count)
+	}
+	m.norms = nil
+	for _, list := range norms {
+		for _, name := range strings.Split(list, ",") {
+			if !validNorm(name) {
+				return nil, nil, fmt.Errorf("-norm %s: unknown normalization %q", list, name)
+			}
+			if m.norms == nil {
+				m.norms = make(map[string]bool)
+			}
+			m.norms[name] = true
+		}
+	}
+	if m.aliases || m.promoted || m.constVal || m.norms["conv"] || m.showTypes {
+		m.typed = true
+	}
+	m.defs = nil
+	for _, def := range defs {
+		if err := m.addDef(def); err != nil {
+			return nil, nil, err
+		}
+	}
 	for i, cmd := range cmds {
 		switch cmd.name {
-		case "w":
+		case "w", "outermost", "innermost", "(", "or", ")":
 			continue // no expr
 		case "p":
+			if cmd.src == "func" {
+				cmds[i].value = parentFunc
+				continue
+			}
 			n, err := strconv.Atoi(cmd.src)
 			if err != nil {
 				return nil, nil, err
@@ -229,17 +1179,365 @@ func (m *matcher) parseCmds(args []string) ([]exprCmd, []string, error) {
 				return nil, nil, fmt.Errorf("cannot parse mods: %v", err)
 			}
 			cmds[i].value = m
-		default:
-			node, err := m.parseExpr(cmd.src)
+		case "limit", "sample":
+			n, err := strconv.Atoi(cmd.src)
 			if err != nil {
 				return nil, nil, err
 			}
+			if n < 0 {
+				return nil, nil, fmt.Errorf("-%s must not be negative, got %d", cmd.name, n)
+			}
+			if cmd.name == "sample" {
+				if i != len(cmds)-1 {
+					return nil, nil, fmt.Errorf("-sample must be the last command")
+				}
+				cmds[i].value = n
+				continue
+			}
+			// the nodes left to keep, shared by all packages
+			cmds[i].value = &n
+		case "u":
+			cmds[i].value = strings.TrimLeft(strings.TrimPrefix(cmd.src, "$"), "*?+")
+		default:
+			src, anc := splitAnchors(cmd.src)
+			srcs := splitAlternatives(src)
+			if len(srcs) > 1 && cmd.name == "s" {
+				return nil, nil, fmt.Errorf("-s %s: cannot use alternatives", cmd.src)
+			}
+			var alts altList
+			for _, src := range srcs {
+				node, err := m.parseExpr(src)
+				if err != nil {
+					return nil, nil, err
+				}
+				if anc.start || anc.end {
+					switch node.(type) {
+					case stmtList, ast.Stmt, ast.Expr:
+					default:
+						return nil, nil, fmt.Errorf("cannot anchor %s: not a statement", cmd.src)
+					}
+				}
+				alts = append(alts, node)
+			}
+			var node ast.Node = alts
+			if len(alts) == 1 {
+				node = alts[0]
+			}
 			cmds[i].value = node
+			cmds[i].literal = !hasWildcards(node)
+			cmds[i].anchors = anc
+		}
+	}
+	if len(cmds) == 0 {
+		return cmds, paths, nil // -f
+	}
+	alts, _, err := groupCmds(cmds, 0, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(alts) > 1 {
+		cmds = []exprCmd{{name: "(", value: alts}}
+	} else {
+		cmds = alts[0]
+	}
+	// each alternative captures its own wildcards
+	for _, path := range cmdPaths(cmds) {
+		if err := m.checkSubsts(path); err != nil {
+			return nil, nil, err
+		}
+		if err := m.checkCollect(path); err != nil {
+			return nil, nil, err
 		}
 	}
+	if err := m.checkTemplate(cmds, m.output); err != nil {
+		return nil, nil, fmt.Errorf("-o %s: %v", m.output, err)
+	}
 	return cmds, paths, nil
 }
 
+// groupCmds splits a list of commands into the alternatives separated by
+// "-or", starting at an index. The commands between "-(" and "-)" are grouped
+// into a single command with the alternatives as its value. It returns the
+// index after the closing "-)", if top is false.
+func groupCmds(cmds []exprCmd, i int, top bool) ([][]exprCmd, int, error) {
+	var alts [][]exprCmd
+	var cur []exprCmd
+	for ; i < len(cmds); i++ {
+		switch cmd := cmds[i]; cmd.name {
+		case "(":
+			inner, next, err := groupCmds(cmds, i+1, false)
+			if err != nil {
+				return nil, 0, err
+			}
+			cur = append(cur, exprCmd{name: "(", value: inner})
+			i = next - 1
+		case ")":
+			if top {
+				return nil, 0, fmt.Errorf("-) without a matching -(")
+			}
+			if len(cur) == 0 {
+				return nil, 0, fmt.Errorf("-or and -) must follow some commands")
+			}
+			alts = append(alts, cur)
+			if err := checkGrouped(alts); err != nil {
+				return nil, 0, err
+			}
+			return alts, i + 1, nil
+		case "or":
+			if len(cur) == 0 {
+				return nil, 0, fmt.Errorf("-or and -) must follow some commands")
+			}
+			alts, cur = append(alts, cur), nil
+		default:
+			cur = append(cur, cmd)
+		}
+	}
+	if !top {
+		return nil, 0, fmt.Errorf("-( without a matching -)")
+	}
+	if len(cur) == 0 {
+		return nil, 0, fmt.Errorf("-or and -) must follow some commands")
+	}
+	alts = append(alts, cur)
+	if len(alts) > 1 {
+		if err := checkGrouped(alts); err != nil {
+			return nil, 0, err
+		}
+	}
+	return alts, i, nil
+}
+
+// checkGrouped makes sure that the alternatives of a group don't use the
+// commands which only make sense once for all the matches, like -w.
+func checkGrouped(alts [][]exprCmd) error {
+	for _, alt := range alts {
+		for _, cmd := range alt {
+			switch cmd.name {
+			case "w", "limit", "sample":
+				return fmt.Errorf("-%s cannot be used within alternatives", cmd.name)
+			}
+		}
+	}
+	return nil
+}
+
+// cmdPaths returns the lists of commands which the nodes may go through,
+// with each group replaced by the commands of one of its alternatives.
+func cmdPaths(cmds []exprCmd) [][]exprCmd {
+	paths := [][]exprCmd{nil}
+	for _, cmd := range cmds {
+		if cmd.name != "(" {
+			for i := range paths {
+				paths[i] = append(paths[i], cmd)
+			}
+			continue
+		}
+		var grown [][]exprCmd
+		for _, path := range paths {
+			for _, alt := range cmd.value.([][]exprCmd) {
+				for _, tail := range cmdPaths(alt) {
+					joined := append(append([]exprCmd(nil), path...), tail...)
+					grown = append(grown, joined)
+				}
+			}
+		}
+		paths = grown
+	}
+	return paths
+}
+
+// normNames are the normalizations which -norm accepts.
+var normNames = []string{"paren", "conv", "keyed", "blank", "decl", "assign", "block"}
+
+// aggressiveNorms are the normalizations enabled by starting a pattern with
+// "~".
+var aggressiveNorms = []string{"blank", "decl", "assign", "block"}
+
+func validNorm(name string) bool {
+	for _, valid := range normNames {
+		if name == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCollect makes sure that the -collect wildcards are captured by some
+// pattern, removing the optional "$", "$*" or "$?" prefixes from their names.
+func (m *matcher) checkCollect(cmds []exprCmd) error {
+	for i, name := range m.collect {
+		name = strings.TrimLeft(strings.TrimPrefix(name, "$"), "*?+")
+		m.collect[i] = name
+		if !m.captured(cmds, name) {
+			return fmt.Errorf("-collect %s: $%s was not captured", name, name)
+		}
+	}
+	return nil
+}
+
+// checkTemplate makes sure that the dollar expressions in a template, like
+// the one given via -o, are captured by some pattern in every alternative.
+func (m *matcher) checkTemplate(cmds []exprCmd, tmpl string) error {
+	for _, path := range cmdPaths(cmds) {
+		for _, sm := range rxOutputVar.FindAllStringSubmatch(tmpl, -1) {
+			if name := sm[1]; name == "_" || !m.captured(path, name) {
+				return fmt.Errorf("%s was not captured", sm[0])
+			}
+		}
+	}
+	return nil
+}
+
+// captured reports whether a wildcard is captured by any of the patterns
+// which record values.
+func (m *matcher) captured(cmds []exprCmd, name string) bool {
+	for _, cmd := range cmds {
+		switch cmd.name {
+		case "x", "children", "g", "in", "follows", "precedes":
+		default:
+			continue
+		}
+		for _, info := range m.patternVars(cmd.value.(ast.Node)) {
+			if info.name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkSubsts makes sure that substitutions only use wildcards captured by
+// the patterns before them, and in the same form. Otherwise, fillValues
+// could leave a wildcard in place or misuse a list. The same applies to
+// attributes on wildcards, like "$x:comp".
+func (m *matcher) checkSubsts(cmds []exprCmd) error {
+	captured := make(map[string]varInfo)
+	// listMatch is whether the nodes being matched are lists, and concat
+	// whether they are fmtconcat calls, whose "$*args" may be joined
+	// with "+" in place of a single expression; see joinExprs
+	listMatch, concat := false, false
+	for _, cmd := range cmds {
+		switch cmd.name {
+		case "x", "children", "g", "in", "follows", "precedes":
+			for _, info := range m.capturedVars(cmd.value.(ast.Node)) {
+				if _, ok := captured[info.name]; !ok {
+					captured[info.name] = info
+				}
+			}
+			if cmd.name == "x" || cmd.name == "children" {
+				_, alts := cmd.value.(altList)
+				_, list := cmd.value.(nodeList)
+				listMatch = list && !alts
+			}
+		case "u":
+			name := cmd.value.(string)
+			if _, ok := captured[name]; !ok || name == "_" {
+				return fmt.Errorf("-u %s: $%s was not captured", cmd.src, name)
+			}
+		case "a":
+			if cmd.value == nodeProperty("fmtconcat") {
+				concat = true
+			}
+			wa, ok := cmd.value.(wildAttr)
+			if !ok {
+				break
+			}
+			prev, ok := captured[wa.info.name]
+			switch {
+			case wa.info.name == "_":
+				return fmt.Errorf("-a %s: %v captures nothing", cmd.src, wa.info)
+			case !ok:
+				return fmt.Errorf("-a %s: %v was not captured", cmd.src, wa.info)
+			case prev.any != wa.info.any:
+				return fmt.Errorf("-a %s: %v was captured as %v", cmd.src, wa.info, prev)
+			}
+		case "s":
+			var err error
+			single := m.singleExprWilds(cmd.value.(ast.Node))
+			if info := m.info(fromWildNode(cmd.value.(ast.Node))); info.any && !listMatch {
+				single[info.name] = true
+			}
+			inspect(cmd.value.(ast.Node), func(node ast.Node) bool {
+				info := m.info(fromWildNode(node))
+				if err != nil || info.name == "" {
+					return err == nil
+				}
+				prev, ok := captured[info.name]
+				switch {
+				case info.name == "_":
+					err = fmt.Errorf("-s %s: %v captures nothing", cmd.src, info)
+				case !ok:
+					err = fmt.Errorf("-s %s: %v was not captured", cmd.src, info)
+				case prev.any != info.any:
+					err = fmt.Errorf("-s %s: %v was captured as %v", cmd.src, info, prev)
+				case info.any && single[info.name] && !concat:
+					err = fmt.Errorf("-s %s: %v is a list, so it cannot replace a single expression", cmd.src, info)
+				}
+				return err == nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// singleExprWilds returns the names of the "$*x" wildcards within a node
+// which are in place of a single expression, like in "$*x + 1", rather than
+// in a list of them, like in "f($*x)".
+func (m *matcher) singleExprWilds(node ast.Node) map[string]bool {
+	single := make(map[string]bool)
+	exprType := reflect.TypeOf((*ast.Expr)(nil)).Elem()
+	inspect(node, func(node ast.Node) bool {
+		switch node.(type) {
+		case *ast.ExprStmt, *ast.Field:
+			// wildcards standing for statements or fields
+			return true
+		}
+		v := reflect.ValueOf(node)
+		if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+			return true
+		}
+		v = v.Elem()
+		for i := 0; i < v.NumField(); i++ {
+			fld := v.Field(i)
+			if fld.Type() != exprType || fld.IsNil() {
+				continue
+			}
+			if info := m.info(fromWildNode(fld.Interface().(ast.Node))); info.any {
+				single[info.name] = true
+			}
+		}
+		return true
+	})
+	return single
+}
+
+// capturedVars is like patternVars, but for alternatives it only returns the
+// wildcards captured by all of them.
+func (m *matcher) capturedVars(node ast.Node) []varInfo {
+	alts, ok := node.(altList)
+	if !ok {
+		return m.patternVars(node)
+	}
+	vars := m.patternVars(alts[0])
+	for _, alt := range alts[1:] {
+		inAlt := make(map[varInfo]bool)
+		for _, info := range m.patternVars(alt) {
+			inAlt[info] = true
+		}
+		var kept []varInfo
+		for _, info := range vars {
+			if inAlt[info] {
+				kept = append(kept, info)
+			}
+		}
+		vars = kept
+	}
+	return vars
+}
+
 type bufferJoinLines struct {
 	bytes.Buffer
 	last string
@@ -259,6 +1557,11 @@ func (b *bufferJoinLines) Write(p []byte) (n int, err error) {
 		b.last = "\n"
 		return 1, nil
 	}
+	if b.last != "\n" && len(p) > 0 && len(bytes.Trim(p, "\t")) == 0 {
+		// tabs aligning columns, like between a field's name
+		// and type, rather than indentation
+		p = []byte(" ")
+	}
 	p = bytes.Trim(p, "\t")
 	n, err = b.Buffer.Write(p)
 	b.last = string(p)
@@ -283,11 +1586,136 @@ func inspect(node ast.Node, fn func(ast.Node) bool) {
 		return
 	}
 	for i := 0; i < list.len(); i++ {
-		ast.Inspect(list.at(i), fn)
+		inspect(list.at(i), fn)
 	}
 	fn(nil)
 }
 
+// explainCmd prints how a command was parsed. Patterns are printed as a
+// tree of node kinds, one node per line, with the wildcards annotated.
+func (m *matcher) explainCmd(cmd exprCmd) {
+	if alts, ok := cmd.value.([][]exprCmd); ok {
+		fmt.Fprintln(m.out, "-(")
+		for i, alt := range alts {
+			if i > 0 {
+				fmt.Fprintln(m.out, "-or")
+			}
+			for _, cmd := range alt {
+				m.explainCmd(cmd)
+			}
+		}
+		fmt.Fprintln(m.out, "-)")
+		return
+	}
+	fmt.Fprintf(m.out, "-%s %s\n", cmd.name, cmd.src)
+	switch x := cmd.value.(type) {
+	case ast.Node:
+		m.explainTree(x, 1)
+	case attribute:
+		if cmd.name != "a" {
+			break
+		}
+		fmt.Fprintf(m.out, "  %s\n", explainAttr(x))
+		for {
+			if wa, ok := x.(wildAttr); ok {
+				x = wa.attr
+			} else if na, ok := x.(negAttr); ok {
+				x = na.attr
+			} else {
+				break
+			}
+		}
+		if sub, ok := x.(subPattern); ok {
+			m.explainTree(sub.node, 2)
+		}
+	}
+}
+
+// explainTree prints a pattern as a tree of nodes, starting at an
+// indentation depth.
+func (m *matcher) explainTree(node ast.Node, depth int) {
+	inspect(node, func(node ast.Node) bool {
+		if node == nil {
+			depth--
+			return true
+		}
+		fmt.Fprintf(m.out, "%s%s\n", strings.Repeat("  ", depth), m.explainNode(node))
+		if fromWildNode(node) >= 0 {
+			return false // don't show the wildcard twice
+		}
+		depth++
+		return true
+	})
+}
+
+// explainNode describes a single pattern node, such as "Ident foo" or
+// "Ident $*x: list wildcard".
+func (m *matcher) explainNode(node ast.Node) string {
+	kind := nodeKind(node)
+	if list, ok := node.(nodeList); ok {
+		return fmt.Sprintf("%s (%d)", kind, list.len())
+	}
+	if id := fromWildNode(node); id >= 0 {
+		info := m.info(id)
+		what := "wildcard"
+		switch {
+		case info.opt:
+			what = "optional wildcard"
+		case info.greedy:
+			what = "greedy list wildcard"
+		case info.any:
+			what = "list wildcard"
+		}
+		return fmt.Sprintf("%s %v: %s", kind, info, what)
+	}
+	return nodeDesc(node)
+}
+
+// nodeDesc describes a node by its kind and, for some kinds, its name,
+// value or operator, such as "Ident foo" or "BinaryExpr ==".
+func nodeDesc(node ast.Node) string {
+	kind := nodeKind(node)
+	switch x := node.(type) {
+	case *ast.Ident:
+		return kind + " " + x.Name
+	case *ast.BasicLit:
+		return kind + " " + x.Value
+	case *ast.BinaryExpr:
+		return kind + " " + x.Op.String()
+	case *ast.UnaryExpr:
+		return kind + " " + x.Op.String()
+	case *ast.AssignStmt:
+		return kind + " " + x.Tok.String()
+	case *ast.IncDecStmt:
+		return kind + " " + x.Tok.String()
+	case *ast.BranchStmt:
+		return kind + " " + x.Tok.String()
+	case *ast.GenDecl:
+		return kind + " " + x.Tok.String()
+	}
+	return kind
+}
+
+// explainAttr describes a parsed attribute, such as "typUnderlying slice".
+func explainAttr(attr attribute) string {
+	switch x := attr.(type) {
+	case wildAttr:
+		return fmt.Sprintf("on %v: %s", x.info, explainAttr(x.attr))
+	case negAttr:
+		return "not " + explainAttr(x.attr)
+	case typeCheck:
+		return fmt.Sprintf("typeCheck %s(%s)", x.op, singleLinePrint(x.expr))
+	case subPattern:
+		return "subPattern"
+	case lenCheck:
+		return fmt.Sprintf("lenCheck %s %v %d", x.of, x.op, x.n)
+	case *regexp.Regexp:
+		return "rx " + x.String()
+	}
+	kind := strings.TrimPrefix(fmt.Sprintf("%T", attr), "main.")
+	return fmt.Sprintf("%s %v", kind, attr)
+}
+
 var emptyFset = token.NewFileSet()
 
 func singleLinePrint(node ast.Node) string {
@@ -306,10 +1734,60 @@ func singleLinePrint(node ast.Node) string {
 		bl.Value = strconv.Quote(bl.Value[1 : len(bl.Value)-1])
 		return true
 	})
+	defer hideComments(node)()
 	printNode(&buf, emptyFset, node)
 	return buf.String()
 }
 
+// hideComments removes the comments attached to a node and its children, as
+// they can't be printed on a single line. The returned func restores them.
+func hideComments(node ast.Node) (restore func()) {
+	var saved []**ast.CommentGroup
+	var groups []*ast.CommentGroup
+	hide := func(ptrs ...**ast.CommentGroup) {
+		for _, ptr := range ptrs {
+			if *ptr != nil {
+				saved = append(saved, ptr)
+				groups = append(groups, *ptr)
+				*ptr = nil
+			}
+		}
+	}
+	var fileComments map[*ast.File][]*ast.CommentGroup
+	inspect(node, func(node ast.Node) bool {
+		switch x := node.(type) {
+		case *ast.File:
+			if fileComments == nil {
+				fileComments = make(map[*ast.File][]*ast.CommentGroup)
+			}
+			fileComments[x] = x.Comments
+			x.Comments = nil
+			hide(&x.Doc)
+		case *ast.FuncDecl:
+			hide(&x.Doc)
+		case *ast.GenDecl:
+			hide(&x.Doc)
+		case *ast.ValueSpec:
+			hide(&x.Doc, &x.Comment)
+		case *ast.TypeSpec:
+			hide(&x.Doc, &x.Comment)
+		case *ast.ImportSpec:
+			hide(&x.Doc, &x.Comment)
+		case *ast.Field:
+			hide(&x.Doc, &x.Comment)
+		}
+		return true
+	})
+	return func() {
+		for i, ptr := range saved {
+			*ptr = groups[i]
+		}
+		for f, comments := range fileComments {
+			f.Comments = comments
+		}
+	}
+}
+
 func printNode(w io.Writer, fset *token.FileSet, node ast.Node) {
 	switch x := node.(type) {
 	case exprList:
@@ -330,6 +1808,42 @@ func printNode(w io.Writer, fset *token.FileSet, node ast.Node) {
 			fmt.Fprintf(w, "; ")
 			printNode(w, fset, n)
 		}
+	case specList:
+		if len(x) == 0 {
+			return
+		}
+		printNode(w, fset, x[0])
+		for _, n := range x[1:] {
+			fmt.Fprintf(w, "; ")
+			printNode(w, fset, n)
+		}
+	case fieldList:
+		if len(x) == 0 {
+			return
+		}
+		printNode(w, fset, x[0])
+		for _, n := range x[1:] {
+			fmt.Fprintf(w, ", ")
+			printNode(w, fset, n)
+		}
+	case *ast.FieldList:
+		printNode(w, fset, fieldList(x.List))
+	case *ast.Field:
+		// go/printer can't print fields on their own
+		for i, name := range x.Names {
+			if i > 0 {
+				fmt.Fprintf(w, ", ")
+			}
+			printNode(w, fset, name)
+		}
+		if len(x.Names) > 0 {
+			fmt.Fprintf(w, " ")
+		}
+		printNode(w, fset, x.Type)
+		if x.Tag != nil {
+			fmt.Fprintf(w, " ")
+			printNode(w, fset, x.Tag)
+		}
 	default:
 		err := printer.Fprint(w, fset, node)
 		if err != nil && strings.Contains(err.Error(), "go/printer: unsupported node type") {
@@ -6,27 +6,33 @@ package main
 import (
 	"fmt"
 	"go/ast"
+	"go/constant"
 	"go/importer"
 	"go/token"
 	"go/types"
+	"math/rand"
+	"path"
+	"path/filepath"
+	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 )
 
-func (m *matcher) matches(cmds []exprCmd, nodes []ast.Node) []ast.Node {
+func (m *matcher) matches(cmds []exprCmd, nodes []ast.Node) []submatch {
+	if limitReached(cmds) {
+		return nil
+	}
 	m.parents = make(map[ast.Node]ast.Node)
+	m.commentMaps = make(map[*ast.File]ast.CommentMap)
 	m.fillParents(nodes...)
 	initial := make([]submatch, len(nodes))
 	for i, node := range nodes {
 		initial[i].node = node
 		initial[i].values = make(map[string]ast.Node)
 	}
-	final := m.submatches(cmds, initial)
-	finalNodes := make([]ast.Node, len(final))
-	for i := range finalNodes {
-		finalNodes[i] = final[i].node
-	}
-	return finalNodes
+	return m.submatches(cmds, initial)
 }
 
 func (m *matcher) fillParents(nodes ...ast.Node) {
@@ -49,6 +55,16 @@ func (m *matcher) fillParents(nodes ...ast.Node) {
 type submatch struct {
 	node   ast.Node
 	values map[string]ast.Node
+
+	// alt is which of the alternatives of the last -x or -children pattern
+	// with any matched the node, starting at 1, or zero if none had
+	// alternatives
+	alt int
+
+	// decl and comments are what -group and -comments print along with
+	// the node; see annotate
+	decl     ast.Decl
+	comments []*ast.Comment
 }
 
 func valsCopy(values map[string]ast.Node) map[string]ast.Node {
@@ -65,17 +81,46 @@ func (m *matcher) submatches(cmds []exprCmd, subs []submatch) []submatch {
 	}
 	cmd := cmds[0]
 	var fn func(exprCmd, []submatch) []submatch
+	m.rangeLimit = -1
 	switch cmd.name {
-	case "x":
+	case "x", "children":
 		fn = m.cmdRange
+		if len(cmds) > 1 && cmds[1].name == "limit" {
+			// no need to find more nodes than the limit keeps
+			m.rangeLimit = *cmds[1].value.(*int)
+		}
 	case "g":
 		fn = m.cmdFilter(true)
 	case "v":
 		fn = m.cmdFilter(false)
 	case "s":
 		fn = m.cmdSubst
+	case "in":
+		fn = m.cmdWithin(true)
+	case "notin":
+		fn = m.cmdWithin(false)
+	case "follows":
+		fn = m.cmdSiblings(false, true)
+	case "notfollows":
+		fn = m.cmdSiblings(false, false)
+	case "precedes":
+		fn = m.cmdSiblings(true, true)
+	case "notprecedes":
+		fn = m.cmdSiblings(true, false)
 	case "a":
 		fn = m.cmdAttr
+	case "u":
+		fn = m.cmdUnique
+	case "outermost":
+		fn = m.cmdNested(false)
+	case "innermost":
+		fn = m.cmdNested(true)
+	case "limit":
+		fn = m.cmdLimit
+	case "(":
+		fn = m.cmdGroup
+	case "sample":
+		fn = m.cmdSample
 	case "p":
 		fn = m.cmdParents
 	case "w":
@@ -97,13 +142,25 @@ func (m *matcher) cmdRange(cmd exprCmd, subs []submatch) []submatch {
 	// from its parent submatch. If we don't do this copy, all the
 	// submatches would share the same map and have side effects.
 	var startValues map[string]ast.Node
+	var startAlt int
 
 	match := func(exprNode, node ast.Node) {
-		if node == nil {
+		if node == nil || len(matches) == m.rangeLimit {
 			return
 		}
-		m.values = valsCopy(startValues)
-		found := m.topNode(exprNode, node)
+		if m.literal {
+			// nothing will be recorded, so share the map
+			m.values = startValues
+		} else {
+			m.values = valsCopy(startValues)
+		}
+		m.trace = m.debugTrace(node)
+		m.alt = startAlt
+		found := m.topNode(exprNode, node, cmd.anchors)
+		if m.trace != nil {
+			m.printTrace(cmd, node)
+			m.trace = nil
+		}
 		if found == nil {
 			return
 		}
@@ -112,13 +169,26 @@ func (m *matcher) cmdRange(cmd exprCmd, subs []submatch) []submatch {
 			matches = append(matches, submatch{
 				node:   found,
 				values: m.values,
+				alt:    m.alt,
 			})
 			seen[hash] = true
 		}
 	}
+	m.literal = cmd.literal
+	defer func() { m.literal = false }()
 	for _, sub := range subs {
-		startValues = valsCopy(sub.values)
-		m.walkWithLists(cmd.value.(ast.Node), sub.node, match)
+		if len(matches) == m.rangeLimit {
+			break
+		}
+		startValues, startAlt = sub.values, sub.alt
+		if !m.literal {
+			startValues = valsCopy(sub.values)
+		}
+		if cmd.name == "children" {
+			m.walkChildren(cmd.value.(ast.Node), sub.node, match)
+		} else {
+			m.walkWithLists(cmd.value.(ast.Node), sub.node, match)
+		}
 	}
 	return matches
 }
@@ -126,21 +196,102 @@ func (m *matcher) cmdRange(cmd exprCmd, subs []submatch) []submatch {
 func (m *matcher) cmdFilter(wantAny bool) func(exprCmd, []submatch) []submatch {
 	return func(cmd exprCmd, subs []submatch) []submatch {
 		var matches []submatch
-		any := false
+		// Values are recorded even when a match fails halfway, so
+		// start each attempt from a copy and keep only the first
+		// successful one.
+		var startValues, found map[string]ast.Node
 		match := func(exprNode, node ast.Node) {
-			if node == nil {
+			if node == nil || found != nil {
 				return
 			}
-			found := m.topNode(exprNode, node)
-			if found != nil {
-				any = true
+			m.values = startValues
+			if !m.literal {
+				m.values = valsCopy(startValues)
+			}
+			if m.topNode(exprNode, node, cmd.anchors) != nil {
+				found = m.values
 			}
 		}
+		m.literal = cmd.literal
+		defer func() { m.literal = false }()
 		for _, sub := range subs {
-			any = false
-			m.values = sub.values
+			startValues, found = sub.values, nil
 			m.walkWithLists(cmd.value.(ast.Node), sub.node, match)
-			if any == wantAny {
+			if any := found != nil; any == wantAny {
+				if any {
+					sub.values = found
+				}
+				matches = append(matches, sub)
+			}
+		}
+		return matches
+	}
+}
+
+// cmdWithin keeps the nodes within a node matching a pattern, or those not
+// within any such node if wantIn is false. Unlike -g and -v, which look at
+// the nodes inside each match, it looks at the nodes around it.
+func (m *matcher) cmdWithin(wantIn bool) func(exprCmd, []submatch) []submatch {
+	return func(cmd exprCmd, subs []submatch) []submatch {
+		var matches []submatch
+		m.literal = cmd.literal
+		defer func() { m.literal = false }()
+		for _, sub := range subs {
+			var found map[string]ast.Node
+			for node := m.parentOf(sub.node); node != nil; node = m.parentOf(node) {
+				m.values = sub.values
+				if !m.literal {
+					m.values = valsCopy(sub.values)
+				}
+				if m.topNode(cmd.value.(ast.Node), node, cmd.anchors) != nil {
+					found = m.values
+					break
+				}
+			}
+			if in := found != nil; in == wantIn {
+				if in {
+					sub.values = found
+				}
+				matches = append(matches, sub)
+			}
+		}
+		return matches
+	}
+}
+
+// cmdSiblings keeps the nodes after a statement matching a pattern within
+// the same function, or before one if later is true. Only the statements
+// which run before or after the node are considered; that is, those
+// preceding or following it in its block and in each of the blocks
+// around it, up to the enclosing function. If wantAny is false, the nodes
+// without such a statement are kept instead.
+func (m *matcher) cmdSiblings(later, wantAny bool) func(exprCmd, []submatch) []submatch {
+	return func(cmd exprCmd, subs []submatch) []submatch {
+		var matches []submatch
+		var startValues, found map[string]ast.Node
+		match := func(exprNode, node ast.Node) {
+			if node == nil || found != nil {
+				return
+			}
+			m.values = startValues
+			if !m.literal {
+				m.values = valsCopy(startValues)
+			}
+			if m.topNode(exprNode, node, cmd.anchors) != nil {
+				found = m.values
+			}
+		}
+		m.literal = cmd.literal
+		defer func() { m.literal = false }()
+		for _, sub := range subs {
+			startValues, found = sub.values, nil
+			for _, list := range m.siblingStmts(sub.node, later) {
+				m.walkWithLists(cmd.value.(ast.Node), list, match)
+			}
+			if any := found != nil; any == wantAny {
+				if any {
+					sub.values = found
+				}
 				matches = append(matches, sub)
 			}
 		}
@@ -148,6 +299,52 @@ func (m *matcher) cmdFilter(wantAny bool) func(exprCmd, []submatch) []submatch {
 	}
 }
 
+// siblingStmts returns the statements before a node in its block and in
+// each of the enclosing blocks, up to the enclosing function, with the
+// closest ones first. If later is true, the statements after it are
+// returned instead.
+func (m *matcher) siblingStmts(node ast.Node, later bool) []stmtList {
+	if list, ok := node.(nodeList); ok {
+		if list.len() == 0 {
+			return nil
+		}
+		if later {
+			node = list.at(list.len() - 1)
+		} else {
+			node = list.at(0)
+		}
+	}
+	var lists []stmtList
+	for parent := m.parentOf(node); parent != nil; node, parent = parent, m.parentOf(parent) {
+		var stmts []ast.Stmt
+		switch x := parent.(type) {
+		case *ast.FuncDecl, *ast.FuncLit:
+			return lists
+		case *ast.BlockStmt:
+			stmts = x.List
+		case *ast.CaseClause:
+			stmts = x.Body
+		case *ast.CommClause:
+			stmts = x.Body
+		case stmtList:
+			stmts = x
+		default:
+			continue
+		}
+		for i, stmt := range stmts {
+			if stmt != node {
+				continue
+			}
+			if later {
+				lists = append(lists, stmtList(stmts[i+1:]))
+			} else {
+				lists = append(lists, stmtList(stmts[:i]))
+			}
+		}
+	}
+	return lists
+}
+
 func (m *matcher) cmdAttr(cmd exprCmd, subs []submatch) []submatch {
 	var matches []submatch
 	for _, sub := range subs {
@@ -159,18 +356,262 @@ func (m *matcher) cmdAttr(cmd exprCmd, subs []submatch) []submatch {
 	return matches
 }
 
+// cmdUnique keeps the first node for each distinct value captured by a
+// wildcard, compared by their printed source. The nodes where it wasn't
+// captured are kept as if it captured nothing.
+func (m *matcher) cmdUnique(cmd exprCmd, subs []submatch) []submatch {
+	name := cmd.value.(string)
+	seen := make(map[string]bool)
+	var matches []submatch
+	for _, sub := range subs {
+		key := ""
+		if value, ok := sub.values[name]; ok {
+			key = singleLinePrint(value)
+		}
+		if !seen[key] {
+			seen[key] = true
+			matches = append(matches, sub)
+		}
+	}
+	return matches
+}
+
+// cmdNested discards the nodes within any of the other nodes, such as the
+// inner calls in "f(g(x))", or those containing any of them if inner is
+// true. Nodes with the same range, like a statement and its expression,
+// don't contain one another.
+func (m *matcher) cmdNested(inner bool) func(exprCmd, []submatch) []submatch {
+	return func(cmd exprCmd, subs []submatch) []submatch {
+		// with the nodes sorted by start and then by reverse end,
+		// each node is followed by those within it
+		order := make([]int, len(subs))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			x, y := subs[order[i]].node, subs[order[j]].node
+			if x.Pos() != y.Pos() {
+				return x.Pos() < y.Pos()
+			}
+			return x.End() > y.End()
+		})
+		within := func(x, y ast.Node) bool {
+			return posHash(x) != posHash(y) &&
+				y.Pos() <= x.Pos() && x.End() <= y.End()
+		}
+		drop := make([]bool, len(subs))
+		var outer ast.Node
+		for k, i := range order {
+			node := subs[i].node
+			switch {
+			case inner:
+				for _, j := range order[k+1:] {
+					if next := subs[j].node; posHash(next) != posHash(node) {
+						drop[i] = within(next, node)
+						break
+					}
+				}
+			case outer != nil && within(node, outer):
+				drop[i] = true
+			default:
+				outer = node
+			}
+		}
+		var matches []submatch
+		for i, sub := range subs {
+			if !drop[i] {
+				matches = append(matches, sub)
+			}
+		}
+		return matches
+	}
+}
+
+// cmdGroup applies each of the alternative lists of commands to the same
+// nodes, keeping the nodes resulting from any of them in order. A node
+// resulting from many of them is only kept once, with the values from the
+// first.
+func (m *matcher) cmdGroup(cmd exprCmd, subs []submatch) []submatch {
+	var matches []submatch
+	seen := map[nodePosHash]bool{}
+	for _, alt := range cmd.value.([][]exprCmd) {
+		// commands like -p modify the nodes in place
+		altSubs := make([]submatch, len(subs))
+		copy(altSubs, subs)
+		for _, sub := range m.submatches(alt, altSubs) {
+			if hash := posHash(sub.node); !seen[hash] {
+				matches = append(matches, sub)
+				seen[hash] = true
+			}
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].node.Pos() < matches[j].node.Pos()
+	})
+	return matches
+}
+
+// cmdLimit keeps the first nodes up to the limit, which is shared by all the
+// packages being matched.
+func (m *matcher) cmdLimit(cmd exprCmd, subs []submatch) []submatch {
+	left := cmd.value.(*int)
+	if len(subs) > *left {
+		subs = subs[:*left]
+	}
+	*left -= len(subs)
+	return subs
+}
+
+// limitReached reports whether any of the -limit commands has kept as many
+// nodes as it could, in which case no more nodes can be matched.
+func limitReached(cmds []exprCmd) bool {
+	for _, cmd := range cmds {
+		if cmd.name == "limit" && *cmd.value.(*int) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// cmdSample keeps a random sample of the nodes, in their original order.
+func (m *matcher) cmdSample(cmd exprCmd, subs []submatch) []submatch {
+	n := cmd.value.(int)
+	if len(subs) <= n {
+		return subs
+	}
+	picked := rand.Perm(len(subs))[:n]
+	sort.Ints(picked)
+	matches := make([]submatch, n)
+	for i, j := range picked {
+		matches[i] = subs[j]
+	}
+	return matches
+}
+
+// parentFunc is the -p value to navigate up to the enclosing function.
+const parentFunc = -1
+
 func (m *matcher) cmdParents(cmd exprCmd, subs []submatch) []submatch {
 	for i := range subs {
 		sub := &subs[i]
 		reps := cmd.value.(int)
+		if reps == parentFunc {
+			sub.node = m.enclosingFunc(sub.node)
+			continue
+		}
 		for j := 0; j < reps; j++ {
 			sub.node = m.parentOf(sub.node)
 		}
 	}
-	return subs
+	var matches []submatch
+	for _, sub := range subs {
+		if sub.node != nil {
+			matches = append(matches, sub)
+		}
+	}
+	return matches
+}
+
+// enclosingDecl returns the top-level declaration containing node, or node
+// itself if it is one. It returns nil if there is none, such as for a file.
+func (m *matcher) enclosingDecl(node ast.Node) ast.Decl {
+	for ; node != nil; node = m.parentOf(node) {
+		if _, ok := m.parentOf(node).(*ast.File); ok {
+			decl, _ := node.(ast.Decl)
+			return decl
+		}
+	}
+	return nil
+}
+
+// funcName returns the name of a function declaration, prefixed by the
+// name of its receiver type if it is a method, as in "T.Close".
+func funcName(fd *ast.FuncDecl) string {
+	if fd.Recv == nil || len(fd.Recv.List) == 0 {
+		return fd.Name.Name
+	}
+	typ := fd.Recv.List[0].Type
+	for {
+		switch x := typ.(type) {
+		case *ast.StarExpr:
+			typ = x.X
+			continue
+		case *ast.IndexExpr:
+			typ = x.X
+			continue
+		case *ast.IndexListExpr:
+			typ = x.X
+			continue
+		case *ast.ParenExpr:
+			typ = x.X
+			continue
+		case *ast.Ident:
+			return x.Name + "." + fd.Name.Name
+		}
+		return fd.Name.Name
+	}
+}
+
+// declHeader describes a top-level declaration on a single line. Functions
+// are printed without their body, as in "func (t *T) Close() error", and
+// other declarations by the names they declare, as in "var a, b".
+func declHeader(decl ast.Decl) string {
+	switch x := decl.(type) {
+	case *ast.FuncDecl:
+		header := *x
+		header.Doc, header.Body = nil, nil
+		return singleLinePrint(&header)
+	case *ast.GenDecl:
+		var names []string
+		for _, spec := range x.Specs {
+			switch spec := spec.(type) {
+			case *ast.ValueSpec:
+				for _, name := range spec.Names {
+					names = append(names, name.Name)
+				}
+			case *ast.TypeSpec:
+				names = append(names, spec.Name.Name)
+			case *ast.ImportSpec:
+				names = append(names, spec.Path.Value)
+			}
+		}
+		return x.Tok.String() + " " + strings.Join(names, ", ")
+	}
+	return nodeKind(decl)
+}
+
+// enclosingFunc returns the closest function declaration or literal
+// containing node, or nil if there is none.
+func (m *matcher) enclosingFunc(node ast.Node) ast.Node {
+	for node = m.parentOf(node); node != nil; node = m.parentOf(node) {
+		switch node.(type) {
+		case *ast.FuncDecl, *ast.FuncLit:
+			return node
+		}
+	}
+	return nil
 }
 
 func (m *matcher) attrApplies(node ast.Node, attr interface{}) bool {
+	if neg, ok := attr.(negAttr); ok {
+		return !m.attrApplies(node, neg.attr)
+	}
+	if x, ok := attr.(wildAttr); ok {
+		value := m.values[x.info.name]
+		return value != nil && m.attrApplies(value, x.attr)
+	}
+	if x, ok := attr.(subPattern); ok {
+		if exprStmt, ok := node.(*ast.ExprStmt); ok {
+			if _, ok := x.node.(ast.Expr); ok {
+				node = exprStmt.X
+			}
+		}
+		// the wildcards in the pattern must not leak into the match
+		values := m.values
+		m.values = valsCopy(values)
+		defer func() { m.values = values }()
+		return m.node(x.node, node)
+	}
 	if rx, ok := attr.(*regexp.Regexp); ok {
 		if exprStmt, ok := node.(*ast.ExprStmt); ok {
 			// since we prefer matching entire statements, get the
@@ -180,6 +621,122 @@ func (m *matcher) attrApplies(node ast.Node, attr interface{}) bool {
 		ident, ok := node.(*ast.Ident)
 		return ok && rx.MatchString(ident.Name)
 	}
+	if x, ok := attr.(directive); ok {
+		for _, c := range m.directivesOf(node) {
+			if x.rx.MatchString(c.Text[2:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if x, ok := attr.(docMatch); ok {
+		doc := m.docOf(node)
+		return doc != nil && x.rx.MatchString(doc.Text())
+	}
+	if x, ok := attr.(commentMatch); ok {
+		for _, c := range m.commentsOf(node) {
+			if x.rx.MatchString(commentText(c)) {
+				return true
+			}
+		}
+		return false
+	}
+	if x, ok := attr.(tagMatch); ok {
+		field := m.fieldOf(node)
+		if field == nil || field.Tag == nil {
+			return false
+		}
+		tag, err := strconv.Unquote(field.Tag.Value)
+		if err != nil {
+			return false
+		}
+		value, ok := reflect.StructTag(tag).Lookup(x.key)
+		return ok && x.rx.MatchString(value)
+	}
+	if x, ok := attr.(fileGlob); ok {
+		return fileMatches(string(x), m.position(node.Pos()).Filename)
+	}
+	if x, ok := attr.(fileRx); ok {
+		return x.rx.MatchString(filepath.ToSlash(m.position(node.Pos()).Filename))
+	}
+	if x, ok := attr.(funcMatch); ok {
+		decl := m.enclosingDecl(node)
+		fd, ok := decl.(*ast.FuncDecl)
+		return ok && (x.rx.MatchString(funcName(fd)) ||
+			x.rx.MatchString(declHeader(fd)))
+	}
+	if x, ok := attr.(pkgMatch); ok {
+		path := m.objectPkg(node)
+		return path != "" && importMatches(string(x), path)
+	}
+	if lc, ok := attr.(lenCheck); ok {
+		var n int
+		switch lc.of {
+		case "stmts":
+			n, ok = stmtCount(node)
+		case "lines":
+			n, ok = m.lineCount(node)
+		default:
+			n, ok = nodeLen(node)
+		}
+		return ok && lc.holds(n)
+	}
+	if x, ok := attr.(rangeKind); ok {
+		rng, ok := node.(*ast.RangeStmt)
+		return ok && m.rangesOver(rng, string(x))
+	}
+	if x, ok := attr.(objKind); ok {
+		return m.objKindOf(node) == string(x)
+	}
+	if x, ok := attr.(nodeProperty); ok {
+		switch x {
+		case "inloop":
+			return m.inLoop(node)
+		case "toplevel":
+			return m.topLevel(node)
+		case "indefer":
+			return m.inDefer(node)
+		case "intest":
+			return m.inTest(node)
+		case "def":
+			id := nodeIdent(node)
+			return id != nil && m.Info.Defs[id] != nil
+		case "use":
+			id := nodeIdent(node)
+			return id != nil && m.Info.Uses[id] != nil
+		case "methodexpr", "methodvalue", "methodcall":
+			return m.methodUse(node) == string(x)
+		case "unusedresult":
+			return m.resultUnused(node)
+		case "fmtconcat":
+			return m.fmtConcat(node)
+		case "noopconv":
+			return m.noopConv(node)
+		case "loopvar":
+			return m.capturesLoopVar(node)
+		case "narrowable":
+			return m.narrowable(node)
+		case "boxing":
+			return m.boxing(node)
+		case "zeroinit":
+			return m.zeroInit(node)
+		case "hasdefault":
+			return hasDefault(node)
+		case "field":
+			field, ok := node.(*ast.Field)
+			return ok && m.structField(field)
+		case "exported":
+			return exported(node)
+		case "pure":
+			return m.pure(node)
+		}
+		return false
+	}
+	if list, ok := node.(exprList); ok && len(list) == 1 {
+		// a list of one expression, such as the values in
+		// "var x = a + b", is found before the expression itself
+		node = list[0]
+	}
 	expr, _ := node.(ast.Expr)
 	if expr == nil {
 		return false // only exprs have types
@@ -193,114 +750,1620 @@ func (m *matcher) attrApplies(node ast.Node, attr interface{}) bool {
 	case typeCheck:
 		want := m.resolveType(m.scope, x.expr)
 		switch {
+		case want == nil:
+			return false
 		case x.op == "type" && !types.Identical(t, want):
 			return false
 		case x.op == "asgn" && !types.AssignableTo(t, want):
 			return false
 		case x.op == "conv" && !types.ConvertibleTo(t, want):
 			return false
+		case x.op == "impl" && !implements(t, want):
+			return false
 		}
 	case typProperty:
 		switch {
-		case x == "comp" && !types.Comparable(t):
+		case x == "comp" && !types.Comparable(m.comparedType(expr, t)):
 			return false
 		case x == "addr" && !tv.Addressable():
 			return false
+		case x == "const" && tv.Value == nil:
+			return false
+		case x == "isnil" && !tv.IsNil():
+			return false
+		case x == "nilable" && !nilable(t):
+			return false
 		}
 	case typUnderlying:
-		u := t.Underlying()
-		uok := true
-		switch x {
-		case "basic":
-			_, uok = u.(*types.Basic)
-		case "array":
-			_, uok = u.(*types.Array)
-		case "slice":
-			_, uok = u.(*types.Slice)
-		case "struct":
-			_, uok = u.(*types.Struct)
-		case "interface":
-			_, uok = u.(*types.Interface)
-		case "pointer":
-			_, uok = u.(*types.Pointer)
-		case "func":
-			_, uok = u.(*types.Signature)
-		case "map":
-			_, uok = u.(*types.Map)
-		case "chan":
-			_, uok = u.(*types.Chan)
-		}
-		if !uok {
+		if !underlyingIs(t, string(x)) {
+			return false
+		}
+	case typeName:
+		byName := types.TypeString(t, func(pkg *types.Package) string {
+			return pkg.Name()
+		})
+		if !x.rx.MatchString(byName) && !x.rx.MatchString(types.TypeString(t, nil)) {
+			return false
+		}
+	case missingField:
+		lit, ok := expr.(*ast.CompositeLit)
+		if !ok || !m.fieldMissing(lit, t, string(x)) {
 			return false
 		}
 	}
 	return true
 }
 
-func (m *matcher) walkWithLists(exprNode, node ast.Node, fn func(exprNode, node ast.Node)) {
-	visit := func(node ast.Node) bool {
-		fn(exprNode, node)
-		for _, list := range nodeLists(node) {
-			fn(exprNode, list)
-			if id := m.wildAnyIdent(exprNode); id != nil {
-				// so that "$*a" will match "a, b"
-				fn(exprList([]ast.Expr{id}), list)
-				// so that "$*a" will match "a; b"
-				fn(toStmtList(id), list)
+// fieldOf returns the struct field a node is or names, if any.
+func (m *matcher) fieldOf(node ast.Node) *ast.Field {
+	if exprStmt, ok := node.(*ast.ExprStmt); ok {
+		node = exprStmt.X
+	}
+	switch x := node.(type) {
+	case *ast.Field:
+		if m.structField(x) {
+			return x
+		}
+	case *ast.Ident:
+		field, _ := m.parentOf(x).(*ast.Field)
+		if field == nil || !m.structField(field) {
+			return nil
+		}
+		for _, name := range field.Names {
+			if name == x {
+				return field
 			}
 		}
-		return true
 	}
-	inspect(node, visit)
+	return nil
 }
 
-func (m *matcher) topNode(exprNode, node ast.Node) ast.Node {
-	sts1, ok1 := exprNode.(stmtList)
-	sts2, ok2 := node.(stmtList)
-	if ok1 && ok2 {
-		// allow a partial match at the top level
-		return m.nodes(sts1, sts2, true)
-	}
-	if m.node(exprNode, node) {
-		return node
-	}
-	return nil
+// structField reports whether a field belongs to a struct type, as opposed
+// to a function signature or an interface.
+func (m *matcher) structField(field *ast.Field) bool {
+	_, ok := m.parentOf(m.parentOf(field)).(*ast.StructType)
+	return ok
 }
 
-// optNode is like node, but for those nodes that can be nil and are not
-// part of a list. For example, init and post statements in a for loop.
-func (m *matcher) optNode(expr, node ast.Node) bool {
-	if ident := m.wildAnyIdent(expr); ident != nil {
-		if m.node(toStmtList(ident), toStmtList(node)) {
-			return true
+// keyedElts reports whether the elements of a composite literal pattern are
+// all keyed, besides any "$*_".
+func (m *matcher) keyedElts(elts []ast.Expr) bool {
+	keyed := false
+	for _, elt := range elts {
+		if _, ok := elt.(*ast.KeyValueExpr); ok {
+			keyed = true
+			continue
+		}
+		if info := m.info(fromWildNode(elt)); !info.any || info.name != "_" {
+			return false
 		}
 	}
-	return m.node(expr, node)
+	return keyed
 }
 
-func (m *matcher) node(expr, node ast.Node) bool {
-	switch node.(type) {
-	case *ast.File, *ast.FuncType, *ast.BlockStmt, *ast.IfStmt,
-		*ast.SwitchStmt, *ast.TypeSwitchStmt, *ast.CaseClause,
-		*ast.CommClause, *ast.ForStmt, *ast.RangeStmt:
-		if scope := m.Info.Scopes[node]; scope != nil {
-			m.scope = scope
+// unorderedElts matches the keyed elements of composite literals regardless
+// of their order. Extra elements are only allowed if the pattern has a
+// "$*_"; see keyedElts.
+func (m *matcher) unorderedElts(elts1, elts2 []ast.Expr) bool {
+	var keyed []ast.Expr
+	for _, elt := range elts1 {
+		if _, ok := elt.(*ast.KeyValueExpr); ok {
+			keyed = append(keyed, elt)
 		}
 	}
-	if !m.aggressive {
-		if expr == nil || node == nil {
-			return expr == node
-		}
-	} else {
-		if expr == nil && node == nil {
+	return m.unordered(exprList(keyed), exprList(elts2), len(keyed) < len(elts1))
+}
+
+// unordered matches each node in ns1 with a different node in ns2, in any
+// order. If extra is true, ns2 may have more nodes than ns1.
+func (m *matcher) unordered(ns1, ns2 nodeList, extra bool) bool {
+	ns1len, ns2len := ns1.len(), ns2.len()
+	if ns1len > ns2len || (!extra && ns1len < ns2len) {
+		return false
+	}
+	used := make([]bool, ns2len)
+	var match func(i int) bool
+	match = func(i int) bool {
+		if i == ns1len {
 			return true
 		}
-		if node == nil {
-			expr, node = node, expr
-		}
+		for j := 0; j < ns2len; j++ {
+			if used[j] {
+				continue
+			}
+			values := valsCopy(m.values)
+			if m.node(ns1.at(i), ns2.at(j)) {
+				used[j] = true
+				if match(i + 1) {
+					return true
+				}
+				used[j] = false
+			}
+			m.values = values
+		}
+		return false
+	}
+	return match(0)
+}
+
+// specValues returns the type and values of a value spec. A constant
+// without either repeats those of the constant before it, as in the "B" of
+// "const (A = iota; B)".
+func (m *matcher) specValues(spec *ast.ValueSpec) (ast.Expr, []ast.Expr) {
+	if spec.Type != nil || spec.Values != nil {
+		return spec.Type, spec.Values
+	}
+	gd, ok := m.parentOf(spec).(*ast.GenDecl)
+	if !ok || gd.Tok != token.CONST {
+		return nil, nil
+	}
+	var typ ast.Expr
+	var values []ast.Expr
+	for _, s := range gd.Specs {
+		if s == spec {
+			break
+		}
+		if vs := s.(*ast.ValueSpec); vs.Type != nil || vs.Values != nil {
+			typ, values = vs.Type, vs.Values
+		}
+	}
+	return typ, values
+}
+
+// param reports whether a field is a parameter or result of a function
+// signature. Receivers are not included.
+func (m *matcher) param(field *ast.Field) bool {
+	_, ok := m.parentOf(m.parentOf(field)).(*ast.FuncType)
+	return ok
+}
+
+// docOf returns the doc comment of a declaration, if any. Specs use their
+// declaration's if it has no parentheses, as that's where the parser puts
+// the comment.
+func (m *matcher) docOf(node ast.Node) *ast.CommentGroup {
+	switch x := node.(type) {
+	case *ast.File:
+		return x.Doc
+	case *ast.FuncDecl:
+		return x.Doc
+	case *ast.GenDecl:
+		return x.Doc
+	case *ast.ValueSpec, *ast.TypeSpec, *ast.ImportSpec:
+		var doc *ast.CommentGroup
+		switch x := x.(type) {
+		case *ast.ValueSpec:
+			doc = x.Doc
+		case *ast.TypeSpec:
+			doc = x.Doc
+		case *ast.ImportSpec:
+			doc = x.Doc
+		}
+		if gd, ok := m.parentOf(node).(*ast.GenDecl); doc == nil && ok && !gd.Lparen.IsValid() {
+			doc = gd.Doc
+		}
+		return doc
+	case *ast.Field:
+		return x.Doc
+	}
+	return nil
+}
+
+// directivesOf returns the directive comments attached to a declaration,
+// such as "//go:generate" or "//line". For a file, the directives are those
+// before the package clause, like "//go:build".
+func (m *matcher) directivesOf(node ast.Node) []*ast.Comment {
+	var groups []*ast.CommentGroup
+	if f, ok := node.(*ast.File); ok {
+		for _, cg := range f.Comments {
+			if cg.Pos() < f.Package {
+				groups = append(groups, cg)
+			}
+		}
+	} else if doc := m.docOf(node); doc != nil {
+		groups = append(groups, doc)
+	}
+	var list []*ast.Comment
+	for _, cg := range groups {
+		for _, c := range cg.List {
+			if isDirective(c.Text) {
+				list = append(list, c)
+			}
+		}
+	}
+	return list
+}
+
+// commentsOf returns the comments attached to a node or to any of its
+// children, following the same rules as ast.CommentMap. For example, that
+// includes the comments on the line before a statement or at the end of it.
+func (m *matcher) commentsOf(node ast.Node) []*ast.Comment {
+	var file *ast.File
+	for parent := node; parent != nil; parent = m.parentOf(parent) {
+		if f, ok := parent.(*ast.File); ok {
+			file = f
+			break
+		}
+	}
+	if file == nil || len(file.Comments) == 0 {
+		return nil
+	}
+	cmap, ok := m.commentMaps[file]
+	if !ok {
+		cmap = ast.NewCommentMap(m.loader.fset, file, file.Comments)
+		m.commentMaps[file] = cmap
+	}
+	var nodes []ast.Node
+	if list, ok := node.(nodeList); ok {
+		for i := 0; i < list.len(); i++ {
+			nodes = append(nodes, list.at(i))
+		}
+	} else {
+		// comments are attached to the largest node, so an
+		// expression must use its statement's, as in "f() // c"
+		for {
+			parent := m.parentOf(node)
+			if parent == nil || parent.Pos() != node.Pos() || parent.End() != node.End() {
+				break
+			}
+			node = parent
+		}
+		nodes = append(nodes, node)
+	}
+	var comments []*ast.Comment
+	for _, node := range nodes {
+		for _, cg := range cmap.Filter(node).Comments() {
+			comments = append(comments, cg.List...)
+		}
+	}
+	return comments
+}
+
+// commentText returns the text of a comment without its markers, such as
+// "//" or "/*" and "*/".
+func commentText(c *ast.Comment) string {
+	if strings.HasPrefix(c.Text, "/*") {
+		return c.Text[2 : len(c.Text)-2]
+	}
+	return c.Text[2:]
+}
+
+// isDirective reports whether a comment is a directive, following the same
+// rules as go/ast: "//line " and "//extern " or "//export " for cgo, or a
+// lowercase alphanumeric namespace and name separated by a colon, as in
+// "//go:noinline".
+func isDirective(text string) bool {
+	if !strings.HasPrefix(text, "//") {
+		return false // a /* */ comment
+	}
+	text = text[2:]
+	for _, prefix := range [...]string{"line ", "extern ", "export "} {
+		if strings.HasPrefix(text, prefix) {
+			return true
+		}
+	}
+	colon := strings.Index(text, ":")
+	if colon <= 0 || colon+1 >= len(text) {
+		return false
+	}
+	for i := 0; i <= colon+1; i++ {
+		if i == colon {
+			continue
+		}
+		if b := text[i]; !('a' <= b && b <= 'z' || '0' <= b && b <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// inLoop reports whether node is within the body of a for or range loop in
+// the same function. Function literals are a boundary, as their body is not
+// run once per iteration of an outer loop.
+func (m *matcher) inLoop(node ast.Node) bool {
+	child := node
+	for parent := m.parentOf(node); parent != nil; parent = m.parentOf(parent) {
+		switch x := parent.(type) {
+		case *ast.FuncLit, *ast.FuncDecl:
+			return false
+		case *ast.ForStmt:
+			if child == x.Body {
+				return true
+			}
+		case *ast.RangeStmt:
+			if child == x.Body {
+				return true
+			}
+		}
+		child = parent
+	}
+	return false
+}
+
+// topLevel reports whether node is outside of any function body, such as a
+// declaration at the package level or the expressions within one.
+func (m *matcher) topLevel(node ast.Node) bool {
+	child := node
+	for parent := m.parentOf(node); parent != nil; parent = m.parentOf(parent) {
+		switch x := parent.(type) {
+		case *ast.FuncLit:
+			if child == x.Body {
+				return false
+			}
+		case *ast.FuncDecl:
+			if child == x.Body {
+				return false
+			}
+		}
+		child = parent
+	}
+	return true
+}
+
+// inDefer reports whether node is within a deferred call, including the
+// body of a deferred func literal as in "defer func() { recover() }()".
+// Other function literals are a boundary, like in inLoop.
+func (m *matcher) inDefer(node ast.Node) bool {
+	for parent := m.parentOf(node); parent != nil; parent = m.parentOf(parent) {
+		switch x := parent.(type) {
+		case *ast.DeferStmt:
+			return true
+		case *ast.FuncLit:
+			call, ok := m.parentOf(x).(*ast.CallExpr)
+			if !ok || call.Fun != x {
+				return false
+			}
+			_, ok = m.parentOf(call).(*ast.DeferStmt)
+			return ok
+		case *ast.FuncDecl:
+			return false
+		}
+	}
+	return false
+}
+
+// methodUse returns how a method is used by node: "methodexpr" for a
+// method expression like T.Method, "methodcall" for a call like
+// v.Method(), and "methodvalue" for a method value like v.Method which
+// isn't called directly. A called selector is "methodcall" too, so that
+// both $x.$_() and $x.$_ can be used to find the calls. It returns "" for
+// any other node.
+func (m *matcher) methodUse(node ast.Node) string {
+	if exprStmt, ok := node.(*ast.ExprStmt); ok {
+		node = exprStmt.X
+	}
+	if call, ok := node.(*ast.CallExpr); ok {
+		sel, ok := unparen(call.Fun).(*ast.SelectorExpr)
+		if !ok || m.selectionKind(sel) != types.MethodVal {
+			return ""
+		}
+		return "methodcall"
+	}
+	sel, ok := node.(*ast.SelectorExpr)
+	if !ok {
+		return ""
+	}
+	switch m.selectionKind(sel) {
+	case types.MethodExpr:
+		return "methodexpr"
+	case types.MethodVal:
+		parent := m.parentOf(sel)
+		for {
+			paren, ok := parent.(*ast.ParenExpr)
+			if !ok {
+				break
+			}
+			parent = m.parentOf(paren)
+		}
+		if call, ok := parent.(*ast.CallExpr); ok && unparen(call.Fun) == sel {
+			return "methodcall"
+		}
+		return "methodvalue"
+	}
+	return ""
+}
+
+// selectionKind returns the kind of a selector, or -1 if it isn't a
+// selection, such as a qualified identifier like pkg.Name.
+func (m *matcher) selectionKind(sel *ast.SelectorExpr) types.SelectionKind {
+	if s := m.Info.Selections[sel]; s != nil {
+		return s.Kind()
+	}
+	return -1
+}
+
+// fileMatches reports whether a file path matches a glob; see fileGlob.
+func fileMatches(glob, name string) bool {
+	name = filepath.ToSlash(name)
+	if dir := strings.TrimSuffix(glob, "/..."); dir != glob {
+		elems := strings.Split(name, "/")
+		for i := 1; i < len(elems); i++ {
+			if ok, _ := path.Match(dir, strings.Join(elems[:i], "/")); ok {
+				return true
+			}
+		}
+		return false
+	}
+	if !strings.Contains(glob, "/") {
+		name = path.Base(name)
+	}
+	ok, _ := path.Match(glob, name)
+	return ok
+}
+
+// inTest reports whether node is in a _test.go file.
+func (m *matcher) inTest(node ast.Node) bool {
+	pos := m.loader.fset.Position(node.Pos())
+	return strings.HasSuffix(pos.Filename, "_test.go")
+}
+
+// capturesLoopVar reports whether node is a func literal which uses a
+// variable declared by an enclosing loop, such as the v in "for _, v :=
+// range xs". Go and defer statements, as well as calls, are looked through
+// to find the func literal.
+//
+// Before Go 1.22, such variables were shared by all iterations, so a
+// goroutine capturing one would likely see a later value.
+func (m *matcher) capturesLoopVar(node ast.Node) bool {
+	var lit *ast.FuncLit
+	for lit == nil {
+		switch x := node.(type) {
+		case *ast.FuncLit:
+			lit = x
+		case *ast.GoStmt:
+			node = x.Call
+		case *ast.DeferStmt:
+			node = x.Call
+		case *ast.ExprStmt:
+			node = x.X
+		case *ast.CallExpr:
+			node = x.Fun
+		default:
+			return false
+		}
+	}
+	vars := m.loopVars(lit)
+	if len(vars) == 0 {
+		return false
+	}
+	captures := false
+	ast.Inspect(lit.Body, func(node ast.Node) bool {
+		if id, ok := node.(*ast.Ident); ok && vars[m.Info.Uses[id]] {
+			captures = true
+		}
+		return !captures
+	})
+	return captures
+}
+
+// loopVars returns the variables declared by the loops whose body contains
+// node, up to the enclosing function declaration.
+func (m *matcher) loopVars(node ast.Node) map[types.Object]bool {
+	vars := make(map[types.Object]bool)
+	addVar := func(expr ast.Expr) {
+		if id, ok := expr.(*ast.Ident); ok && m.Info.Defs[id] != nil {
+			vars[m.Info.Defs[id]] = true
+		}
+	}
+	child := node
+	for parent := m.parentOf(node); parent != nil; parent = m.parentOf(parent) {
+		switch x := parent.(type) {
+		case *ast.FuncDecl:
+			return vars
+		case *ast.ForStmt:
+			if assign, ok := x.Init.(*ast.AssignStmt); ok && child == x.Body {
+				for _, lhs := range assign.Lhs {
+					addVar(lhs)
+				}
+			}
+		case *ast.RangeStmt:
+			if x.Tok == token.DEFINE && child == x.Body {
+				addVar(x.Key)
+				addVar(x.Value)
+			}
+		}
+		child = parent
+	}
+	return vars
+}
+
+// objectPkg returns the import path of the package declaring the object
+// that a name, selector or call refers to, if any. For a package name, that
+// is the imported package.
+func (m *matcher) objectPkg(node ast.Node) string {
+	switch x := node.(type) {
+	case *ast.ExprStmt:
+		node = x.X
+	case exprList:
+		if len(x) == 1 {
+			node = x[0]
+		}
+	}
+	if call, ok := node.(*ast.CallExpr); ok {
+		node = call.Fun
+	}
+	if expr, ok := node.(ast.Expr); ok {
+		node = unparen(expr)
+	}
+	if x, _, ok := indexParts(node); ok {
+		node = x // a generic instantiation like "F[int]"
+	}
+	if sel, ok := node.(*ast.SelectorExpr); ok {
+		node = sel.Sel
+	}
+	id, ok := node.(*ast.Ident)
+	if !ok {
+		return ""
+	}
+	switch obj := m.Info.ObjectOf(id).(type) {
+	case nil:
+		return ""
+	case *types.PkgName:
+		return obj.Imported().Path()
+	default:
+		if obj.Pkg() == nil {
+			return "" // a builtin
+		}
+		return obj.Pkg().Path()
+	}
+}
+
+// sameConst reports whether two constant values are equal. Numbers are
+// compared regardless of their kind, so 2 is the same as 2.0.
+func sameConst(x, y constant.Value) bool {
+	if x == nil || y == nil {
+		return false
+	}
+	isNum := func(val constant.Value) bool {
+		switch val.Kind() {
+		case constant.Int, constant.Float, constant.Complex:
+			return true
+		}
+		return false
+	}
+	if x.Kind() != y.Kind() && !(isNum(x) && isNum(y)) {
+		return false
+	}
+	return constant.Compare(x, token.EQL, y)
+}
+
+// qualifiedIdent returns the imported package and the name of a qualified
+// identifier, which is either a selector like "pkg.Name" or a name imported
+// with a dot. Otherwise, the returned package is nil.
+func (m *matcher) qualifiedIdent(node ast.Node) (*types.Package, *ast.Ident) {
+	switch x := node.(type) {
+	case *ast.SelectorExpr:
+		id, ok := x.X.(*ast.Ident)
+		if !ok {
+			return nil, nil
+		}
+		if pkg, ok := m.Info.Uses[id].(*types.PkgName); ok {
+			return pkg.Imported(), x.Sel
+		}
+	case *ast.Ident:
+		obj := m.Info.Uses[x]
+		if obj == nil || obj.Pkg() == nil {
+			return nil, nil
+		}
+		// dot imports add the names to the file scope
+		for parent := m.parentOf(x); parent != nil; parent = m.parentOf(parent) {
+			if f, ok := parent.(*ast.File); ok {
+				if m.Info.Scopes[f].Lookup(x.Name) == obj {
+					return obj.Pkg(), x
+				}
+				break
+			}
+		}
+	}
+	return nil, nil
+}
+
+// promotes reports whether embedded selects an embedded field, and whether
+// the field or method selected by sel, whose X is embedded or goes through
+// it, is promoted to the type embedding that field. That is, whether
+// "x.E.M" could be written as "x.M".
+func (m *matcher) promotes(embedded, sel *ast.SelectorExpr) bool {
+	s := m.Info.Selections[embedded]
+	if s == nil || s.Kind() != types.FieldVal || !s.Obj().(*types.Var).Embedded() {
+		return false
+	}
+	want := m.Info.Selections[sel]
+	t := m.Info.TypeOf(embedded.X)
+	if want == nil || t == nil {
+		return false
+	}
+	obj, _, _ := types.LookupFieldOrMethod(t, true, want.Obj().Pkg(), sel.Sel.Name)
+	return obj == want.Obj()
+}
+
+// objKindOf returns the kind of object that a name, or the selected name
+// in a selector like "math.Pi", defines or refers to. It returns "" if node
+// isn't a name or if it has no object, as is the case with the blank
+// identifier.
+func (m *matcher) objKindOf(node ast.Node) string {
+	if sel, ok := node.(*ast.SelectorExpr); ok {
+		node = sel.Sel
+	}
+	id := nodeIdent(node)
+	if id == nil {
+		return ""
+	}
+	switch m.Info.ObjectOf(id).(type) {
+	case *types.Var:
+		return "var"
+	case *types.Const:
+		return "const"
+	case *types.Func:
+		return "func"
+	case *types.TypeName:
+		return "type"
+	case *types.PkgName:
+		return "pkgname"
+	case *types.Label:
+		return "label"
+	}
+	return ""
+}
+
+// nodeIdent returns the identifier that node consists of, if any, such as
+// the x in "x := 1". A defined name that isn't used, like the blank
+// identifier, is in neither Info.Defs nor Info.Uses.
+func nodeIdent(node ast.Node) *ast.Ident {
+	switch x := node.(type) {
+	case *ast.ExprStmt:
+		node = x.X
+	case exprList:
+		if len(x) == 1 {
+			node = x[0]
+		}
+	case identList:
+		if len(x) == 1 {
+			node = x[0]
+		}
+	}
+	id, _ := node.(*ast.Ident)
+	return id
+}
+
+// exported reports whether node is an exported name, or a selector of one
+// as in "pkg.Name".
+func exported(node ast.Node) bool {
+	if exprStmt, ok := node.(*ast.ExprStmt); ok {
+		node = exprStmt.X
+	}
+	if sel, ok := node.(*ast.SelectorExpr); ok {
+		node = sel.Sel
+	}
+	id, ok := node.(*ast.Ident)
+	return ok && id.IsExported()
+}
+
+// hasDefault reports whether node is a select or switch statement with a
+// default clause. For a select, this means that it never blocks.
+func hasDefault(node ast.Node) bool {
+	var body *ast.BlockStmt
+	switch x := node.(type) {
+	case *ast.SelectStmt:
+		body = x.Body
+	case *ast.SwitchStmt:
+		body = x.Body
+	case *ast.TypeSwitchStmt:
+		body = x.Body
+	default:
+		return false
+	}
+	for _, stmt := range body.List {
+		switch x := stmt.(type) {
+		case *ast.CommClause:
+			if x.Comm == nil {
+				return true
+			}
+		case *ast.CaseClause:
+			if x.List == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// boxing reports whether node is an assignment or variable declaration which
+// implicitly converts a concrete value to an interface type, such as "var r
+// io.Reader = buf". Such conversions may allocate. Values which already are
+// interfaces, as well as nil, are not boxed.
+func (m *matcher) boxing(node ast.Node) bool {
+	var lhs, rhs []ast.Expr
+	switch x := node.(type) {
+	case *ast.DeclStmt:
+		return m.boxing(x.Decl)
+	case *ast.GenDecl:
+		for _, spec := range x.Specs {
+			if m.boxing(spec) {
+				return true
+			}
+		}
+		return false
+	case *ast.ValueSpec:
+		if x.Type == nil {
+			return false // the types are those of the values
+		}
+		for _, name := range x.Names {
+			lhs = append(lhs, name)
+		}
+		rhs = x.Values
+	case *ast.AssignStmt:
+		if x.Tok != token.ASSIGN && x.Tok != token.DEFINE {
+			return false
+		}
+		lhs, rhs = x.Lhs, x.Rhs
+	default:
+		return false
+	}
+	var rtypes []types.Type
+	if len(rhs) == 1 && len(lhs) > 1 {
+		// a, b = f(), or one of the comma-ok forms
+		switch t := m.Info.TypeOf(rhs[0]).(type) {
+		case *types.Tuple:
+			for i := 0; i < t.Len(); i++ {
+				rtypes = append(rtypes, t.At(i).Type())
+			}
+		case nil:
+		default:
+			rtypes = append(rtypes, t)
+		}
+	} else {
+		for _, expr := range rhs {
+			rtypes = append(rtypes, m.Info.TypeOf(expr))
+		}
+	}
+	for i, expr := range lhs {
+		if i >= len(rtypes) {
+			break
+		}
+		lt, rt := m.Info.TypeOf(expr), rtypes[i]
+		if lt == nil || rt == nil || !types.IsInterface(lt) || types.IsInterface(rt) {
+			continue
+		}
+		if b, ok := rt.(*types.Basic); ok && b.Kind() == types.UntypedNil {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// zeroInit reports whether node is a variable declaration, or a short one,
+// whose explicit values are all the zero values of their types, such as
+// "var n int = 0" or "s := """. Empty composite literals are only zero values
+// for structs and arrays, as empty maps and slices aren't nil.
+func (m *matcher) zeroInit(node ast.Node) bool {
+	var lhs, rhs []ast.Expr
+	switch x := node.(type) {
+	case *ast.DeclStmt:
+		return m.zeroInit(x.Decl)
+	case *ast.GenDecl:
+		if x.Tok != token.VAR || len(x.Specs) != 1 {
+			return false
+		}
+		return m.zeroInit(x.Specs[0])
+	case *ast.ValueSpec:
+		for _, name := range x.Names {
+			lhs = append(lhs, name)
+		}
+		rhs = x.Values
+	case *ast.AssignStmt:
+		if x.Tok != token.DEFINE {
+			return false
+		}
+		lhs, rhs = x.Lhs, x.Rhs
+	default:
+		return false
+	}
+	if len(rhs) == 0 || len(lhs) != len(rhs) {
+		return false
+	}
+	for i, expr := range rhs {
+		t := m.Info.TypeOf(lhs[i])
+		if t == nil || !m.zeroValue(unparen(expr), t) {
+			return false
+		}
+	}
+	return true
+}
+
+// zeroValue reports whether expr is the zero value of type t.
+func (m *matcher) zeroValue(expr ast.Expr, t types.Type) bool {
+	switch u := t.Underlying().(type) {
+	case *types.Basic:
+		val := m.Info.Types[expr].Value
+		if val == nil {
+			return false
+		}
+		switch {
+		case u.Info()&types.IsBoolean != 0:
+			return val.Kind() == constant.Bool && !constant.BoolVal(val)
+		case u.Info()&types.IsString != 0:
+			return val.Kind() == constant.String && constant.StringVal(val) == ""
+		case u.Info()&types.IsNumeric != 0:
+			return constant.Sign(val) == 0
+		}
+	case *types.Pointer, *types.Interface, *types.Slice, *types.Map,
+		*types.Chan, *types.Signature:
+		b, ok := m.Info.TypeOf(expr).(*types.Basic)
+		return ok && b.Kind() == types.UntypedNil
+	case *types.Struct, *types.Array:
+		lit, ok := expr.(*ast.CompositeLit)
+		return ok && len(lit.Elts) == 0
+	}
+	return false
+}
+
+// commutes reports whether the operands of a binary expression can be
+// swapped without changing its result. Strings are concatenated with "+",
+// so it's only considered commutative if the type isn't known to be a
+// string.
+func (m *matcher) commutes(expr *ast.BinaryExpr) bool {
+	switch expr.Op {
+	case token.EQL, token.NEQ, token.MUL, token.AND, token.OR, token.XOR:
+		return true
+	case token.ADD:
+		t := m.Info.TypeOf(expr)
+		return t == nil || !basicKind(t.Underlying(), "string")
+	}
+	return false
+}
+
+// basicKind reports whether a type is a basic type of a kind, such as
+// "string" or "unsigned"; see typUnderlying.
+func basicKind(t types.Type, kind string) bool {
+	b, ok := t.(*types.Basic)
+	if !ok {
+		return false
+	}
+	info := b.Info()
+	switch kind {
+	case "bool":
+		return info&types.IsBoolean != 0
+	case "string":
+		return info&types.IsString != 0
+	case "int":
+		return info&types.IsInteger != 0
+	case "uint", "unsigned":
+		return info&types.IsUnsigned != 0
+	case "signed":
+		return info&types.IsInteger != 0 && info&types.IsUnsigned == 0
+	case "float":
+		return info&types.IsFloat != 0
+	case "complex":
+		return info&types.IsComplex != 0
+	}
+	return false
+}
+
+// underlyingIs reports whether the underlying type of t is of a kind, like
+// "slice". A type parameter is of a kind if all the types in its type set
+// are, such as "T ~int | ~int8" and "int".
+func underlyingIs(t types.Type, kind string) bool {
+	if tparam, ok := t.(*types.TypeParam); ok {
+		iface, ok := tparam.Constraint().Underlying().(*types.Interface)
+		return ok && typeSetIs(iface, kind)
+	}
+	u := t.Underlying()
+	switch kind {
+	case "basic":
+		_, ok := u.(*types.Basic)
+		return ok
+	case "array":
+		_, ok := u.(*types.Array)
+		return ok
+	case "slice":
+		_, ok := u.(*types.Slice)
+		return ok
+	case "struct":
+		_, ok := u.(*types.Struct)
+		return ok
+	case "interface":
+		_, ok := u.(*types.Interface)
+		return ok
+	case "pointer":
+		_, ok := u.(*types.Pointer)
+		return ok
+	case "func":
+		_, ok := u.(*types.Signature)
+		return ok
+	case "map":
+		_, ok := u.(*types.Map)
+		return ok
+	case "chan":
+		_, ok := u.(*types.Chan)
+		return ok
+	}
+	return basicKind(u, kind)
+}
+
+// typeSetIs reports whether all the types in the type set of a constraint
+// interface are of a kind. Since the type set is the intersection of the
+// embedded elements, it's enough for any one element to only have types of
+// that kind. Interfaces with methods only, like "any", have no such
+// elements.
+func typeSetIs(iface *types.Interface, kind string) bool {
+	for i := 0; i < iface.NumEmbeddeds(); i++ {
+		switch e := iface.EmbeddedType(i).(type) {
+		case *types.Union:
+			all := true
+			for j := 0; j < e.Len(); j++ {
+				if !underlyingIs(e.Term(j).Type(), kind) {
+					all = false
+					break
+				}
+			}
+			if all {
+				return true
+			}
+		default:
+			if inner, ok := e.Underlying().(*types.Interface); ok {
+				if typeSetIs(inner, kind) {
+					return true
+				}
+			} else if underlyingIs(e, kind) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// implements reports whether a type implements an interface type. Unlike
+// types.Implements, it's false if iface isn't an interface.
+func implements(t, iface types.Type) bool {
+	if iface == nil {
+		return false
+	}
+	it, ok := iface.Underlying().(*types.Interface)
+	return ok && types.Implements(t, it)
+}
+
+// nilable reports whether values of a type can be compared to nil. Type
+// parameters can't, even if all of their types could.
+func nilable(t types.Type) bool {
+	if _, ok := t.(*types.TypeParam); ok {
+		return false
+	}
+	switch u := t.Underlying().(type) {
+	case *types.Basic:
+		return u.Kind() == types.UnsafePointer || u.Kind() == types.UntypedNil
+	case *types.Pointer, *types.Interface, *types.Slice, *types.Map,
+		*types.Chan, *types.Signature:
+		return true
+	}
+	return false
+}
+
+// narrowable reports whether node is the name of a parameter of an
+// interface type where a narrower type would do. That is, where only some
+// of the interface's methods are called on it, or where an empty interface
+// is only used in type assertions and switches.
+//
+// Any other use, such as passing the parameter to another function, is
+// assumed to need the whole interface.
+func (m *matcher) narrowable(node ast.Node) bool {
+	id, ok := node.(*ast.Ident)
+	if !ok {
+		return false
+	}
+	param, ok := m.Info.Defs[id].(*types.Var)
+	if !ok {
+		return false
+	}
+	iface, ok := param.Type().Underlying().(*types.Interface)
+	if !ok {
+		return false
+	}
+	var body *ast.BlockStmt
+	field, _ := m.parentOf(id).(*ast.Field)
+	list, _ := m.parentOf(field).(*ast.FieldList)
+	if ftyp, _ := m.parentOf(list).(*ast.FuncType); ftyp != nil && ftyp.Params == list {
+		switch x := m.parentOf(ftyp).(type) {
+		case *ast.FuncDecl:
+			body = x.Body
+		case *ast.FuncLit:
+			body = x.Body
+		}
+	}
+	if body == nil {
+		return false // not a parameter, or a func without a body
+	}
+	uses := 0
+	methods := make(map[string]bool)
+	wider := false
+	ast.Inspect(body, func(node ast.Node) bool {
+		use, ok := node.(*ast.Ident)
+		if !ok || m.Info.Uses[use] != param {
+			return !wider
+		}
+		uses++
+		switch x := m.parentOf(use).(type) {
+		case *ast.TypeAssertExpr:
+			if iface.NumMethods() == 0 {
+				return true
+			}
+		case *ast.SelectorExpr:
+			if _, ok := m.Info.Uses[x.Sel].(*types.Func); ok {
+				methods[x.Sel.Name] = true
+				return true
+			}
+		}
+		wider = true
+		return false
+	})
+	if uses == 0 || wider {
+		return false
+	}
+	return iface.NumMethods() == 0 || len(methods) < iface.NumMethods()
+}
+
+// rangesOver reports whether a range loop iterates over a kind of value,
+// such as "map" or "int". Ranging over a pointer to an array counts as
+// ranging over an array.
+func (m *matcher) rangesOver(rng *ast.RangeStmt, kind string) bool {
+	t := m.Info.TypeOf(rng.X)
+	if t == nil {
+		return false
+	}
+	u := t.Underlying()
+	if ptr, ok := u.(*types.Pointer); ok {
+		u = ptr.Elem().Underlying()
+	}
+	ok := false
+	switch kind {
+	case "slice":
+		_, ok = u.(*types.Slice)
+	case "array":
+		_, ok = u.(*types.Array)
+	case "map":
+		_, ok = u.(*types.Map)
+	case "chan":
+		_, ok = u.(*types.Chan)
+	case "func":
+		_, ok = u.(*types.Signature)
+	case "string":
+		basic, isBasic := u.(*types.Basic)
+		ok = isBasic && basic.Info()&types.IsString != 0
+	case "int":
+		basic, isBasic := u.(*types.Basic)
+		ok = isBasic && basic.Info()&types.IsInteger != 0
+	}
+	return ok
+}
+
+// resultUnused reports whether node is a call used as a statement, whose
+// results are thus discarded. Calls to builtins like copy are left out.
+func (m *matcher) resultUnused(node ast.Node) bool {
+	if stmt, ok := node.(*ast.ExprStmt); ok {
+		node = stmt.X
+	} else {
+		parent := m.parentOf(node)
+		for {
+			// as in "(f())"
+			paren, ok := parent.(*ast.ParenExpr)
+			if !ok {
+				break
+			}
+			parent = m.parentOf(paren)
+		}
+		if _, ok := parent.(*ast.ExprStmt); !ok {
+			return false
+		}
+	}
+	expr, ok := node.(ast.Expr)
+	if !ok {
+		return false
+	}
+	call, ok := unparen(expr).(*ast.CallExpr)
+	if !ok {
+		return false
+	}
+	tv := m.Info.Types[call.Fun]
+	if tv.IsBuiltin() {
+		return false
+	}
+	sign, ok := tv.Type.(*types.Signature)
+	return ok && sign.Results().Len() > 0
+}
+
+// fmtConcat reports whether node is a call to fmt.Sprintf that merely
+// concatenates strings, such as fmt.Sprintf("%s%s", a, b), which is
+// equivalent to a + b. Only the %s verb without flags nor width is allowed,
+// and all the arguments must be of type string.
+func (m *matcher) fmtConcat(node ast.Node) bool {
+	if stmt, ok := node.(*ast.ExprStmt); ok {
+		node = stmt.X
+	}
+	call, ok := node.(*ast.CallExpr)
+	if !ok || len(call.Args) < 2 || call.Ellipsis.IsValid() {
+		return false
+	}
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok {
+		return false
+	}
+	fn, ok := m.Info.ObjectOf(sel.Sel).(*types.Func)
+	if !ok || fn.FullName() != "fmt.Sprintf" {
+		return false
+	}
+	lit, ok := call.Args[0].(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return false
+	}
+	format, err := strconv.Unquote(lit.Value)
+	if err != nil || format != strings.Repeat("%s", len(call.Args)-1) {
+		return false
+	}
+	for _, arg := range call.Args[1:] {
+		basic, ok := m.Info.TypeOf(arg).(*types.Basic)
+		if !ok || (basic.Kind() != types.String && basic.Kind() != types.UntypedString) {
+			return false
+		}
+	}
+	return true
+}
+
+// noopConv reports whether node is a conversion to the type its operand
+// already has, such as int(x) where x is an int. Converting an untyped
+// constant like in int(3) is not a no-op, as it gives the constant a type.
+func (m *matcher) noopConv(node ast.Node) bool {
+	if stmt, ok := node.(*ast.ExprStmt); ok {
+		node = stmt.X
+	}
+	call, ok := node.(*ast.CallExpr)
+	if !ok || len(call.Args) != 1 || !m.Info.Types[call.Fun].IsType() {
+		return false
+	}
+	arg := call.Args[0]
+	if m.untypedConst(arg) {
+		return false
+	}
+	from, to := m.Info.TypeOf(arg), m.Info.TypeOf(call)
+	return from != nil && to != nil && types.Identical(from, to)
+}
+
+// normalize strips the parentheses and no-op conversions around a node,
+// following the -norm flags. Patterns have no type information, so only
+// the conversions in the source are stripped.
+func (m *matcher) normalize(node ast.Node) ast.Node {
+	for {
+		switch x := node.(type) {
+		case *ast.ParenExpr:
+			if !m.norms["paren"] {
+				return node
+			}
+			node = x.X
+		case *ast.CallExpr:
+			if !m.norms["conv"] || !m.noopConv(x) {
+				return node
+			}
+			node = x.Args[0]
+		default:
+			return node
+		}
+	}
+}
+
+// pure reports whether evaluating an expression has no side effects, so
+// that it may be duplicated or reordered. That is, it has no calls other
+// than conversions and a few builtins, and no channel receives. The bodies
+// of func literals are not evaluated, so they don't count.
+func (m *matcher) pure(node ast.Node) bool {
+	var exprs []ast.Expr
+	switch x := node.(type) {
+	case *ast.ExprStmt:
+		exprs = append(exprs, x.X)
+	case ast.Expr:
+		exprs = append(exprs, x)
+	case exprList:
+		exprs = x
+	default:
+		return false
+	}
+	pure := true
+	for _, expr := range exprs {
+		ast.Inspect(expr, func(node ast.Node) bool {
+			switch x := node.(type) {
+			case *ast.FuncLit:
+				return false
+			case *ast.UnaryExpr:
+				if x.Op == token.ARROW {
+					pure = false
+				}
+			case *ast.CallExpr:
+				if !m.pureCall(x) {
+					pure = false
+				}
+			}
+			return pure
+		})
+	}
+	return pure
+}
+
+// pureCall reports whether a call is a conversion, or a call to a builtin
+// func without side effects like len.
+func (m *matcher) pureCall(call *ast.CallExpr) bool {
+	if m.Info.Types[call.Fun].IsType() {
+		return true
+	}
+	id, ok := unparen(call.Fun).(*ast.Ident)
+	if !ok {
+		return false
+	}
+	b, ok := m.Info.Uses[id].(*types.Builtin)
+	if !ok {
+		return false
+	}
+	switch b.Name() {
+	case "len", "cap", "real", "imag", "complex", "min", "max":
+		return true
+	}
+	return false
+}
+
+// untypedConst reports whether expr is an untyped constant expression. The
+// recorded types can't tell us, as untyped constants are given the type
+// they end up being converted to.
+func (m *matcher) untypedConst(expr ast.Expr) bool {
+	if m.Info.Types[expr].Value == nil {
+		return false
+	}
+	switch x := unparen(expr).(type) {
+	case *ast.BasicLit:
+		return true
+	case *ast.Ident:
+		return m.untypedConstObj(x)
+	case *ast.SelectorExpr:
+		return m.untypedConstObj(x.Sel)
+	case *ast.UnaryExpr:
+		return m.untypedConst(x.X)
+	case *ast.BinaryExpr:
+		return m.untypedConst(x.X) && m.untypedConst(x.Y)
+	}
+	return false
+}
+
+func (m *matcher) untypedConstObj(id *ast.Ident) bool {
+	obj, ok := m.Info.ObjectOf(id).(*types.Const)
+	if !ok {
+		return false
+	}
+	basic, ok := obj.Type().(*types.Basic)
+	return ok && basic.Info()&types.IsUntyped != 0
+}
+
+// comparedType returns the type whose values are compared when comparing
+// expr, which is of type t. Explicit conversions to interface types are
+// looked through, as comparing the resulting interfaces panics at run time
+// if the converted values are not comparable.
+//
+// This is only a heuristic; the dynamic type held by an interface value
+// that isn't a conversion, such as a parameter, cannot be known.
+func (m *matcher) comparedType(expr ast.Expr, t types.Type) types.Type {
+	for types.IsInterface(t) {
+		call, ok := unparen(expr).(*ast.CallExpr)
+		if !ok || len(call.Args) != 1 || !m.Info.Types[call.Fun].IsType() {
+			break
+		}
+		argType := m.Info.TypeOf(call.Args[0])
+		if argType == nil {
+			break
+		}
+		expr, t = call.Args[0], argType
+	}
+	return t
+}
+
+// nodeLen returns the number of elements in a node, such as the arguments
+// in a call or the statements in a block.
+func nodeLen(node ast.Node) (int, bool) {
+	switch x := node.(type) {
+	case *ast.ExprStmt:
+		return nodeLen(x.X)
+	case nodeList:
+		return x.len(), true
+	case *ast.CallExpr:
+		return len(x.Args), true
+	case *ast.CompositeLit:
+		return len(x.Elts), true
+	case *ast.BlockStmt:
+		return len(x.List), true
+	}
+	return 0, false
+}
+
+// stmtCount returns the number of statements in a node, including nested
+// ones like those within an if statement or a func literal. Blocks and
+// clauses only count their statements.
+func stmtCount(node ast.Node) (int, bool) {
+	switch node.(type) {
+	case ast.Stmt, stmtList, *ast.FuncDecl, *ast.FuncLit:
+	default:
+		return 0, false
+	}
+	n := 0
+	inspect(node, func(node ast.Node) bool {
+		switch node.(type) {
+		case *ast.BlockStmt, *ast.CaseClause, *ast.CommClause:
+		case ast.Stmt:
+			n++
+		}
+		return true
+	})
+	return n, true
+}
+
+// lineCount returns the number of lines a node spans.
+func (m *matcher) lineCount(node ast.Node) (int, bool) {
+	if list, ok := node.(nodeList); ok && list.len() == 0 {
+		return 0, true
+	}
+	if !node.Pos().IsValid() || !node.End().IsValid() {
+		return 0, false
+	}
+	start := m.loader.fset.Position(node.Pos())
+	end := m.loader.fset.Position(node.End())
+	return end.Line - start.Line + 1, true
+}
+
+func (lc lenCheck) holds(n int) bool {
+	switch lc.op {
+	case token.NEQ:
+		return n != lc.n
+	case token.LSS:
+		return n < lc.n
+	case token.LEQ:
+		return n <= lc.n
+	case token.GTR:
+		return n > lc.n
+	case token.GEQ:
+		return n >= lc.n
+	}
+	return n == lc.n
+}
+
+// fieldMissing reports whether a struct composite literal of type t leaves
+// the named field unset. Positional literals set all fields. A field
+// promoted from an embedded struct is only set if the embedded field is,
+// and if its value is a literal, the field must be set in that literal too.
+func (m *matcher) fieldMissing(lit *ast.CompositeLit, t types.Type, name string) bool {
+	if ptr, ok := t.Underlying().(*types.Pointer); ok {
+		t = ptr.Elem()
+	}
+	st, ok := t.Underlying().(*types.Struct)
+	if !ok || st.NumFields() == 0 {
+		return false
+	}
+	obj, index, _ := types.LookupFieldOrMethod(t, false, st.Field(0).Pkg(), name)
+	if _, ok := obj.(*types.Var); !ok {
+		return false // no such field
+	}
+	return litFieldMissing(lit, st, index)
+}
+
+func litFieldMissing(lit *ast.CompositeLit, st *types.Struct, index []int) bool {
+	if len(lit.Elts) > 0 {
+		if _, ok := lit.Elts[0].(*ast.KeyValueExpr); !ok {
+			return false // positional, so all fields are set
+		}
+	}
+	fld := st.Field(index[0])
+	for _, elt := range lit.Elts {
+		kv := elt.(*ast.KeyValueExpr)
+		if key, ok := kv.Key.(*ast.Ident); !ok || key.Name != fld.Name() {
+			continue
+		}
+		if len(index) == 1 {
+			return false
+		}
+		value := kv.Value
+		if un, ok := value.(*ast.UnaryExpr); ok && un.Op == token.AND {
+			value = un.X
+		}
+		inner, ok := value.(*ast.CompositeLit)
+		if !ok {
+			return false // set by some other expression
+		}
+		ftyp := fld.Type()
+		if ptr, ok := ftyp.Underlying().(*types.Pointer); ok {
+			ftyp = ptr.Elem()
+		}
+		ist, ok := ftyp.Underlying().(*types.Struct)
+		return !ok || litFieldMissing(inner, ist, index[1:])
+	}
+	return true
+}
+
+func (m *matcher) walkWithLists(exprNode, node ast.Node, fn func(exprNode, node ast.Node)) {
+	visit := func(node ast.Node) bool {
+		fn(exprNode, node)
+		for _, list := range nodeLists(node) {
+			fn(exprNode, list)
+			if id := m.wildAnyIdent(exprNode); id != nil {
+				// so that "$*a" will match "a, b"
+				fn(exprList([]ast.Expr{id}), list)
+				// so that "$*a" will match "a; b"
+				fn(toStmtList(id), list)
+			}
+		}
+		return true
+	}
+	inspect(node, visit)
+}
+
+// walkChildren is like walkWithLists, but it only visits the direct children
+// of node and the lists of them, such as the arguments of a call.
+func (m *matcher) walkChildren(exprNode, node ast.Node, fn func(exprNode, node ast.Node)) {
+	if list, ok := node.(nodeList); ok {
+		for i := 0; i < list.len(); i++ {
+			fn(exprNode, list.at(i))
+		}
+		return
+	}
+	for _, list := range nodeLists(node) {
+		fn(exprNode, list)
+		if id := m.wildAnyIdent(exprNode); id != nil {
+			fn(exprList([]ast.Expr{id}), list)
+			fn(toStmtList(id), list)
+		}
+	}
+	ast.Inspect(node, func(child ast.Node) bool {
+		if child == node {
+			return true
+		}
+		if child != nil {
+			fn(exprNode, child)
+		}
+		return false
+	})
+}
+
+func (m *matcher) topNode(exprNode, node ast.Node, anc anchors) ast.Node {
+	if alts, ok := exprNode.(altList); ok {
+		values := m.values
+		for i, alt := range alts {
+			m.values = valsCopy(values)
+			if found := m.topNode(alt, node, anc); found != nil {
+				m.alt = i + 1
+				return found
+			}
+		}
+		m.values = values
+		return nil
+	}
+	sts1, ok1 := exprNode.(stmtList)
+	sts2, ok2 := node.(stmtList)
+	if anc.start || anc.end {
+		if !ok1 {
+			// a single statement is anchored like a list
+			sts1, ok1 = toStmtList(exprNode), true
+		}
+		if !ok2 {
+			return nil
+		}
+	}
+	if ok1 && ok2 {
+		// allow a partial match at the top level, unless anchored
+		return m.nodes(sts1, sts2, !anc.start, !anc.end)
+	}
+	if x, ok := node.(ast.Expr); ok && len(m.norms) > 0 && m.normalize(x) != x {
+		// the inner node is matched instead, as in "x" for "(x)"
+		return nil
+	}
+	if m.node(exprNode, node) {
+		return node
+	}
+	return nil
+}
+
+// opWildBinary returns the operator wildcard of a binary expression in a
+// pattern, as well as its left operand. See markOpWildcards.
+func opWildBinary(x *ast.BinaryExpr) (op *ast.Ident, left ast.Expr) {
+	inner, ok := x.X.(*ast.BinaryExpr)
+	if !ok || x.Op != token.LOR || inner.Op != token.LOR {
+		return nil, nil
+	}
+	if id, ok := inner.Y.(*ast.Ident); ok && strings.HasPrefix(id.Name, opWildPrefix) {
+		return id, inner.X
+	}
+	return nil, nil
+}
+
+// opWildUnary returns the operator wildcard of a unary expression in a
+// pattern. See markOpWildcards.
+func opWildUnary(x *ast.CompositeLit) *ast.Ident {
+	if id, ok := x.Type.(*ast.Ident); ok && len(x.Elts) == 1 &&
+		strings.HasPrefix(id.Name, opWildPrefix) {
+		return id
+	}
+	return nil
+}
+
+// wildOp matches an operator wildcard. Since values must be nodes, the
+// operator is recorded as an identifier with its name, like "==".
+func (m *matcher) wildOp(wild *ast.Ident, op token.Token, pos token.Pos) bool {
+	info := m.info(fromWildName(wild.Name))
+	if info.name == "_" {
+		return true
+	}
+	prev, ok := m.values[info.name]
+	if !ok {
+		m.values[info.name] = &ast.Ident{NamePos: pos, Name: op.String()}
+		return true
+	}
+	id, ok := prev.(*ast.Ident)
+	return ok && id.Name == op.String()
+}
+
+// opTokens maps the operators' names to their tokens, to undo wildOp.
+var opTokens = func() map[string]token.Token {
+	ops := make(map[string]token.Token)
+	for tok := token.ADD; tok <= token.COLON; tok++ {
+		ops[tok.String()] = tok
+	}
+	return ops
+}()
+
+// optNode is like node, but for those nodes that can be nil and are not
+// part of a list. For example, init and post statements in a for loop.
+func (m *matcher) optNode(expr, node ast.Node) bool {
+	if ident := m.wildAnyIdent(expr); ident != nil {
+		if m.node(toStmtList(ident), toStmtList(node)) {
+			return true
+		}
+	}
+	return m.node(expr, node)
+}
+
+func (m *matcher) node(expr, node ast.Node) bool {
+	if m.trace != nil && (expr != nil || node != nil) {
+		return m.tracedNode(expr, node)
+	}
+	return m.nodeOnce(expr, node)
+}
+
+func (m *matcher) nodeOnce(expr, node ast.Node) bool {
+	switch node.(type) {
+	case *ast.File, *ast.FuncType, *ast.BlockStmt, *ast.IfStmt,
+		*ast.SwitchStmt, *ast.TypeSwitchStmt, *ast.CaseClause,
+		*ast.CommClause, *ast.ForStmt, *ast.RangeStmt:
+		if scope := m.Info.Scopes[node]; scope != nil {
+			m.scope = scope
+		}
+	}
+	if !m.norms["blank"] {
+		if expr == nil || node == nil {
+			return expr == node
+		}
+	} else {
+		if expr == nil && node == nil {
+			return true
+		}
+		if node == nil {
+			expr, node = node, expr
+		}
+	}
+	if len(m.norms) > 0 {
+		expr, node = m.normalize(expr), m.normalize(node)
+	}
+	if m.boolNormalize && fromWildNode(expr) < 0 {
+		// try the normalized forms first, so that wildcards bind
+		// to the original nodes if only the plain match succeeds
+		if nx, ny := normBool(expr), normBool(node); nx != expr || ny != node {
+			values := valsCopy(m.values)
+			if m.node(nx, ny) {
+				return true
+			}
+			m.values = values
+		}
 	}
 	switch x := expr.(type) {
-	case nil: // only in aggressive mode
+	case nil: // only with the blank normalization
 		y, ok := node.(*ast.Ident)
 		return ok && y.Name == "_"
 
@@ -326,6 +2389,14 @@ func (m *matcher) node(expr, node ast.Node) bool {
 		y, yok := node.(*ast.Ident)
 		if !isWildName(x.Name) {
 			// not a wildcard
+			if m.typedEqual && yok {
+				// only identifiers in the source have
+				// objects, such as when comparing the
+				// nodes of a repeated wildcard
+				if obj := m.Info.ObjectOf(x); obj != nil {
+					return m.Info.ObjectOf(y) == obj
+				}
+			}
 			return yok && x.Name == y.Name
 		}
 		if _, ok := node.(ast.Node); !ok {
@@ -356,14 +2427,39 @@ func (m *matcher) node(expr, node ast.Node) bool {
 	case stmtList:
 		y, ok := node.(stmtList)
 		return ok && m.stmts(x, y)
+	case fieldList:
+		y, ok := node.(fieldList)
+		return ok && m.nodesMatch(x, y)
 
 	// lits
 	case *ast.BasicLit:
+		if m.constVal {
+			// "1024" also matches "1 << 10" and "0x400"
+			if y, ok := node.(ast.Expr); ok {
+				return sameConst(constant.MakeFromLiteral(x.Value, x.Kind, 0),
+					m.Info.Types[y].Value)
+			}
+		}
 		y, ok := node.(*ast.BasicLit)
 		return ok && x.Kind == y.Kind && x.Value == y.Value
 	case *ast.CompositeLit:
+		if op := opWildUnary(x); op != nil {
+			switch y := node.(type) {
+			case *ast.UnaryExpr:
+				return m.wildOp(op, y.Op, y.OpPos) && m.node(x.Elts[0], y.X)
+			case *ast.StarExpr:
+				return m.wildOp(op, token.MUL, y.Star) && m.node(x.Elts[0], y.X)
+			}
+			return false
+		}
 		y, ok := node.(*ast.CompositeLit)
-		return ok && m.node(x.Type, y.Type) && m.exprs(x.Elts, y.Elts)
+		if !ok || !m.node(x.Type, y.Type) {
+			return false
+		}
+		if m.norms["keyed"] && m.keyedElts(x.Elts) {
+			return m.unorderedElts(x.Elts, y.Elts)
+		}
+		return m.exprs(x.Elts, y.Elts)
 	case *ast.FuncLit:
 		y, ok := node.(*ast.FuncLit)
 		return ok && m.node(x.Type, y.Type) && m.node(x.Body, y.Body)
@@ -379,13 +2475,21 @@ func (m *matcher) node(expr, node ast.Node) bool {
 		y, ok := node.(*ast.StructType)
 		return ok && m.fields(x.Fields, y.Fields)
 	case *ast.Field:
-		// TODO: tags?
 		y, ok := node.(*ast.Field)
-		return ok && m.idents(x.Names, y.Names) && m.node(x.Type, y.Type)
+		if !ok || !m.node(x.Type, y.Type) {
+			return false
+		}
+		// a pattern without names matches parameters with any
+		// names, as in "func(io.Reader)"
+		if (x.Names != nil || !m.param(y)) && !m.idents(x.Names, y.Names) {
+			return false
+		}
+		// a pattern without a tag matches fields with any tag
+		return x.Tag == nil || (y.Tag != nil && m.node(x.Tag, y.Tag))
 	case *ast.FuncType:
 		y, ok := node.(*ast.FuncType)
-		return ok && m.fields(x.Params, y.Params) &&
-			m.fields(x.Results, y.Results)
+		return ok && m.fields(x.TypeParams, y.TypeParams) &&
+			m.fields(x.Params, y.Params) && m.fields(x.Results, y.Results)
 	case *ast.InterfaceType:
 		y, ok := node.(*ast.InterfaceType)
 		return ok && m.fields(x.Methods, y.Methods)
@@ -404,12 +2508,30 @@ func (m *matcher) node(expr, node ast.Node) bool {
 		y, ok := node.(*ast.UnaryExpr)
 		return ok && x.Op == y.Op && m.node(x.X, y.X)
 	case *ast.BinaryExpr:
+		if op, left := opWildBinary(x); op != nil {
+			y, ok := node.(*ast.BinaryExpr)
+			return ok && m.wildOp(op, y.Op, y.OpPos) &&
+				m.node(left, y.X) && m.node(x.Y, y.Y)
+		}
 		y, ok := node.(*ast.BinaryExpr)
-		return ok && x.Op == y.Op && m.node(x.X, y.X) && m.node(x.Y, y.Y)
+		if !ok || x.Op != y.Op {
+			return false
+		}
+		if m.commutative && m.commutes(y) {
+			// try the original order first, so that wildcards
+			// bind in order if both orders match
+			values := valsCopy(m.values)
+			if m.node(x.X, y.X) && m.node(x.Y, y.Y) {
+				return true
+			}
+			m.values = values
+			return m.node(x.X, y.Y) && m.node(x.Y, y.X)
+		}
+		return m.node(x.X, y.X) && m.node(x.Y, y.Y)
 	case *ast.CallExpr:
 		y, ok := node.(*ast.CallExpr)
 		return ok && m.node(x.Fun, y.Fun) && m.exprs(x.Args, y.Args) &&
-			bothValid(x.Ellipsis, y.Ellipsis)
+			m.callEllipsis(x, y)
 	case *ast.KeyValueExpr:
 		y, ok := node.(*ast.KeyValueExpr)
 		return ok && m.node(x.Key, y.Key) && m.node(x.Value, y.Value)
@@ -417,11 +2539,45 @@ func (m *matcher) node(expr, node ast.Node) bool {
 		y, ok := node.(*ast.StarExpr)
 		return ok && m.node(x.X, y.X)
 	case *ast.SelectorExpr:
+		if pkg, ok := x.X.(*ast.Ident); ok && m.aliases && !isWildName(pkg.Name) {
+			// "fmt.Println" also matches "f.Println" and
+			// "Println" if fmt is imported as f or with a dot
+			if imported, sel := m.qualifiedIdent(node); imported != nil {
+				return imported.Name() == pkg.Name && m.node(x.Sel, sel)
+			}
+		}
 		y, ok := node.(*ast.SelectorExpr)
-		return ok && m.node(x.X, y.X) && m.node(x.Sel, y.Sel)
-	case *ast.IndexExpr:
-		y, ok := node.(*ast.IndexExpr)
-		return ok && m.node(x.X, y.X) && m.node(x.Index, y.Index)
+		if !ok {
+			return false
+		}
+		if !m.promoted {
+			return m.node(x.X, y.X) && m.node(x.Sel, y.Sel)
+		}
+		// "$x.Close()" also matches "s.File.Close()" as if it
+		// were written "s.Close()", if File is an embedded
+		// field which promotes Close. Try the embedding types
+		// first, starting with the outermost.
+		yxs := []ast.Expr{y.X}
+		for {
+			sel, ok := yxs[len(yxs)-1].(*ast.SelectorExpr)
+			if !ok || !m.promotes(sel, y) {
+				break
+			}
+			yxs = append(yxs, sel.X)
+		}
+		values := valsCopy(m.values)
+		for i := len(yxs) - 1; i >= 0; i-- {
+			m.values = valsCopy(values)
+			if m.node(x.X, yxs[i]) && m.node(x.Sel, y.Sel) {
+				return true
+			}
+		}
+		return false
+	case *ast.IndexExpr, *ast.IndexListExpr:
+		// "Map[$*_]" must also match "Map[K, V]"
+		xx, xindices, _ := indexParts(x)
+		yx, yindices, ok := indexParts(node)
+		return ok && m.node(xx, yx) && m.exprs(xindices, yindices)
 	case *ast.SliceExpr:
 		y, ok := node.(*ast.SliceExpr)
 		return ok && m.node(x.X, y.X) && m.node(x.Low, y.Low) &&
@@ -432,6 +2588,11 @@ func (m *matcher) node(expr, node ast.Node) bool {
 
 	// decls
 	case *ast.GenDecl:
+		if x.Tok == token.IMPORT && !x.Lparen.IsValid() && len(x.Specs) == 1 {
+			// a single import matches any import spec, even
+			// within parentheses next to others
+			return m.node(x.Specs[0], node)
+		}
 		y, ok := node.(*ast.GenDecl)
 		return ok && x.Tok == y.Tok && m.specs(x.Specs, y.Specs)
 	case *ast.FuncDecl:
@@ -442,18 +2603,37 @@ func (m *matcher) node(expr, node ast.Node) bool {
 	// specs
 	case *ast.ValueSpec:
 		y, ok := node.(*ast.ValueSpec)
-		if !ok || !m.node(x.Type, y.Type) {
+		if !ok {
+			return false
+		}
+		ytype, yvalues := y.Type, y.Values
+		if x.Type != nil || x.Values != nil {
+			ytype, yvalues = m.specValues(y)
+		}
+		if !m.node(x.Type, ytype) {
 			return false
 		}
-		if m.aggressive && len(x.Names) == 1 {
+		if m.norms["decl"] && len(x.Names) == 1 {
 			for i := range y.Names {
-				if m.node(x.Names[i], y.Names[i]) &&
-					(x.Values == nil || m.node(x.Values[i], y.Values[i])) {
+				if m.node(x.Names[0], y.Names[i]) && (x.Values == nil ||
+					(i < len(yvalues) && m.node(x.Values[0], yvalues[i]))) {
 					return true
 				}
 			}
 		}
-		return m.idents(x.Names, y.Names) && m.exprs(x.Values, y.Values)
+		return m.idents(x.Names, y.Names) && m.exprs(x.Values, yvalues)
+
+	case *ast.ImportSpec:
+		y, ok := node.(*ast.ImportSpec)
+		if !ok || !importPathMatches(x.Path, y.Path) {
+			return false
+		}
+		if x.Name == nil || y.Name == nil {
+			// "$_" also matches the lack of a name
+			return x.Name == y.Name || (x.Name != nil &&
+				m.info(fromWildNode(x.Name)).name == "_")
+		}
+		return m.node(x.Name, y.Name)
 
 	// stmt bridge nodes
 	case *ast.ExprStmt:
@@ -483,7 +2663,7 @@ func (m *matcher) node(expr, node ast.Node) bool {
 		return ok && x.Tok == y.Tok && m.node(x.X, y.X)
 	case *ast.AssignStmt:
 		y, ok := node.(*ast.AssignStmt)
-		if !m.aggressive {
+		if !m.norms["assign"] {
 			return ok && x.Tok == y.Tok &&
 				m.exprs(x.Lhs, y.Lhs) && m.exprs(x.Rhs, y.Rhs)
 		}
@@ -506,7 +2686,7 @@ func (m *matcher) node(expr, node ast.Node) bool {
 		y, ok := node.(*ast.BranchStmt)
 		return ok && x.Tok == y.Tok && m.node(maybeNilIdent(x.Label), maybeNilIdent(y.Label))
 	case *ast.BlockStmt:
-		if m.aggressive && m.node(stmtList(x.List), node) {
+		if m.norms["block"] && m.node(stmtList(x.List), node) {
 			return true
 		}
 		y, ok := node.(*ast.BlockStmt)
@@ -571,14 +2751,21 @@ func (m *matcher) node(expr, node ast.Node) bool {
 		if !ok {
 			return false
 		}
-		return m.optNode(x.Init, y.Init) && m.node(x.Cond, y.Cond) &&
+		// each of the three clauses may be omitted, so "$*x" in
+		// any of them matches both a present and an absent clause
+		return m.optNode(x.Init, y.Init) && m.optNode(x.Cond, y.Cond) &&
 			m.optNode(x.Post, y.Post) && m.node(x.Body, y.Body)
 	case *ast.RangeStmt:
 		y, ok := node.(*ast.RangeStmt)
 		return ok && m.node(x.Key, y.Key) && m.node(x.Value, y.Value) &&
 			m.node(x.X, y.X) && m.node(x.Body, y.Body)
 
-	case *ast.TypeSpec, *ast.FieldList:
+	case *ast.TypeSpec:
+		y, ok := node.(*ast.TypeSpec)
+		return ok && m.node(x.Name, y.Name) &&
+			m.fields(x.TypeParams, y.TypeParams) &&
+			x.Assign.IsValid() == y.Assign.IsValid() && m.node(x.Type, y.Type)
+	case *ast.FieldList:
 		// we ignore these, for now
 		return false
 	default:
@@ -616,48 +2803,351 @@ func (m *matcher) resolveType(scope *types.Scope, expr ast.Expr) types.Type {
 		return obj.Type()
 	case *ast.ArrayType:
 		elt := m.resolveType(scope, x.Elt)
+		if elt == nil {
+			return nil
+		}
 		if x.Len == nil {
 			return types.NewSlice(elt)
 		}
-		bl, ok := x.Len.(*ast.BasicLit)
-		if !ok || bl.Kind != token.INT {
-			panic(fmt.Sprintf("TODO: %T", x))
+		// "[...]T" has no length of its own
+		val := m.constValue(scope, x.Len)
+		if val == nil {
+			return nil
+		}
+		len, ok := constant.Int64Val(constant.ToInt(val))
+		if !ok || len < 0 {
+			return nil
 		}
-		len, _ := strconv.ParseInt(bl.Value, 0, 0)
 		return types.NewArray(elt, len)
 	case *ast.StarExpr:
-		return types.NewPointer(m.resolveType(scope, x.X))
+		elem := m.resolveType(scope, x.X)
+		if elem == nil {
+			return nil
+		}
+		return types.NewPointer(elem)
 	case *ast.SelectorExpr:
-		scope = m.findScope(scope, x.X)
+		if scope = m.findScope(scope, x.X); scope == nil {
+			return nil
+		}
 		return m.resolveType(scope, x.Sel)
+	case *ast.ParenExpr:
+		return m.resolveType(scope, x.X)
+	case *ast.MapType:
+		key, value := m.resolveType(scope, x.Key), m.resolveType(scope, x.Value)
+		if key == nil || value == nil {
+			return nil
+		}
+		return types.NewMap(key, value)
+	case *ast.ChanType:
+		elem := m.resolveType(scope, x.Value)
+		if elem == nil {
+			return nil
+		}
+		dir := types.SendRecv
+		switch x.Dir {
+		case ast.SEND:
+			dir = types.SendOnly
+		case ast.RECV:
+			dir = types.RecvOnly
+		}
+		return types.NewChan(dir, elem)
+	case *ast.FuncType:
+		sig := m.resolveSignature(scope, x)
+		if sig == nil {
+			return nil
+		}
+		return sig
+	case *ast.StructType:
+		var fields []*types.Var
+		var tags []string
+		for _, field := range x.Fields.List {
+			typ := m.resolveType(scope, field.Type)
+			if typ == nil {
+				return nil
+			}
+			tag := ""
+			if field.Tag != nil {
+				tag, _ = strconv.Unquote(field.Tag.Value)
+			}
+			if len(field.Names) == 0 {
+				// the name of an embedded field is that of
+				// its type, without a pointer nor package
+				name := field.Type
+				if star, ok := name.(*ast.StarExpr); ok {
+					name = star.X
+				}
+				if sel, ok := name.(*ast.SelectorExpr); ok {
+					name = sel.Sel
+				}
+				id, _ := name.(*ast.Ident)
+				if id == nil {
+					return nil
+				}
+				fields = append(fields, types.NewField(token.NoPos,
+					scopePkg(scope), id.Name, typ, true))
+				tags = append(tags, tag)
+			}
+			for _, name := range field.Names {
+				fields = append(fields, types.NewField(token.NoPos,
+					scopePkg(scope), name.Name, typ, false))
+				tags = append(tags, tag)
+			}
+		}
+		return types.NewStruct(fields, tags)
+	case *ast.InterfaceType:
+		var methods []*types.Func
+		var embeddeds []types.Type
+		for _, field := range x.Methods.List {
+			if len(field.Names) == 0 {
+				typ := m.resolveType(scope, field.Type)
+				if typ == nil {
+					return nil
+				}
+				embeddeds = append(embeddeds, typ)
+				continue
+			}
+			ftyp, ok := field.Type.(*ast.FuncType)
+			if !ok {
+				return nil
+			}
+			sig := m.resolveSignature(scope, ftyp)
+			if sig == nil {
+				return nil
+			}
+			for _, name := range field.Names {
+				methods = append(methods, types.NewFunc(token.NoPos,
+					scopePkg(scope), name.Name, sig))
+			}
+		}
+		return types.NewInterfaceType(methods, embeddeds).Complete()
+	case *ast.IndexExpr, *ast.IndexListExpr:
+		// an instantiation of a generic type, like "List[int]"
+		generic, indices, _ := indexParts(x)
+		orig := m.resolveType(scope, generic)
+		if orig == nil {
+			return nil
+		}
+		targs := make([]types.Type, len(indices))
+		for i, index := range indices {
+			if targs[i] = m.resolveType(scope, index); targs[i] == nil {
+				return nil
+			}
+		}
+		inst, err := types.Instantiate(nil, orig, targs, true)
+		if err != nil {
+			return nil
+		}
+		return inst
 	default:
-		panic(fmt.Sprintf("resolveType TODO: %T", x))
+		return nil
+	}
+}
+
+// constValue evaluates a constant numeric expression from a given scope,
+// such as the length of an array type, or returns nil if it isn't one.
+func (m *matcher) constValue(scope *types.Scope, expr ast.Expr) constant.Value {
+	isNum := func(val constant.Value) bool {
+		return val != nil && (val.Kind() == constant.Int || val.Kind() == constant.Float)
+	}
+	switch x := expr.(type) {
+	case *ast.BasicLit:
+		if x.Kind == token.INT || x.Kind == token.FLOAT || x.Kind == token.CHAR {
+			return constant.MakeFromLiteral(x.Value, x.Kind, 0)
+		}
+	case *ast.Ident:
+		_, obj := scope.LookupParent(x.Name, token.NoPos)
+		if c, ok := obj.(*types.Const); ok && isNum(c.Val()) {
+			return c.Val()
+		}
+	case *ast.SelectorExpr:
+		if scope = m.findScope(scope, x.X); scope != nil {
+			return m.constValue(scope, x.Sel)
+		}
+	case *ast.ParenExpr:
+		return m.constValue(scope, x.X)
+	case *ast.UnaryExpr:
+		val := m.constValue(scope, x.X)
+		switch x.Op {
+		case token.ADD, token.SUB, token.XOR:
+			if isNum(val) {
+				return constant.UnaryOp(x.Op, val, 0)
+			}
+		}
+	case *ast.BinaryExpr:
+		left, right := m.constValue(scope, x.X), m.constValue(scope, x.Y)
+		if !isNum(left) || !isNum(right) {
+			return nil
+		}
+		switch x.Op {
+		case token.SHL, token.SHR:
+			shift, ok := constant.Uint64Val(constant.ToInt(right))
+			if !ok || constant.ToInt(left).Kind() != constant.Int {
+				return nil
+			}
+			return constant.Shift(constant.ToInt(left), x.Op, uint(shift))
+		case token.QUO:
+			if constant.Sign(right) == 0 {
+				return nil
+			}
+			if left.Kind() == constant.Int && right.Kind() == constant.Int {
+				// integer division, as QUO would give a fraction
+				return constant.BinaryOp(left, token.QUO_ASSIGN, right)
+			}
+			return constant.BinaryOp(left, x.Op, right)
+		case token.ADD, token.SUB, token.MUL:
+			return constant.BinaryOp(left, x.Op, right)
+		case token.REM, token.AND, token.OR, token.XOR, token.AND_NOT:
+			if left.Kind() == constant.Int && right.Kind() == constant.Int {
+				return constant.BinaryOp(left, x.Op, right)
+			}
+		}
+	}
+	return nil
+}
+
+// resolveSignature resolves a func type expression from a given scope, or
+// returns nil if any of its parameter or result types cannot be resolved.
+func (m *matcher) resolveSignature(scope *types.Scope, ftyp *ast.FuncType) *types.Signature {
+	params, variadic, ok := m.resolveTuple(scope, ftyp.Params)
+	if !ok {
+		return nil
+	}
+	results, _, ok := m.resolveTuple(scope, ftyp.Results)
+	if !ok {
+		return nil
+	}
+	return types.NewSignatureType(nil, nil, nil, params, results, variadic)
+}
+
+// resolveTuple resolves the types in a list of parameters or results, and
+// whether the last of them is variadic. It returns false if any of the
+// types cannot be resolved.
+func (m *matcher) resolveTuple(scope *types.Scope, list *ast.FieldList) (*types.Tuple, bool, bool) {
+	if list == nil {
+		return nil, false, true
+	}
+	var vars []*types.Var
+	variadic := false
+	for _, field := range list.List {
+		texpr := field.Type
+		if ell, ok := texpr.(*ast.Ellipsis); ok {
+			texpr = &ast.ArrayType{Elt: ell.Elt}
+			variadic = true
+		}
+		typ := m.resolveType(scope, texpr)
+		if typ == nil {
+			return nil, false, false
+		}
+		if len(field.Names) == 0 {
+			vars = append(vars, types.NewParam(token.NoPos, nil, "", typ))
+		}
+		for _, name := range field.Names {
+			vars = append(vars, types.NewParam(token.NoPos, nil, name.Name, typ))
+		}
+	}
+	return types.NewTuple(vars...), variadic, true
+}
+
+// scopePkg returns the package that a scope belongs to, so that unexported
+// names in resolved types can be identical to those declared in it. It
+// returns nil if the package scope declares no objects.
+func scopePkg(scope *types.Scope) *types.Package {
+	for scope != nil && scope.Parent() != types.Universe {
+		scope = scope.Parent()
+	}
+	if scope == nil {
+		return nil
+	}
+	for _, name := range scope.Names() {
+		if pkg := scope.Lookup(name).Pkg(); pkg != nil {
+			return pkg
+		}
 	}
+	return nil
 }
 
+// findScope returns the scope of the package that a type expression like
+// "pkg.Name" refers to. The package is either one imported by the current
+// file, one found by path or by name in the import graph of the current
+// package, or a std package. It returns nil if no package was found.
 func (m *matcher) findScope(scope *types.Scope, expr ast.Expr) *types.Scope {
+	var path string
 	switch x := expr.(type) {
 	case *ast.Ident:
 		_, obj := scope.LookupParent(x.Name, token.NoPos)
 		if pkg, ok := obj.(*types.PkgName); ok {
 			return pkg.Imported().Scope()
 		}
-		// try to fall back to std
-		if m.stdImporter == nil {
-			m.stdImporter = importer.Default()
-		}
-		path := x.Name
+		path = x.Name
 		if longer, ok := stdImportFixes[path]; ok {
 			path = longer
 		}
-		pkg, err := m.stdImporter.Import(path)
-		if err != nil {
-			panic(fmt.Sprintf("findScope err: %v", err))
+		if pkg := findImport(m.pkg, path, x.Name); pkg != nil {
+			return pkg.Scope()
+		}
+	case *ast.BasicLit:
+		// a full import path, as quoted by quotePaths
+		path, _ = strconv.Unquote(x.Value)
+		if pkg := findImport(m.pkg, path, ""); pkg != nil {
+			return pkg.Scope()
 		}
-		return pkg.Scope()
 	default:
-		panic(fmt.Sprintf("findScope TODO: %T", x))
+		return nil
+	}
+	// try to fall back to std
+	if m.stdImporter == nil {
+		m.stdImporter = importer.Default()
+	}
+	pkg, err := m.stdImporter.Import(path)
+	if err != nil {
+		return nil
+	}
+	return pkg.Scope()
+}
+
+// findImport looks for a package with the given path in the import graph
+// of pkg, including pkg itself. If name isn't empty, a package with that
+// name is also accepted, but one with the path is preferred.
+func findImport(pkg *types.Package, path, name string) *types.Package {
+	if pkg == nil {
+		return nil
+	}
+	var byName *types.Package
+	seen := map[*types.Package]bool{}
+	var walk func(pkg *types.Package) *types.Package
+	walk = func(pkg *types.Package) *types.Package {
+		if seen[pkg] {
+			return nil
+		}
+		seen[pkg] = true
+		if pkg.Path() == path {
+			return pkg
+		}
+		if name != "" && pkg.Name() == name && byName == nil {
+			byName = pkg
+		}
+		for _, imp := range pkg.Imports() {
+			if found := walk(imp); found != nil {
+				return found
+			}
+		}
+		return nil
 	}
+	if found := walk(pkg); found != nil {
+		return found
+	}
+	return byName
+}
+
+// pathRx matches qualified names whose package is given by its full
+// import path, like "github.com/foo/bar.Baz".
+var pathRx = regexp.MustCompile(`([\w.~-]+(?:/[\w.~-]+)+)\.([\pL_][\pL\pN_]*)`)
+
+// quotePaths quotes the import paths in a type expression, such as
+// "*github.com/foo/bar.Baz" becoming `*"github.com/foo/bar".Baz`, so that
+// it can be parsed as Go.
+func quotePaths(src string) string {
+	return pathRx.ReplaceAllString(src, "\"$1\".$2")
 }
 
 var stdImportFixes = map[string]string{
@@ -787,6 +3277,76 @@ func bothValid(p1, p2 token.Pos) bool {
 	return p1.IsValid() == p2.IsValid()
 }
 
+// callEllipsis reports whether the spread arguments of two calls match. A
+// trailing "$*x" without "..." in the pattern may absorb a spread argument,
+// so that "f($*x)" matches both "f(a)" and "f(s...)". Substitutions keep
+// the "..." after it; see keepSpread.
+func (m *matcher) callEllipsis(x, y *ast.CallExpr) bool {
+	if bothValid(x.Ellipsis, y.Ellipsis) {
+		return true
+	}
+	if x.Ellipsis.IsValid() || len(x.Args) == 0 {
+		return false
+	}
+	return m.wildAnyIdent(x.Args[len(x.Args)-1]) != nil
+}
+
+// normBool rewrites a negated boolean expression by pushing the negation
+// inwards. That is, "!!a" becomes "a", "!(a && b)" becomes "!a || !b", and
+// "!(a == b)" becomes "a != b". Negated ordered comparisons such as
+// "!(a < b)" are left alone, as they are not equivalent to "a >= b" when
+// NaN floats are involved.
+//
+// node is returned as is if no rewrite applies. Otherwise, new nodes are
+// allocated; node itself is never modified.
+func normBool(node ast.Node) ast.Node {
+	un, ok := node.(*ast.UnaryExpr)
+	if !ok || un.Op != token.NOT {
+		return node
+	}
+	switch x := unparen(un.X).(type) {
+	case *ast.UnaryExpr:
+		if x.Op == token.NOT {
+			return normBool(unparen(x.X))
+		}
+	case *ast.BinaryExpr:
+		switch x.Op {
+		case token.LAND, token.LOR:
+			op := token.LOR
+			if x.Op == token.LOR {
+				op = token.LAND
+			}
+			return &ast.BinaryExpr{
+				X:  negate(x.X),
+				Op: op,
+				Y:  negate(x.Y),
+			}
+		case token.EQL, token.NEQ:
+			op := token.NEQ
+			if x.Op == token.NEQ {
+				op = token.EQL
+			}
+			return &ast.BinaryExpr{X: x.X, Op: op, Y: x.Y}
+		}
+	}
+	return node
+}
+
+// negate returns the normalized negation of an expression.
+func negate(x ast.Expr) ast.Expr {
+	return normBool(&ast.UnaryExpr{Op: token.NOT, X: x}).(ast.Expr)
+}
+
+func unparen(x ast.Expr) ast.Expr {
+	for {
+		paren, ok := x.(*ast.ParenExpr)
+		if !ok {
+			return x
+		}
+		x = paren.X
+	}
+}
+
 type nodeList interface {
 	at(i int) ast.Node
 	len() int
@@ -795,8 +3355,10 @@ type nodeList interface {
 }
 
 // nodes matches two lists of nodes. It uses a common algorithm to match
-// wildcard patterns with any number of nodes without recursion.
-func (m *matcher) nodes(ns1, ns2 nodeList, partial bool) ast.Node {
+// wildcard patterns with any number of nodes without recursion. If
+// skipStart or skipEnd are true, ns1 may match a sublist of ns2 which
+// doesn't start at its beginning or end at its end, respectively.
+func (m *matcher) nodes(ns1, ns2 nodeList, skipStart, skipEnd bool) ast.Node {
 	ns1len, ns2len := ns1.len(), ns2.len()
 	if ns1len == 0 {
 		if ns2len == 0 {
@@ -804,6 +3366,9 @@ func (m *matcher) nodes(ns1, ns2 nodeList, partial bool) ast.Node {
 		}
 		return nil
 	}
+	if m.literal {
+		return m.literalNodes(ns1, ns2, skipStart, skipEnd)
+	}
 	partialStart, partialEnd := 0, ns2len
 	i1, i2 := 0, 0
 	next1, next2 := 0, 0
@@ -811,9 +3376,14 @@ func (m *matcher) nodes(ns1, ns2 nodeList, partial bool) ast.Node {
 	// We need to keep a copy of m.values so that we can restart
 	// with a different "any of" match while discarding any matches
 	// we found while trying it.
+	// The wildcard being matched is kept too, as the restarts may
+	// go back to an earlier one.
 	type restart struct {
 		matches      map[string]ast.Node
 		next1, next2 int
+
+		wildName  string
+		wildStart int
 	}
 	// We need to stack these because otherwise some edge cases
 	// would not match properly. Since we have various kinds of
@@ -821,16 +3391,20 @@ func (m *matcher) nodes(ns1, ns2 nodeList, partial bool) ast.Node {
 	// we may have to go back and do multiple restarts to get to the
 	// right starting position.
 	var stack []restart
+	wildName := ""
+	wildStart := 0
 	push := func(n1, n2 int) {
 		if n2 > ns2len {
 			return // would be discarded anyway
 		}
-		stack = append(stack, restart{valsCopy(m.values), n1, n2})
+		stack = append(stack, restart{valsCopy(m.values), n1, n2, wildName, wildStart})
 		next1, next2 = n1, n2
 	}
 	pop := func() {
 		i1, i2 = next1, next2
-		m.values = stack[len(stack)-1].matches
+		top := stack[len(stack)-1]
+		m.values = top.matches
+		wildName, wildStart = top.wildName, top.wildStart
 		stack = stack[:len(stack)-1]
 		next1, next2 = 0, 0
 		if len(stack) > 0 {
@@ -838,8 +3412,6 @@ func (m *matcher) nodes(ns1, ns2 nodeList, partial bool) ast.Node {
 			next2 = stack[len(stack)-1].next2
 		}
 	}
-	wildName := ""
-	wildStart := 0
 
 	// wouldMatch returns whether the current wildcard - if any -
 	// matches the nodes we are currently trying it on.
@@ -862,7 +3434,9 @@ func (m *matcher) nodes(ns1, ns2 nodeList, partial bool) ast.Node {
 			n1 := ns1.at(i1)
 			id := fromWildNode(n1)
 			info := m.info(id)
-			if info.any {
+			// a previous wildcard must match the nodes
+			// it took before starting another one
+			if info.any && (info.name == wildName || wouldMatch()) {
 				// keep track of where this wildcard
 				// started (if info.name == wildName,
 				// we're trying the same wildcard
@@ -871,13 +3445,25 @@ func (m *matcher) nodes(ns1, ns2 nodeList, partial bool) ast.Node {
 					wildStart = i2
 					wildName = info.name
 				}
-				// try to match zero or more at i2,
-				// restarting at i2+1 if it fails
-				push(i1, i2+1)
-				i1++
+				// "$?x" may only match one node
+				more := i2 < ns2len && (!info.opt || i2 == wildStart)
+				switch {
+				case more && info.greedy:
+					// try to match one more at i2,
+					// restarting without it if it fails
+					push(i1+1, i2)
+					i2++
+				case more:
+					// try to stop matching at i2,
+					// restarting at i2+1 if it fails
+					push(i1, i2+1)
+					i1++
+				default:
+					i1++
+				}
 				continue
 			}
-			if partial && i1 == 0 {
+			if skipStart && i1 == 0 {
 				// let "b; c" match "a; b; c"
 				// (simulates a $*_ at the beginning)
 				partialStart = i2
@@ -891,12 +3477,12 @@ func (m *matcher) nodes(ns1, ns2 nodeList, partial bool) ast.Node {
 				continue
 			}
 		}
-		if partial && i1 == ns1len && wildName == "" {
+		if skipEnd && i1 == ns1len && wildName == "" {
 			partialEnd = i2
 			break // let "b; c" match "b; c; d"
 		}
 		// mismatch, try to restart
-		if 0 < next2 && next2 <= ns2len && (i1 != next1 || i2 != next2) {
+		if len(stack) > 0 && (i1 != next1 || i2 != next2) {
 			pop()
 			continue
 		}
@@ -908,8 +3494,34 @@ func (m *matcher) nodes(ns1, ns2 nodeList, partial bool) ast.Node {
 	return ns2.slice(partialStart, partialEnd)
 }
 
+// literalNodes is a faster version of nodes for patterns without dollar
+// expressions. Since no node can match a variable number of nodes, there is
+// no need to backtrack nor to keep copies of the values.
+func (m *matcher) literalNodes(ns1, ns2 nodeList, skipStart, skipEnd bool) ast.Node {
+	ns1len, ns2len := ns1.len(), ns2.len()
+	if ns1len > ns2len || (!skipStart && !skipEnd && ns1len != ns2len) {
+		return nil
+	}
+	first, last := 0, ns2len-ns1len
+	if !skipStart {
+		last = 0
+	} else if !skipEnd {
+		first = last
+	}
+	for start := first; start <= last; start++ {
+		i := 0
+		for i < ns1len && m.node(ns1.at(i), ns2.at(start+i)) {
+			i++
+		}
+		if i == ns1len {
+			return ns2.slice(start, start+ns1len)
+		}
+	}
+	return nil
+}
+
 func (m *matcher) nodesMatch(list1, list2 nodeList) bool {
-	return m.nodes(list1, list2, false) != nil
+	return m.nodes(list1, list2, false, false) != nil
 }
 
 func (m *matcher) exprs(exprs1, exprs2 []ast.Expr) bool {
@@ -944,48 +3556,102 @@ func (m *matcher) cases(stmts1, stmts2 []ast.Stmt) bool {
 			return false
 		}
 	}
-	var left []*ast.Ident
+	// wildcards stand in for whole clauses, and can be mixed with
+	// regular clauses like "default: $*_"
+	anyWild := false
+	// the order of select clauses doesn't matter, so if the only
+	// wildcards are "$*_", the other clauses may be anywhere
+	selectAny := true
+	var left, clauses []ast.Stmt
 	for _, stmt := range stmts1 {
-		var expr ast.Expr
-		var bstmt ast.Stmt
-		switch x := stmt.(type) {
+		switch stmt.(type) {
 		case *ast.CaseClause:
-			if len(x.List) != 1 || len(x.Body) != 1 {
-				return false
-			}
-			expr, bstmt = x.List[0], x.Body[0]
+			selectAny = false
 		case *ast.CommClause:
-			if x.Comm == nil || len(x.Body) != 1 {
-				return false
-			}
-			if commExpr, ok := x.Comm.(*ast.ExprStmt); ok {
-				expr = commExpr.X
-			}
-			bstmt = x.Body[0]
 		default:
 			return false
 		}
-		xs, ok := bstmt.(*ast.ExprStmt)
-		if !ok {
-			return false
+		if id := wildClause(stmt); id != nil {
+			anyWild = true
+			if info := m.info(fromWildNode(id)); !info.any || info.name != "_" {
+				selectAny = false
+			}
+			stmt = &ast.ExprStmt{X: id}
+		} else {
+			clauses = append(clauses, stmt)
 		}
-		bodyIdent, ok := xs.X.(*ast.Ident)
-		if !ok || bodyIdent.Name != "gogrep_body" {
-			return false
+		left = append(left, stmt)
+	}
+	if anyWild && selectAny {
+		return m.unordered(stmtList(clauses), stmtList(stmts2), true)
+	}
+	return anyWild && m.nodesMatch(stmtList(left), stmtList(stmts2))
+}
+
+// wildClause returns the wildcard that a case clause stands for, as
+// tokenize turns "$x" into "case $x: gogrep_body" within a switch or select.
+func wildClause(stmt ast.Stmt) *ast.Ident {
+	var expr ast.Expr
+	var bstmt ast.Stmt
+	switch x := stmt.(type) {
+	case *ast.CaseClause:
+		if len(x.List) != 1 || len(x.Body) != 1 {
+			return nil
 		}
-		id, ok := expr.(*ast.Ident)
-		if !ok || !isWildName(id.Name) {
-			return false
+		expr, bstmt = x.List[0], x.Body[0]
+	case *ast.CommClause:
+		if x.Comm == nil || len(x.Body) != 1 {
+			return nil
 		}
-		left = append(left, id)
+		if commExpr, ok := x.Comm.(*ast.ExprStmt); ok {
+			expr = commExpr.X
+		}
+		bstmt = x.Body[0]
+	default:
+		return nil
+	}
+	xs, ok := bstmt.(*ast.ExprStmt)
+	if !ok {
+		return nil
+	}
+	bodyIdent, ok := xs.X.(*ast.Ident)
+	if !ok || bodyIdent.Name != "gogrep_body" {
+		return nil
+	}
+	id, ok := expr.(*ast.Ident)
+	if !ok || !isWildName(id.Name) {
+		return nil
 	}
-	return m.nodesMatch(identList(left), stmtList(stmts2))
+	return id
 }
 
 func (m *matcher) stmts(stmts1, stmts2 []ast.Stmt) bool {
 	return m.nodesMatch(stmtList(stmts1), stmtList(stmts2))
 }
 
+// importPathMatches reports whether an import path matches one in a
+// pattern, which may end in "/..." as with -imports.
+func importPathMatches(pattern, path *ast.BasicLit) bool {
+	want, err := strconv.Unquote(pattern.Value)
+	if err != nil {
+		return false
+	}
+	got, err := strconv.Unquote(path.Value)
+	return err == nil && importMatches(want, got)
+}
+
+// indexParts returns the operand and indices of an index expression,
+// including generic instantiations with many type arguments like "Map[K, V]".
+func indexParts(node ast.Node) (ast.Expr, []ast.Expr, bool) {
+	switch x := node.(type) {
+	case *ast.IndexExpr:
+		return x.X, []ast.Expr{x.Index}, true
+	case *ast.IndexListExpr:
+		return x.X, x.Indices, true
+	}
+	return nil, nil, false
+}
+
 func (m *matcher) specs(specs1, specs2 []ast.Spec) bool {
 	return m.nodesMatch(specList(specs1), specList(specs2))
 }
@@ -994,15 +3660,38 @@ func (m *matcher) fields(fields1, fields2 *ast.FieldList) bool {
 	if fields1 == nil || fields2 == nil {
 		return fields1 == fields2
 	}
-	if len(fields1.List) != len(fields2.List) {
-		return false
-	}
-	for i, f1 := range fields1.List {
-		if !m.node(f1, fields2.List[i]) {
-			return false
+	return m.nodesMatch(fieldList(fields1.List), fieldList(fields2.List))
+}
+
+// patternVars returns the wildcards captured by a pattern, in order of
+// appearance and without duplicate names. "$_" and "$*_" are left out, as
+// they capture nothing.
+func (m *matcher) patternVars(node ast.Node) []varInfo {
+	var vars []varInfo
+	seen := make(map[string]bool)
+	inspect(node, func(node ast.Node) bool {
+		info := m.info(fromWildNode(node))
+		if info.name == "" || info.name == "_" || seen[info.name] {
+			return true
 		}
-	}
-	return true
+		seen[info.name] = true
+		vars = append(vars, info)
+		return true
+	})
+	return vars
+}
+
+// hasWildcards reports whether a pattern contains any dollar expressions,
+// including "$_".
+func hasWildcards(node ast.Node) bool {
+	any := false
+	inspect(node, func(node ast.Node) bool {
+		if ident, ok := node.(*ast.Ident); ok && isWildName(ident.Name) {
+			any = true
+		}
+		return !any
+	})
+	return any
 }
 
 func fromWildNode(node ast.Node) int {
@@ -1011,6 +3700,16 @@ func fromWildNode(node ast.Node) int {
 		return fromWildName(x.Name)
 	case *ast.ExprStmt:
 		return fromWildNode(x.X)
+	case *ast.Field:
+		// "$*params" in "func(int, $*params)"
+		if len(x.Names) == 0 && x.Tag == nil {
+			return fromWildNode(x.Type)
+		}
+	case *ast.ValueSpec:
+		// "$*_" in "const (A = iota; $*_)"
+		if len(x.Names) == 1 && x.Type == nil && x.Values == nil {
+			return fromWildNode(x.Names[0])
+		}
 	}
 	return -1
 }
@@ -1051,28 +3750,43 @@ type exprList []ast.Expr
 type identList []*ast.Ident
 type stmtList []ast.Stmt
 type specList []ast.Spec
+type fieldList []*ast.Field
+
+// altList is a pattern made of alternatives separated by "\|", which
+// matches a node if any of the alternatives does.
+type altList []ast.Node
 
 func (l exprList) len() int  { return len(l) }
 func (l identList) len() int { return len(l) }
 func (l stmtList) len() int  { return len(l) }
 func (l specList) len() int  { return len(l) }
+func (l fieldList) len() int { return len(l) }
+func (l altList) len() int   { return len(l) }
 
 func (l exprList) at(i int) ast.Node  { return l[i] }
 func (l identList) at(i int) ast.Node { return l[i] }
 func (l stmtList) at(i int) ast.Node  { return l[i] }
 func (l specList) at(i int) ast.Node  { return l[i] }
+func (l fieldList) at(i int) ast.Node { return l[i] }
+func (l altList) at(i int) ast.Node   { return l[i] }
 
 func (l exprList) slice(i, j int) nodeList  { return l[i:j] }
 func (l identList) slice(i, j int) nodeList { return l[i:j] }
 func (l stmtList) slice(i, j int) nodeList  { return l[i:j] }
 func (l specList) slice(i, j int) nodeList  { return l[i:j] }
+func (l fieldList) slice(i, j int) nodeList { return l[i:j] }
+func (l altList) slice(i, j int) nodeList   { return l[i:j] }
 
 func (l exprList) Pos() token.Pos  { return l[0].Pos() }
 func (l identList) Pos() token.Pos { return l[0].Pos() }
 func (l stmtList) Pos() token.Pos  { return l[0].Pos() }
 func (l specList) Pos() token.Pos  { return l[0].Pos() }
+func (l fieldList) Pos() token.Pos { return l[0].Pos() }
+func (l altList) Pos() token.Pos   { return l[0].Pos() }
 
 func (l exprList) End() token.Pos  { return l[len(l)-1].End() }
 func (l identList) End() token.Pos { return l[len(l)-1].End() }
 func (l stmtList) End() token.Pos  { return l[len(l)-1].End() }
 func (l specList) End() token.Pos  { return l[len(l)-1].End() }
+func (l fieldList) End() token.Pos { return l[len(l)-1].End() }
+func (l altList) End() token.Pos   { return l[len(l)-1].End() }
@@ -4,8 +4,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"go/ast"
+	"go/build"
 	"go/importer"
 	"go/token"
 	"go/types"
@@ -20,6 +22,43 @@ func parseErr(msg string) wantErr { return wantErr("cannot parse expr: " + msg)
 
 type wantSrc string
 
+func TestPatternError(t *testing.T) {
+	tests := []struct {
+		pattern   string
+		offset    int
+		line, col int
+		kind      string
+	}{
+		{"foo)", 3, 1, 4, "BlockStmt"},
+		{"$x(", 3, 1, 4, "CallExpr"},
+		{"f(a,\n\tb[)", 8, 2, 4, "IndexExpr"},
+		{"a\nb\n$x)", 6, 3, 3, "BlockStmt"},
+		{"{", 1, 1, 2, ""},
+	}
+	for _, tc := range tests {
+		m := matcher{}
+		_, _, err := m.parseCmds([]string{"-x", tc.pattern})
+		var perr *PatternError
+		if !errors.As(err, &perr) {
+			t.Errorf("%q: wanted a PatternError, got %v", tc.pattern, err)
+			continue
+		}
+		if perr.Pattern != tc.pattern {
+			t.Errorf("%q: wanted the pattern, got %q", tc.pattern, perr.Pattern)
+		}
+		if perr.Offset != tc.offset {
+			t.Errorf("%q: wanted offset %d, got %d", tc.pattern, tc.offset, perr.Offset)
+		}
+		if perr.Pos.Line != tc.line || perr.Pos.Column != tc.col {
+			t.Errorf("%q: wanted position %d:%d, got %d:%d", tc.pattern,
+				tc.line, tc.col, perr.Pos.Line, perr.Pos.Column)
+		}
+		if perr.Kind != tc.kind {
+			t.Errorf("%q: wanted kind %q, got %q", tc.pattern, tc.kind, perr.Kind)
+		}
+	}
+}
+
 func TestMatch(t *testing.T) {
 	tests := []struct {
 		args    []string
@@ -63,14 +102,23 @@ func TestMatch(t *testing.T) {
 			[]string{"-x", "$x", "-a", "is(slice) etc"},
 			"a", modErr(`1:11: wanted EOF, got IDENT`),
 		},
+		{
+			[]string{"-x", "$x", "-a", "missing(1)"},
+			"a", modErr(`1:9: wanted field name, got INT`),
+		},
+		{
+			[]string{"-x", "$x", "-a", "len(a)"},
+			"a", modErr(`1:5: wanted length, got IDENT`),
+		},
 
 		// expr parse errors
-		{[]string{"-x", "foo)"}, "a", parseErr(`1:4: expected statement, found ')'`)},
-		{[]string{"-x", "{"}, "a", parseErr(`1:4: expected '}', found 'EOF'`)},
-		{[]string{"-x", "$x)"}, "a", parseErr(`1:3: expected statement, found ')'`)},
-		{[]string{"-x", "$x("}, "a", parseErr(`1:5: expected operand, found '}'`)},
-		{[]string{"-x", "$*x)"}, "a", parseErr(`1:4: expected statement, found ')'`)},
-		{[]string{"-x", "a\n$x)"}, "a", parseErr(`2:3: expected statement, found ')'`)},
+		{[]string{"-x", "foo)"}, "a", parseErr(`1:4: expected statement, found ')' (in BlockStmt)`)},
+		{[]string{"-x", "{"}, "a", parseErr(`1:2: expected '}', found 'EOF'`)},
+		{[]string{"-x", "$x)"}, "a", parseErr(`1:3: expected statement, found ')' (in BlockStmt)`)},
+		{[]string{"-x", "$x("}, "a", parseErr(`1:4: expected operand, found '}' (in CallExpr)`)},
+		{[]string{"-x", "$*x)"}, "a", parseErr(`1:4: expected statement, found ')' (in BlockStmt)`)},
+		{[]string{"-x", "a\n$x)"}, "a", parseErr(`2:3: expected statement, found ')' (in BlockStmt)`)},
+		{[]string{"-x", "f(a,\n\tb[)"}, "a", parseErr(`2:4: expected operand, found ')' (in IndexExpr)`)},
 
 		// basic lits
 		{[]string{"-x", "123"}, "123", 1},
@@ -148,6 +196,30 @@ func TestMatch(t *testing.T) {
 			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "type([2]int)"},
 			"package p; var _ = []int{1, 2}", 0,
 		},
+		{
+			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "type([N]int)"},
+			"package p; const N = 2; var _ = [...]int{1, 2}", 1,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "type([N<<1 - 2]int)"},
+			"package p; const N = 2; var _ = [...]int{1, 2}", 1,
+		},
+		{
+			[]string{"-x", "var $x $_", "-a", "$x:type([md5.Size]byte)"},
+			`package p; import "crypto/md5"; var a [16]byte; var b [md5.Size]byte; var c [8]byte`, 2,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "type([M]int)"},
+			"package p; var M = 2; var _ = [...]int{1, 2}", 0,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "type([...]int)"},
+			"package p; var _ = [...]int{1, 2}", 0,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "type(1)"},
+			"package p; var _ = 1", 0,
+		},
 		{
 			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "type(*int)"},
 			"package p; var _ = int(3)", 0,
@@ -172,6 +244,78 @@ func TestMatch(t *testing.T) {
 			[]string{"-x", "$x", "-a", "type(*I)"},
 			`package p; type I int; var i *I`, 2,
 		},
+		{
+			[]string{"-x", "var $x $_", "-a", "$x:type(map[string]int)"},
+			"package p; var a map[string]int; var b map[string]int8; var c map[int]int", 1,
+		},
+		{
+			[]string{"-x", "var $x $_", "-a", "$x:type(<-chan error)"},
+			"package p; var a <-chan error; var b chan error; var c chan<- error", 1,
+		},
+		{
+			[]string{"-x", "var $x $_", "-a", "$x:type(chan (<-chan int))"},
+			"package p; var a chan (<-chan int); var b chan chan int", 1,
+		},
+		{
+			[]string{"-x", "var $x $_", "-a", "$x:type(func(string, ...int) (bool, error))"},
+			"package p; var a func(s string, n ...int) (ok bool, err error); var b func(string, []int) (bool, error)", 1,
+		},
+		{
+			[]string{"-x", "var $x $_", "-a", "$x:type(interface{ Close() error })"},
+			`package p; import "io"; var a io.Closer; var b interface{ Close() }; var c interface{ io.Closer }`, 1,
+		},
+		{
+			[]string{"-x", "var $x $_", "-a", "$x:type(struct{ T; n, m int `json:\"n\"` })"},
+			"package p; type T int; var a struct{ T; n, m int `json:\"n\"` }; var b struct{ T; n, m int }", 1,
+		},
+		{
+			[]string{"-x", "var $x $_", "-a", "$x:asgn(interface{})"},
+			"package p; var a int; var b struct{}", 2,
+		},
+		{
+			[]string{"-x", "var $x $_", "-a", "$x:type(L[int])"},
+			"package p; type L[T any] []T; var a L[int]; var b L[string]", 1,
+		},
+		{
+			[]string{"-x", "return $x", "-a", "$x:asgn(T)"},
+			"package p; func f[T any](t T, n int) T { if n > 0 { return t }; return *new(T) }", 2,
+		},
+		{
+			[]string{"-x", "$x = $_", "-a", "$x:asgn(T)"},
+			"package p; type L[T any] struct{ v T; n int }; func (l *L[T]) set(v T) { l.v = v; l.n = 1 }", 1,
+		},
+		{
+			[]string{"-x", "_ = $x", "-a", "$x:impl(cmp.Ordered)"},
+			"package p; func f[T ~int | ~string, U any](t T, u U, s string, b bool) { _ = t; _ = u; _ = s; _ = b }", 2,
+		},
+		{
+			[]string{"-x", "_ = $x", "-a", "$x:impl(fmt.Stringer)"},
+			`package p; import "fmt"; func f[T fmt.Stringer, U any](t T, u U) { _ = t; _ = u }`, 1,
+		},
+		{
+			[]string{"-x", "_ = $x", "-a", "$x:is(int)"},
+			"package p; func f[T ~int | ~int8, U ~int | ~string, V any](t T, u U, v V, n int) { _ = t; _ = u; _ = v; _ = n }", 2,
+		},
+		{
+			[]string{"-x", "_ = $x", "-a", "$x:is(interface)"},
+			"package p; func f[T any, U interface{ ~[]int }](t T, u U, e error) { _ = t; _ = u; _ = e }", 1,
+		},
+		{
+			[]string{"-x", "_ = $x", "-a", "$x:is(slice)"},
+			"package p; func f[T any, U interface{ ~[]int }](t T, u U) { _ = t; _ = u }", 1,
+		},
+		{
+			[]string{"-x", "var $x $_", "-a", "$x:type(*encoding/json.Decoder)"},
+			`package p; import "encoding/json"; var a *json.Decoder; var b json.Decoder`, 1,
+		},
+		{
+			[]string{"-x", "var $x $_", "-a", "$x:type(a.b.C)"},
+			"package p; var a int", 0,
+		},
+		{
+			[]string{"-x", "var $x $_", "-a", "$x:type(map[string]Unknown)"},
+			"package p; var a map[string]int", 0,
+		},
 
 		// type assignability
 		{
@@ -225,6 +369,48 @@ func TestMatch(t *testing.T) {
 			"package p; type I int; var i I", 1,
 		},
 
+		// objects declared in a package
+		{
+			[]string{"-x", "$f($*_)", "-a", "$f:pkg(net/http)"},
+			`package p; import ("net/http"; h "net/http"; . "net/http"; "fmt"); func f(c *http.Client) { http.Get(""); h.Get(""); Get(""); (c.Do)(nil); fmt.Println(); println() }`, 4,
+		},
+		{
+			[]string{"-x", "$x", "-a", "pkg(\"net/...\")", "-a", "!pkg(net/http)"},
+			`package p; import ("net/http"; "net/url"); var _ = url.Parse; var _ = http.Get`, 3,
+		},
+
+		// type names
+		{
+			[]string{"-x", "var $x $_", "-x", "$x", "-a", `typename("sql\\.Null.*")`},
+			`package p; import "database/sql"; var a sql.NullString; var b sql.NullInt64; var c *sql.NullBool; var d sql.DB`, 2,
+		},
+		{
+			[]string{"-x", "var $x $_", "-x", "$x", "-a", `typename("\\*?database/sql\\..*")`},
+			`package p; import "database/sql"; var a sql.NullString; var c *sql.NullBool; var d int`, 2,
+		},
+		{
+			[]string{"-x", "var $x $_", "-x", "$x", "-a", `typename("\\[\\]byte|string")`},
+			`package p; type S string; var a []byte; var b string; var c S`, 2,
+		},
+
+		// interface implementations
+		{
+			[]string{"-x", "var $x $_", "-x", "$x", "-a", "impl(error)"},
+			"package p; type E struct{}; func (E) Error() string { return \"\" }; var e E; var i int", 1,
+		},
+		{
+			[]string{"-x", "var $x $_", "-x", "$x", "-a", "impl(io.Reader)"},
+			`package p; import ("io"; "os"; "strings"); var f *os.File; var r *strings.Reader; var w io.Writer; var s string`, 2,
+		},
+		{
+			[]string{"-x", "var $x $_", "-x", "$x", "-a", "impl(fmt.Stringer)"},
+			"package p; type T struct{}; func (*T) String() string { return \"\" }; var t T; var p *T", 1,
+		},
+		{
+			[]string{"-x", "var $x $_", "-x", "$x", "-a", "impl(int)"},
+			"package p; var i int", 0,
+		},
+
 		// comparable types
 		{
 			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "comp"},
@@ -235,6 +421,440 @@ func TestMatch(t *testing.T) {
 			"package p; var _ = [...]byte{0}", 1,
 		},
 
+		{
+			[]string{"-x", "$x == $_", "-x", "$x", "-a", "comp"},
+			"package p; type T struct{ i int }; var a, b T; var _ = a == b", 1,
+		},
+		{
+			[]string{"-x", "$x == $_", "-x", "$x", "-a", "!comp"},
+			"package p; type T struct{ i int }; var a, b T; var _ = a == b", 0,
+		},
+		{
+			[]string{"-x", "$x == $_", "-x", "$x", "-a", "!comp"},
+			"package p; type T struct{ s []int }; var a, b T; var _ = interface{}(a) == interface{}(b)", 1,
+		},
+		{
+			[]string{"-x", "$x == $_", "-x", "$x", "-a", "!comp"},
+			"package p; type T struct{ i int }; var a, b T; var _ = interface{}(a) == interface{}(b)", 0,
+		},
+		{
+			[]string{"-x", "$x == $_", "-x", "$x", "-a", "!comp"},
+			"package p; type T struct{ m map[int]int }; var a T; var _ = interface{}((interface{})(a)) == nil", 1,
+		},
+		{
+			[]string{"-x", "$x == $_", "-x", "$x", "-a", "!comp"},
+			"package p; func f(a, b interface{}) bool { return a == b }", 0,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "!is(basic)"},
+			"package p; var _ = []byte{}; var _ = 3", 1,
+		},
+		{
+			[]string{"-x", "f($x)", "-x", "$x", "-a", "!rx(`foo`)"},
+			"f(foo); f(bar)", 1,
+		},
+		{
+			[]string{"-x", "$x", "-a", "!comp etc"},
+			"a", modErr(`1:7: wanted EOF, got IDENT`),
+		},
+		// attributes on wildcards and sub-patterns
+		{
+			[]string{"-x", "f($x)", "-a", "$x:!match(len($_))"},
+			"f(len(a)); f(cap(b)); f(c)", 2,
+		},
+		{
+			[]string{"-x", "f($x)", "-a", "$x:match(len($_))"},
+			"f(len(a)); f(cap(b)); f(c)", "f(len(a))",
+		},
+		{
+			[]string{"-x", "f($x, $y)", "-a", "$y:match($x + 1)"},
+			"f(a, a + 1); f(a, b + 1)", "f(a, a+1)",
+		},
+		{
+			[]string{"-x", "f($x, $y)", "-a", "$y:match($z + $z)", "-s", "g($x)"},
+			"f(a, b + b); f(a, b + c)", wantSrc("g(a); f(a, b+c)"),
+		},
+		{
+			[]string{"-x", "f($x)", "-a", "match(f(a))"},
+			"f(a); f(b)", 1,
+		},
+		{
+			[]string{"-x", "f($*x)", "-a", "$*x:match($_, $_)"},
+			"f(a, b); f(c)", 1,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-a", "$x:!is(basic)"},
+			"package p; var _ = []byte{}; var _ = 3", 1,
+		},
+		{
+			[]string{"-x", "f($x)", "-a", "$x:rx(`foo`)"},
+			"f(foo); f(bar)", 1,
+		},
+		{
+			[]string{"-x", "f($x)", "-a", "$y:comp"},
+			"f(a)", wantErr("-a $y:comp: $y was not captured"),
+		},
+		{
+			[]string{"-x", "f($x)", "-a", "$_:comp"},
+			"f(a)", wantErr("-a $_:comp: $_ captures nothing"),
+		},
+		{
+			[]string{"-x", "f($x)", "-a", "$*x:comp"},
+			"f(a)", wantErr("-a $*x:comp: $*x was captured as $x"),
+		},
+		{
+			[]string{"-x", "f($x)", "-a", "$x comp"},
+			"f(a)", modErr("1:4: wanted :"),
+		},
+		// expressions without side effects
+		{
+			[]string{"-x", "_ = $x", "-a", "$x:pure"},
+			`package p; type T int; func f(s []int, m map[int]int, c chan int, g func() int) { _ = s[0] + len(s); _ = T(m[1]); _ = func() { g() }; _ = g(); _ = <-c; _ = append(s, 1); _ = -s[len(s)-1] }`, 4,
+		},
+		{
+			[]string{"-x", "$x == $x", "-a", "$x:!pure"},
+			`package p; func f(a int, g func() int) { _ = a == a; _ = g() == g() }`, 1,
+		},
+
+		// exported names
+		{
+			[]string{"-x", "func $f() {}", "-a", "$f:exported"},
+			"package p; func Foo() {}; func bar() {}; func Ñu() {}; func ñu() {}; func _() {}", 2,
+		},
+		{
+			[]string{"-x", "$x.$_", "-a", "!exported"},
+			"package p; import \"fmt\"; type T struct{ a, B int }; var t T; var _, _ = t.a, t.B; var _ = fmt.Sprint", 1,
+		},
+
+		// nodes inside loops
+		{
+			[]string{"-x", "defer $_()", "-a", "inloop"},
+			"for { defer f() }; defer g(); for range x { if y { defer h() } }", 2,
+		},
+		{
+			[]string{"-x", "defer $_()", "-a", "inloop"},
+			"for { func() { defer f() }() }", 0,
+		},
+		{
+			[]string{"-x", "defer $_()", "-a", "inloop"},
+			"func() { for { defer f() } }", 1,
+		},
+		{
+			[]string{"-x", "defer $_()", "-a", "inloop"},
+			"for { func() { for { defer f() } }() }", 1,
+		},
+		{
+			[]string{"-x", "$_()", "-a", "inloop"},
+			"for i := f(); g(); h() { }", 0,
+		},
+		{
+			[]string{"-x", "$_()", "-a", "inloop"},
+			"for _, x := range f() { g() }", 1,
+		},
+		{
+			[]string{"-x", "append($*_)", "-a", "!inloop"},
+			"for { x = append(x, 1) }; x = append(x, 2)", 1,
+		},
+		{
+			[]string{"-x", "$x", "-a", "inloop etc"},
+			"a", modErr(`1:8: wanted EOF, got IDENT`),
+		},
+
+		// definitions and uses of names
+		{
+			[]string{"-x", "ctx", "-a", "def"},
+			"package p; var ctx int; func f() { _ = ctx; { ctx := 1; _ = ctx }; for ctx := range []int{} { _ = ctx } }", 3,
+		},
+		{
+			[]string{"-x", "ctx", "-a", "use"},
+			"package p; var ctx int; func f() { _ = ctx; { ctx := 1; _ = ctx } }", 2,
+		},
+		{
+			[]string{"-x", "$x", "-a", "def", "-a", "use"},
+			"package p; func f(a int) int { return a }", 0,
+		},
+		{
+			[]string{"-x", "$x := $_", "-a", "$x:def"},
+			"package p; func f() (a int) { b := 1; a, c := b, 2; _ = c; return }", 1,
+		},
+
+		// method expressions, method values and method calls
+		{
+			[]string{"-x", "$x.$_", "-a", "methodexpr"},
+			"package p; type T int; func (T) M() {}; func f(t T) { t.M(); _ = t.M; _ = T.M }", 1,
+		},
+		{
+			[]string{"-x", "$x.$_", "-a", "methodvalue"},
+			"package p; type T int; func (T) M() {}; func f(t T) { t.M(); _ = t.M; _ = T.M }", 1,
+		},
+		{
+			[]string{"-x", "$x.$_", "-a", "methodcall"},
+			"package p; type T int; func (T) M() {}; func f(t T) { t.M(); (t.M)(); _ = t.M; _ = T.M }", 2,
+		},
+		{
+			[]string{"-x", "$_($*_)", "-a", "methodcall"},
+			"package p; type T int; func (T) M() {}; func f(t T) { t.M(); T.M(t); f(t) }", 1,
+		},
+		{
+			[]string{"-x", "$x.$_", "-a", "methodvalue"},
+			"package p; import \"strings\"; type T struct{ f int }; func f(t T) { _ = t.f; _ = strings.Title }", 0,
+		},
+
+		// kinds of objects that names refer to
+		{
+			[]string{"-x", "$x", "-a", "obj(const)"},
+			"package p; const c = 1; var v = 2; func f() int { return c + v }", 2,
+		},
+		{
+			[]string{"-x", "$x + $_", "-a", "$x:obj(var)"},
+			"package p; const c = 1; var v = 2; var _, _ = c + v, v + c", 1,
+		},
+		{
+			[]string{"-x", "$x", "-a", "obj(pkgname)"},
+			"package p; import \"math\"; var _ = math.Pi", 1,
+		},
+		{
+			[]string{"-x", "$x.$_", "-a", "obj(const)"},
+			"package p; import \"math\"; var _, _ = math.Pi, math.Abs", 1,
+		},
+		{
+			[]string{"-x", "$x", "-a", "obj(label)"},
+			"package p; func f() { l: for { break l } }", 2,
+		},
+		{
+			[]string{"-x", "$x", "-a", "obj(type)"},
+			"package p; type T int; func f(T) {}", 2,
+		},
+		{
+			[]string{"-x", "$x", "-a", "obj(func)"},
+			"package p; func f() { f() }", 2,
+		},
+		{
+			[]string{"-x", "$x", "-a", "obj(foo)"},
+			"a", modErr(`1:5: unknown object kind: "foo"`),
+		},
+
+		// nodes at the top level or inside defers
+		{
+			[]string{"-x", "$_()", "-a", "toplevel"},
+			"package p; var a = f(); func g() { h() }; var b = func() int { return i() }()", 2,
+		},
+		{
+			[]string{"-x", "func $_() { $*_ }", "-a", "toplevel"},
+			"package p; func f() {}; var g = func() {}; func h() { _ = func() {} }", 2,
+		},
+		{
+			[]string{"-x", "recover()", "-a", "indefer"},
+			"defer func() { recover() }(); recover(); defer g(recover()); defer func() { func() { recover() }() }()", 2,
+		},
+		{
+			[]string{"-x", "recover()", "-a", "!indefer"},
+			"defer func() { recover() }(); recover(); go func() { recover() }()", 2,
+		},
+		// calls with unused results
+		{
+			[]string{"-x", "$f($*_)", "-a", "unusedresult"},
+			"package p; func f() {}; func g() error { return nil }; func _() { f(); g() }", 1,
+		},
+		{
+			[]string{"-x", "$f($*_)", "-a", "unusedresult"},
+			"package p; func f() (int, error) { return 0, nil }; func _() { f(); _, _ = f() }", 1,
+		},
+		{
+			[]string{"-x", "$f($*_)", "-a", "unusedresult"},
+			"package p; func f() error { return nil }; func _() { defer f(); go f(); if f() != nil {} }", 0,
+		},
+		{
+			[]string{"-x", "$f($*_)", "-a", "unusedresult"},
+			"package p; func _(a, b []int) { copy(a, b); print(a) }", 0,
+		},
+		{
+			[]string{"-x", "$f($*_)", "-a", "unusedresult"},
+			"package p; type T struct{}; func (T) m() bool { return true }; func _(t T) { t.m(); func() int { return 1 }() }", 2,
+		},
+		{
+			[]string{"-x", "$f($*_)", "-a", "!unusedresult"},
+			"package p; func f() {}; func g() error { return nil }; func _() { f(); g() }", 1,
+		},
+		{
+			[]string{"-x", "$f($*_)", "-a", "unusedresult"},
+			`package p; import "os"; func _() { os.Remove("x"); (os.Remove("y")); ((os.Remove))("z"); _ = os.Remove("w") }`, 3,
+		},
+		{
+			[]string{"-x", "os.Remove($_)", "-a", "unusedresult"},
+			`package p; import "os"; func _() { os.Remove("x"); (os.Remove("y")); if err := os.Remove("z"); err != nil {} }`, 2,
+		},
+		// fmt.Sprintf calls that just concatenate
+		{
+			[]string{"-x", "fmt.Sprintf($*_)", "-a", "fmtconcat"},
+			`package p; import "fmt"; func f(a, b string) { _ = fmt.Sprintf("%s%s", a, b); _ = fmt.Sprintf(` + "`%s`" + `, a) }`, 2,
+		},
+		{
+			[]string{"-x", "fmt.Sprintf($*_)", "-a", "fmtconcat"},
+			`package p; import "fmt"; func f(a, b string) { _ = fmt.Sprintf("%s", "lit"); _ = fmt.Sprintf("%s", a+b) }`, 2,
+		},
+		{
+			[]string{"-x", "fmt.Sprintf($*_)", "-a", "fmtconcat"},
+			`package p; import "fmt"; func f(a, b string) { _ = fmt.Sprintf("%s-%s", a, b); _ = fmt.Sprintf("%5s", a); _ = fmt.Sprintf("%%s", a) }`, 0,
+		},
+		{
+			[]string{"-x", "fmt.Sprintf($*_)", "-a", "fmtconcat"},
+			`package p; import "fmt"; func f(a string, b []interface{}) { _ = fmt.Sprintf("%s%s", a); _ = fmt.Sprintf("%s"); _ = fmt.Sprintf("%s%s", b...) }`, 0,
+		},
+		{
+			[]string{"-x", "fmt.Sprintf($*_)", "-a", "fmtconcat"},
+			`package p; import "fmt"; type S string; func f(a string, b S, err error) { _ = fmt.Sprintf("%s%s", a, b); _ = fmt.Sprintf("%s", err); _ = fmt.Sprintf("%d", 3) }`, 0,
+		},
+		{
+			[]string{"-x", "$_.Sprintf($*_)", "-a", "fmtconcat"},
+			`package p; import "fmt"; type T struct{}; func (T) Sprintf(string, ...interface{}) string { return "" }; func f(t T, a string) { _ = t.Sprintf("%s", a); _ = fmt.Sprintf("%s", a) }`, 1,
+		},
+		// conversions that do nothing
+		{
+			[]string{"-x", "$_($_)", "-a", "noopconv"},
+			"package p; type I int; func f(x int, i I) { _ = int(x); _ = I(i); _ = (int)(x); _ = int(i); _ = I(x) }", 3,
+		},
+		{
+			[]string{"-x", "$_($_)", "-a", "noopconv"},
+			"package p; const c = 3; func f() { _ = int(3); _ = int(c); _ = int(1 + c); _ = float64(-c); _ = string(\"x\"); _ = bool(true) }", 0,
+		},
+		{
+			[]string{"-x", "$_($_)", "-a", "noopconv"},
+			"package p; const d int = 4; func f() { _ = int(d); _ = int(d + 1) }", 2,
+		},
+		{
+			[]string{"-x", "$_($_)", "-a", "noopconv"},
+			"package p; func f(s []byte, g func(int) int) { _ = []byte(s); _ = g(3); _ = len(s) }", 1,
+		},
+		// func literals capturing loop variables
+		{
+			[]string{"-x", "go $_($*_)", "-a", "loopvar"},
+			"package p; func f(xs []int) { for i, x := range xs { go func() { print(i) }(); go func() { print(x) }() } }", 2,
+		},
+		{
+			[]string{"-x", "go $_($*_)", "-a", "loopvar"},
+			"package p; func f(xs []int) { for i := range xs { print(i); go func() { for i := range xs { print(i) } }() } }", 0,
+		},
+		{
+			[]string{"-x", "go $_($*_)", "-a", "loopvar"},
+			"package p; func f(xs []int) { for i := range xs { func() { go func() { print(i) }() }() } }", 1,
+		},
+		{
+			[]string{"-x", "$_($*_)", "-a", "loopvar"},
+			"package p; func f(xs []int) { for i := 0; i < len(xs); i++ { print(i) } }", 0,
+		},
+		// interface parameters that could be narrower
+		{
+			[]string{"-x", "$x", "-a", "narrowable"},
+			`package p; import "io"; var _ = func(rc io.ReadCloser) { rc.Close() }`, 1,
+		},
+		{
+			[]string{"-x", "$x", "-a", "narrowable"},
+			`package p; import "io"; func f(rc io.ReadCloser) { defer rc.Close(); rc.Read(nil) }`, 0,
+		},
+		{
+			[]string{"-x", "$x", "-a", "narrowable"},
+			`package p; import "io"; func f(rc io.ReadCloser) { var r io.Reader = rc; r.Read(nil) }`, 0,
+		},
+		{
+			[]string{"-x", "$x", "-a", "narrowable"},
+			`package p; func f(v interface{}) bool { _, ok := v.(int); return ok && v != nil }`, 0,
+		},
+		{
+			[]string{"-x", "$x", "-a", "narrowable"},
+			`package p; type I interface{ M() }; func f(i I) { i.M() }`, 0,
+		},
+		{
+			[]string{"-x", "$x", "-a", "narrowable"},
+			`package p; import "io"; func f() (rc io.ReadCloser) { rc.Close(); return }`, 0,
+		},
+		// assignments boxing concrete values into interfaces
+		{
+			[]string{"-x", "$_ = $_", "-a", "boxing"},
+			`package p; func f(x interface{}, y int) { x = y; _ = x }`, 1,
+		},
+		{
+			[]string{"-x", "$_ = $_", "-a", "boxing"},
+			`package p; import "io"; func f(r io.Reader, rc io.ReadCloser) { r = rc; _ = r }`, 0,
+		},
+		{
+			[]string{"-x", "$_ = $_", "-a", "boxing"},
+			`package p; import "io"; func f(r io.Reader) { r = nil; _ = r }`, 0,
+		},
+		{
+			[]string{"-x", "$*_ = $*_", "-a", "boxing"},
+			`package p; func f(a, b interface{}, s string) { a, b = b, s; _, _ = a, b }`, 1,
+		},
+		{
+			[]string{"-x", "$*_ = $*_", "-a", "boxing"},
+			`package p; func f(a, b interface{}) { a, b = g(); _, _ = a, b }; func g() (error, int) { return nil, 0 }`, 1,
+		},
+		{
+			[]string{"-x", "$*_ = $*_", "-a", "boxing"},
+			`package p; func f(a, b interface{}) { a, b = g(); _, _ = a, b }; func g() (error, error) { return nil, nil }`, 0,
+		},
+		{
+			[]string{"-x", "var $x $t = $v", "-a", "boxing"},
+			`package p; import "fmt"; var s fmt.Stringer = t(0); type t int; func (t) String() string { return "" }`, 1,
+		},
+		{
+			[]string{"-x", "var $x $t = $v", "-a", "boxing"},
+			`package p; var x interface{} = 3`, 1,
+		},
+		{
+			[]string{"-x", "var $x = $v", "-a", "!boxing"},
+			`package p; var x = 3`, 1,
+		},
+		// redundant zero value initializations
+		{
+			[]string{"-x", "var $_ $_ = $_", "-a", "zeroinit"},
+			`package p; var a int = 0; var b float64 = 0.0; var c string = ""; var d bool = false; var e complex64 = 0i`, 5,
+		},
+		{
+			[]string{"-x", "var $_ $_ = $_", "-a", "zeroinit"},
+			`package p; var a int = 1; var b string = "x"; var c bool = true; var d *int = new(int)`, 0,
+		},
+		{
+			[]string{"-x", "var $_ $_ = $_", "-a", "zeroinit"},
+			`package p; var a *int = nil; var b error = (nil); var c []int = nil; var d map[int]int = nil; var e chan int = nil; var f func() = nil`, 6,
+		},
+		{
+			[]string{"-x", "$*_ := $*_", "-a", "zeroinit"},
+			`package p; type T struct{ x int }; func f() { a, b := T{}, [2]int{}; c := map[int]int{}; d := []int{}; _, _, _, _ = a, b, c, d }`, 1,
+		},
+		{
+			[]string{"-x", "$*_ := $*_", "-a", "zeroinit"},
+			`package p; type S string; const zero S = ""; func f() { s := zero; n := 0; x, y := 0, 1; _, _, _, _ = s, n, x, y }`, 2,
+		},
+		{
+			[]string{"-x", "$_ = $_", "-a", "zeroinit"},
+			`package p; func f(n int) { n = 0; _ = n }`, 0,
+		},
+		// range loops by what they iterate over
+		{
+			[]string{"-x", "for $*_ { $*_ }", "-a", "range(slice)"},
+			"package p; func f(s []int, a [2]int, m map[int]int) { for range s {}; for range a {}; for range m {} }", 1,
+		},
+		{
+			[]string{"-x", "for $*_ { $*_ }", "-a", "range(array)"},
+			"package p; func f(a [2]int, p *[2]int, s []int) { for range a {}; for range p {}; for range s {} }", 2,
+		},
+		{
+			[]string{"-x", "for $*_ { $*_ }", "-a", "range(map)"},
+			"package p; type M map[string]bool; func f(m M, s []int) { for k := range m { _ = k }; for range s {} }", 1,
+		},
+		{
+			[]string{"-x", "for $*_ { $*_ }", "-a", "range(chan)"},
+			"package p; func f(c chan int, s string) { for v := range c { _ = v }; for range s {} }", 1,
+		},
+		{
+			[]string{"-x", "for $*_ { $*_ }", "-a", "range(string)"},
+			"package p; type S string; func f(s string, t S, b []byte) { for range s {}; for range t {}; for range b {} }", 2,
+		},
+		{
+			[]string{"-x", "$x", "-a", "range(foo)"},
+			"a", modErr(`1:7: unknown range kind: "foo"`),
+		},
 		// addressable expressions
 		{
 			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "addr"},
@@ -245,6 +865,42 @@ func TestMatch(t *testing.T) {
 			"package p; var s struct { i int }; var _ = s.i", 1,
 		},
 
+		// constant expressions
+		{
+			[]string{"-x", "time.Sleep($x)", "-a", "$x:const"},
+			`package p; import "time"; const d = time.Second; var v time.Duration; func f() { time.Sleep(2 * time.Second); time.Sleep(d); time.Sleep(v) }`, 2,
+		},
+		{
+			[]string{"-x", "make($_, $x)", "-a", "$x:!const"},
+			`package p; func f(n int) { _ = make([]int, 8); _ = make([]int, n); _ = make([]int, len("abc")) }`, 1,
+		},
+		{
+			[]string{"-x", "$x", "-a", "const", "-a", "is(basic)"},
+			`package p; var s = "a" + "b"`, 3,
+		},
+
+		// nil and types that can be nil
+		{
+			[]string{"-x", "return $x", "-a", "$x:isnil"},
+			`package p; func f() error { return nil }; func g() error { var err error; return err }; func h() *int { return (nil) }`, 2,
+		},
+		{
+			[]string{"-x", "$x != nil", "-a", "$x:!isnil"},
+			`package p; var a *int; var _ = a != nil`, 1,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-a", "$x:nilable"},
+			`package p; import "unsafe"; var a *int; var b []int; var c map[int]int; var d chan int; var e func(); var f error; var g unsafe.Pointer; var _ = a; var _ = b; var _ = c; var _ = d; var _ = e; var _ = f; var _ = g`, 7,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-a", "$x:nilable"},
+			`package p; type S []int; var a int; var b string; var c [2]int; var d struct{}; var e S; var _ = a; var _ = b; var _ = c; var _ = d; var _ = e`, 1,
+		},
+		{
+			[]string{"-x", "_ = $x", "-a", "$x:nilable"},
+			`package p; func f[T any](t T, err error) { _ = t; _ = err }`, 1,
+		},
+
 		// underlying types
 		{
 			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(basic)"},
@@ -255,74 +911,363 @@ func TestMatch(t *testing.T) {
 			"package p; var _ = 3", 1,
 		},
 		{
-			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(basic)"},
-			`package p; import "io"; var _ = io.SeekEnd`, 1,
+			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(basic)"},
+			`package p; import "io"; var _ = io.SeekEnd`, 1,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(array)"},
+			"package p; var _ = []byte{}", 0,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(array)"},
+			"package p; var _ = [...]byte{}", 1,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(slice)"},
+			"package p; var _ = []byte{}", 1,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(slice)"},
+			"package p; var _ = [...]byte{}", 0,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(struct)"},
+			"package p; var _ = []byte{}", 0,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(struct)"},
+			"package p; var _ = struct{}{}", 1,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(interface)"},
+			"package p; var _ = struct{}{}", 0,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(interface)"},
+			"package p; var _ = interface{}(nil)", 1,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(pointer)"},
+			"package p; var _ = []byte{}", 0,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(pointer)"},
+			"package p; var _ = new(byte)", 1,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(func)"},
+			"package p; var _ = []byte{}", 0,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(func)"},
+			"package p; var _ = func() {}", 1,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(map)"},
+			"package p; var _ = []byte{}", 0,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(map)"},
+			"package p; var _ = map[int]int{}", 1,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(chan)"},
+			"package p; var _ = []byte{}", 0,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(chan)"},
+			"package p; var _ = make(chan int)", 1,
+		},
+		{
+			[]string{"-x", "var $x $_", "-x", "$x", "-a", "is(string)"},
+			"package p; type S string; var a string; var b S; var c []byte; var d rune", 2,
+		},
+		{
+			[]string{"-x", "var $x $_", "-x", "$x", "-a", "is(int)"},
+			"package p; type D int64; var a int; var b uint8; var c D; var d float64", 3,
+		},
+		{
+			[]string{"-x", "var $x $_", "-x", "$x", "-a", "is(unsigned)"},
+			"package p; var a int; var b uint8; var c uintptr; var d float64", 2,
+		},
+		{
+			[]string{"-x", "var $x $_", "-x", "$x", "-a", "is(signed)"},
+			"package p; var a int; var b uint8; var c int32; var d float64", 2,
+		},
+		{
+			[]string{"-x", "var $x $_", "-x", "$x", "-a", "is(float)"},
+			"package p; var a float32; var b complex64; var c int", 1,
+		},
+		{
+			[]string{"-x", "var $x $_", "-x", "$x", "-a", "is(complex)"},
+			"package p; var a float32; var b complex64; var c int", 1,
+		},
+		{
+			[]string{"-x", "$x == $_", "-a", "$x:is(bool)"},
+			"package p; type B bool; var a, b B; var c, d int; var _ = a == b; var _ = c == d; var _ = true == false", 2,
+		},
+		{
+			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(int)"},
+			"package p; var _ = 3", 1,
+		},
+
+		// number of elements
+		{
+			[]string{"-x", "append($*_)", "-a", "len(2)"},
+			"append(a); append(a, b); append(a, b, c)", 1,
+		},
+		{
+			[]string{"-x", "fmt.Printf($*_)", "-a", "len(>=2)"},
+			`fmt.Printf("a"); fmt.Printf("%d", 1); fmt.Printf("%d %d", 1, 2)`, 2,
+		},
+		{
+			[]string{"-x", "f($*_)", "-a", "len(!=1)"},
+			"f(); f(a); f(a, b)", 2,
+		},
+		{
+			[]string{"-x", "f($*args)", "-a", "len(1)"},
+			"f(a); f(s...); f(a, s...)", 2,
+		},
+		{
+			[]string{"-x", "{ $*_; b() }", "-a", "len(<2)"},
+			"{ b() }; { a(); b() }", 1,
+		},
+		{
+			[]string{"-x", "$_{$*_}", "-a", "len(>0)"},
+			"T{}; T{a}", 1,
+		},
+		{
+			[]string{"-x", "func $_() { $*_ }", "-a", "stmts(>=3)"},
+			"package p; func f() { a(); if b { c() } }; func g() { a() }", 1,
+		},
+		{
+			[]string{"-x", "func() { $*body }", "-a", "$*body:stmts(3)"},
+			"func() { a(); for { b() } }; func() { a(); b() }; func() { a(); func() { b() }() }", 2,
+		},
+		{
+			[]string{"-x", "switch $_ { case $_: $*body }", "-a", "$*body:stmts(0)"},
+			"switch x { case 1: }; switch x { case 2: a() }", 1,
+		},
+		{
+			[]string{"-x", "$x", "-a", "stmts(1)"},
+			"a + b", 0,
+		},
+
+		// comparing repeated wildcards by object
+		{
+			[]string{"-x", "$_{$x: $x}"},
+			"package p; type T struct{ a int }; func f(a int) T { return T{a: a} }",
+			1,
+		},
+		{
+			[]string{"-equal", "typed", "-x", "$_{$x: $x}"},
+			"package p; type T struct{ a int }; func f(a int) T { return T{a: a} }",
+			0,
+		},
+		{
+			[]string{"-equal", "typed", "-x", "$x = $x"},
+			"package p; func f(a, b int) { a = a; a = b }",
+			1,
+		},
+		{
+			[]string{"-x", "$x.n++; { $_ := $_; $x.n++; $*_ }"},
+			"package p; type T struct{ n int }; func f(p, q *T) { p.n++; { p := q; p.n++ } }",
+			1,
+		},
+		{
+			[]string{"-equal", "typed", "-x", "$x.n++; { $_ := $_; $x.n++; $*_ }"},
+			"package p; type T struct{ n int }; func f(p, q *T) { p.n++; { p := q; p.n++ } }",
+			0,
+		},
+		{
+			[]string{"-equal", "typed", "-x", "$x.n++; { $_ := $_; $x.n++; $*_ }"},
+			"package p; type T struct{ n int }; func f(p *T) { p.n++; { q := p; p.n++; q.n++ } }",
+			1,
+		},
+		{
+			[]string{"-equal", "typed", "-x", "g($*x); g($*x)"},
+			"package p; func g(...int) {}; func f(a, b int) { g(a, b); g(a, b); { a := 1; g(a, b) } }",
+			1,
+		},
+		// normalizations
+		{[]string{"-x", "f(x)"}, "f(x); f((x)); f(((x)))", 1},
+		{[]string{"-norm", "paren", "-x", "f(x)"}, "f(x); f((x)); f(((x)))", 3},
+		{[]string{"-norm", "paren", "-x", "(a + b) * c"}, "(a + b) * c; a + b*c", 1},
+		{[]string{"-norm", "paren", "-x", "f(($x))"}, "f(a); f((b))", 2},
+		{[]string{"-norm", "paren", "-x", "$x"}, "(a)", "a"},
+		{[]string{"-norm", "paren", "-x", "f($x)", "-s", "g($x)"}, "f((a)); f(b)", wantSrc("g(a); g(b)")},
+		{
+			[]string{"-norm", "conv", "-x", "f($x)", "-a", "$x:is(int)"},
+			"package p; func f(interface{}) {}; func g(i int, u uint) { f(int(i)); f(int(u)); f(i) }",
+			3,
+		},
+		{
+			[]string{"-norm", "conv", "-x", "f(i)"},
+			"package p; func f(interface{}) {}; func g(i int, u uint) { f(int(i)); f(int(u)); f(i) }",
+			2,
+		},
+		{
+			[]string{"-norm", "paren,conv", "-x", "f(i)"},
+			"package p; func f(interface{}) {}; func g(i int) { f((int(i))); f(int((i))) }",
+			2,
+		},
+		{
+			[]string{"-norm", "conv", "-x", "f(3)"},
+			"package p; func f(interface{}) {}; func g() { f(int(3)) }",
+			0,
+		},
+		{[]string{"-x", "T{b: 2, a: 1}"}, "T{a: 1, b: 2}", 0},
+		{[]string{"-norm", "keyed", "-x", "T{b: 2, a: 1}"}, "T{a: 1, b: 2}; T{a: 1, b: 2, c: 3}; T{b: 1, a: 2}", 1},
+		{[]string{"-norm", "keyed", "-x", "T{b: $x, $*_}"}, "T{a: 1, b: 2}; T{b: 3}; T{a: 4}", 2},
+		{[]string{"-norm", "keyed", "-x", "T{$*_, b: $_, $*_}"}, "T{a: 1, b: 2, c: 3}; T{c: 3}", 1},
+		{[]string{"-norm", "keyed", "-x", "T{$k: $x, b: $x}"}, "T{b: 1, a: 1}; T{b: 1, a: 2}", 1},
+		{[]string{"-norm", "keyed", "-x", "T{a: $x, b: 2}", "-s", "T{a: $x}"}, "x = T{b: 2, a: f()}", wantSrc("x = T{a: f()}")},
+		{[]string{"-norm", "keyed", "-x", "T{b: 2, $*x}"}, "T{a: 1, b: 2}", 0},
+		{[]string{"-norm", "keyed", "-x", "T{2, 1}"}, "T{1, 2}", 0},
+		{[]string{"-norm", "parens", "-x", "a"}, "a", wantErr(`-norm parens: unknown normalization "parens"`)},
+
+		// literals by constant value
+		{
+			[]string{"-x", "1024"},
+			"package p; const kb = 1024; var _ = 1 << 10; var _ = 0x400; var _ = kb",
+			1,
+		},
+		{
+			[]string{"-constval", "-x", "1024"},
+			"package p; const kb = 1024; var _ = 1 << 10; var _ = 0x400; var _ = kb",
+			4,
+		},
+		{
+			[]string{"-constval", "-x", "f(2)"},
+			"package p; func f(float64) {}; func g() { f(2.0); f(1 + 1); f(3) }",
+			2,
+		},
+		{
+			[]string{"-constval", "-x", `"ab"`},
+			`package p; var _ = "a" + "b"; var _ = 'a'; var _ = "b"`,
+			1,
+		},
+		{
+			[]string{"-constval", "-x", "97"},
+			`package p; var _ = 'a'; var _ = "a"`,
+			1,
+		},
+		// qualified identifiers by package
+		{
+			[]string{"-x", "fmt.Println($*_)"},
+			`package p; import ("fmt"; f "fmt"; . "fmt"); func g() { fmt.Println(); f.Println(); Println() }`,
+			1,
+		},
+		{
+			[]string{"-aliases", "-x", "fmt.Println($*_)"},
+			`package p; import ("fmt"; f "fmt"; . "fmt"); func g() { fmt.Println(); f.Println(); Println() }`,
+			3,
+		},
+		{
+			[]string{"-aliases", "-x", "fmt.$f"},
+			`package p; import f "fmt"; type T struct{ Println int }; func g(fmt T) { f.Println(); _ = fmt.Println }`,
+			2,
+		},
+		{
+			[]string{"-aliases", "-x", "os.Exit($_)"},
+			`package p; import (os "fmt"; exit "os"); func g() { exit.Exit(1); os.Errorf("") }`,
+			"exit.Exit(1)",
 		},
+		// selectors through embedded fields
 		{
-			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(array)"},
-			"package p; var _ = []byte{}", 0,
+			[]string{"-x", "s.Close()"},
+			`package p; import "os"; type S struct{ *os.File }; func f(s S) { s.File.Close(); s.Close() }`,
+			1,
 		},
 		{
-			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(array)"},
-			"package p; var _ = [...]byte{}", 1,
+			[]string{"-promoted", "-x", "s.Close()"},
+			`package p; import "os"; type S struct{ *os.File }; func f(s S) { s.File.Close(); s.Close() }`,
+			2,
 		},
 		{
-			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(slice)"},
-			"package p; var _ = []byte{}", 1,
+			[]string{"-promoted", "-x", "d.Close"},
+			`package p; import "os"; type S struct{ *os.File }; type D struct{ S }; func f(d D) { _ = d.S.File.Close; _ = d.S.Close; _ = d.S.File }`,
+			2,
 		},
 		{
-			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(slice)"},
-			"package p; var _ = [...]byte{}", 0,
+			[]string{"-promoted", "-x", "$x.Close()", "-a", "$x:is(struct)"},
+			`package p; import "os"; type S struct{ *os.File }; func f(s S, f *os.File) { s.File.Close(); f.Close() }`,
+			"s.File.Close()",
 		},
 		{
-			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(struct)"},
-			"package p; var _ = []byte{}", 0,
+			[]string{"-promoted", "-x", "s.Close()"},
+			`package p; import "os"; type S struct{ *os.File; Close func() }; func f(s S) { s.File.Close() }`,
+			0,
 		},
 		{
-			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(struct)"},
-			"package p; var _ = struct{}{}", 1,
+			[]string{"-promoted", "-x", "s.Name()"},
+			`package p; import "os"; type S struct{ F *os.File }; func f(s S) { s.F.Name() }`,
+			0,
 		},
+		// commutative operands
+		{[]string{"-commutative", "-x", "$x == nil"}, "a == nil; nil == b; c != nil", 2},
+		{[]string{"-commutative", "-x", "a + $x"}, "a + b; c + a; a - d; e - a", 2},
+		{[]string{"-commutative", "-x", "$x - a"}, "a - b; b - a", 1},
+		{[]string{"-commutative", "-x", "$x * $x"}, "a * a; a * b", 1},
+		{[]string{"-commutative", "-x", "f($x) == $x"}, "a == f(a); f(b) == b; f(c) == d", 2},
+		{[]string{"-commutative", "-x", "$x == nil", "-s", "nil == $x"}, "a == nil; nil == b", wantSrc("nil == a; nil == b")},
+		{[]string{"-x", "$x == nil"}, "a == nil; nil == b", 1},
 		{
-			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(interface)"},
-			"package p; var _ = struct{}{}", 0,
+			[]string{"-commutative", "-x", "$x + \"a\"", "-a", "$x:is(basic)"},
+			`package p; var s = "b"; var _ = s + "a"; var _ = "a" + s`, 1,
 		},
 		{
-			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(interface)"},
-			"package p; var _ = interface{}(nil)", 1,
+			[]string{"-commutative", "-x", "$x + 1", "-a", "$x:is(basic)"},
+			`package p; var n = 2; var _ = n + 1; var _ = 1 + n`, 2,
 		},
+		// boolean normalization
+		{[]string{"-x", "!a || !b"}, "!(a && b)", 0},
+		{[]string{"-boolean-normalize", "-x", "!a || !b"}, "!(a && b)", 1},
+		{[]string{"-boolean-normalize", "-x", "!(a && b)"}, "!a || !b", 1},
+		{[]string{"-boolean-normalize", "-x", "!a && !b"}, "!(a || b)", 1},
+		{[]string{"-boolean-normalize", "-x", "!($x || $y)"}, "!foo() && !bar", 1},
+		{[]string{"-boolean-normalize", "-x", "!a && b"}, "!(a || b)", 0},
+		{[]string{"-boolean-normalize", "-x", "a != b"}, "!(a == b)", 1},
+		{[]string{"-boolean-normalize", "-x", "!($x == $y)"}, "a != b", 1},
+		{[]string{"-boolean-normalize", "-x", "a == b"}, "!((a != b))", 1},
+		{[]string{"-boolean-normalize", "-x", "a >= b"}, "!(a < b)", 0},
+		{[]string{"-boolean-normalize", "-x", "a"}, "!!a", 2},
+		{[]string{"-boolean-normalize", "-x", "!a"}, "!!!a", 2},
+		{[]string{"-boolean-normalize", "-x", "a || b != c"}, "!(!a && b == c)", 1},
+		{[]string{"-boolean-normalize", "-x", "!$x"}, "!(a && b)", "!(a && b)"},
+		// missing struct fields
 		{
-			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(pointer)"},
-			"package p; var _ = []byte{}", 0,
+			[]string{"-x", "$_{$*_}", "-a", "missing(B)"},
+			"package p; type T struct{ A, B int }; var _ = T{A: 1}", 1,
 		},
 		{
-			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(pointer)"},
-			"package p; var _ = new(byte)", 1,
+			[]string{"-x", "$_{$*_}", "-a", "missing(B)"},
+			"package p; type T struct{ A, B int }; var _ = T{A: 1, B: 2}", 0,
 		},
 		{
-			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(func)"},
-			"package p; var _ = []byte{}", 0,
+			[]string{"-x", "$_{$*_}", "-a", "missing(B)"},
+			"package p; type T struct{ A, B int }; var _ = T{1, 2}", 0,
 		},
 		{
-			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(func)"},
-			"package p; var _ = func() {}", 1,
+			[]string{"-x", "$_{$*_}", "-a", "missing(C)"},
+			"package p; type T struct{ A, B int }; var _ = T{}", 0,
 		},
 		{
-			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(map)"},
-			"package p; var _ = []byte{}", 0,
+			[]string{"-x", "$_{$*_}", "-a", "missing(B)"},
+			"package p; type E struct{ B int }; type T struct{ E; A int }; var _ = T{A: 1}", 1,
 		},
 		{
-			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(map)"},
-			"package p; var _ = map[int]int{}", 1,
+			[]string{"-x", "$_{$*_}", "-a", "missing(B)"},
+			"package p; type E struct{ B int }; type T struct{ E; A int }; var _ = T{E: E{B: 2}}", 0,
 		},
 		{
-			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(chan)"},
-			"package p; var _ = []byte{}", 0,
+			[]string{"-x", "$_{$*_}", "-a", "missing(B)"},
+			"package p; type E struct{ B int }; type T struct{ *E; A int }; var _ = T{E: &E{}}", 2,
 		},
 		{
-			[]string{"-x", "var _ = $x", "-x", "$x", "-a", "is(chan)"},
-			"package p; var _ = make(chan int)", 1,
+			[]string{"-x", "$_{$*_}", "-a", "missing(B)"},
+			"package p; type E struct{ B int }; type T struct{ E; A int }; var e E; var _ = T{E: e}", 0,
 		},
-
 		// many value expressions
 		{[]string{"-x", "$x, $y"}, "foo(1, 2)", 1},
 		{[]string{"-x", "$x, $y"}, "1", 0},
@@ -366,6 +1311,25 @@ func TestMatch(t *testing.T) {
 		{[]string{"-x", "struct{field $t}"}, "struct{field int}", 1},
 		{[]string{"-x", "struct{field $t}"}, "struct{other int}", 0},
 		{[]string{"-x", "struct{field $t}"}, "struct{f1, f2 int}", 0},
+		{[]string{"-x", "struct{field $t}"}, "struct{field int `json:\"f\"`}", 1},
+		{[]string{"-x", "struct{field $t `json:\"f\"`}"}, "struct{field int `json:\"f\"`}", 1},
+		{[]string{"-x", "struct{field $t `json:\"f\"`}"}, "struct{field int `json:\"g\"`}", 0},
+		{[]string{"-x", "struct{field $t `json:\"f\"`}"}, "struct{field int}", 0},
+		{
+			[]string{"-x", "$x", "-a", `tag("json", "-")`},
+			"package p; type T struct { A int `json:\"a\"`; B, C int `json:\"-\"`; D int }",
+			3,
+		},
+		{
+			[]string{"-x", "$x", "-a", "field", "-a", `!tag("json", ".*")`},
+			"package p; type T struct { A int `json:\"a\"`; B int `xml:\"b\"`; D int }; func f(x int) {}",
+			2,
+		},
+		{
+			[]string{"-x", "$x", "-a", "field", "-a", `tag("json", "\\w+,omitempty")`},
+			"package p; type T struct { A int `json:\"a,omitempty\"`; B int `json:\",omitempty\"` }",
+			"A int `json:\"a,omitempty\"`",
+		},
 		{[]string{"-x", "interface{$x() int}"}, "interface{i() int}", 1},
 		{[]string{"-x", "chan $x"}, "chan bool", 1},
 		{[]string{"-x", "<-chan $x"}, "chan bool", 0},
@@ -417,6 +1381,12 @@ func TestMatch(t *testing.T) {
 		{[]string{"-x", "append($x, $y...)"}, "append(a, bs...)", 1},
 		{[]string{"-x", "foo($x...)"}, "foo(a)", 0},
 		{[]string{"-x", "foo($x...)"}, "foo(a, b)", 0},
+		{[]string{"-x", "foo($x)"}, "foo(a...)", 0},
+		{[]string{"-x", "foo($*x)"}, "foo(a); foo(a, b...)", 2},
+		{[]string{"-x", "foo($*x...)"}, "foo(a); foo(a, b...)", 1},
+		{[]string{"-x", "foo($*x, $y)"}, "foo(a...)", 0},
+		{[]string{"-x", "foo($*x)", "-s", "bar($*x)"}, "foo(a, b...); foo(a)", wantSrc("bar(a, b...); bar(a)")},
+		{[]string{"-x", "foo($*x)", "-s", "bar(x, $*x)"}, "foo(b...); foo()", wantSrc("bar(x, b...); bar(x)")},
 
 		// forcing node to be a statement
 		{[]string{"-x", "append($*_);"}, "f(); x = append(x, a)", 0},
@@ -433,6 +1403,76 @@ func TestMatch(t *testing.T) {
 		{[]string{"-x", "b; c"}, "{b; c; d}", 1},
 		{[]string{"-x", "b; c"}, "{a; b; c}", 1},
 		{[]string{"-x", "b; c"}, "{b; b; c; c}", "b; c"},
+		{[]string{"-x", "^ b; c"}, "{b; c; d}", 1},
+		{[]string{"-x", "^ b; c"}, "{a; b; c}", 0},
+		{[]string{"-x", "b; c $"}, "{a; b; c}", 1},
+		{[]string{"-x", "b; c $"}, "{b; c; d}", 0},
+		{[]string{"-x", "^ b; c $"}, "{b; c}", 1},
+		{[]string{"-x", "^ b; c $"}, "{b; c; d}", 0},
+		{[]string{"-x", "^ b; c"}, "{a; b; c}; {b; c; d}", "b; c"},
+		{[]string{"-x", "^ b;"}, "{b; c}; {a; b}; {b}", 2},
+		{[]string{"-x", "^ x"}, "^x; x", "^x"},
+		{[]string{"-x", "^ $x"}, "^x; x; ^f()", 2},
+		{[]string{"-x", "^ f() $"}, "{f()}; {f(); a}", 1},
+		{[]string{"-x", "b $"}, "{b; c}; {a; b}; {b}", 2},
+		{[]string{"-x", "^\tb;\n"}, "{b; c}; {a; b}", 1},
+		{[]string{"-x", "^ $*_; return $_ $"}, "func f() { a(); return b }; func g() { return b; c() }", 1},
+		{[]string{"-x", "^$x"}, "^a; b", 1},
+		{[]string{"-x", "a, b $"}, "a", wantErr("cannot anchor a, b $: not a statement")},
+
+		// named patterns
+		{[]string{"-def", "errcheck=if err != nil { $*_ }", "-x", "errcheck"}, "if err != nil { return }; if err == nil {}", 1},
+		{[]string{"-def", "nilerr = err != nil", "-x", "if nilerr { $*_ }"}, "if err != nil {}; if x != nil {}", 1},
+		{[]string{"-def", "call=foo($x)", "-def", "twice=call; call", "-x", "twice"}, "foo(a); foo(a); foo(b)", "foo(a); foo(a)"},
+		{[]string{"-def", "x=foo()", "-x", "bar($x)"}, "bar(foo()); bar(b)", 2},
+		{[]string{"-def", "x=foo()", "-x", "bar(x)", "-s", "x"}, "bar(foo()); bar(x)", wantSrc("foo(); bar(x)")},
+		{[]string{"-def", "lock=$x.Lock()", "-x", "$f($*_)", "-a", "match(lock)"}, "a.Lock(); a.Unlock()", "a.Lock()"},
+		{[]string{"-def", "bitor=a | b", "-x", "bitor"}, "a; a | b", "a | b"},
+		{[]string{"-def", "sum=a + b", "-x", "sum * 2"}, "(a + b) * 2; a + b*2", "(a + b) * 2"},
+		{[]string{"-def", "sum=a + b", "-x", "sum + c"}, "a + b + c; a + (b + c)", "a + b + c"},
+		{[]string{"-def", "sum=a + b", "-x", "c - sum"}, "c - (a + b); c - a + b", "c - (a + b)"},
+		{[]string{"-def", "sum=$x + $y", "-x", "-sum"}, "-(a + b); -a + b", "-(a + b)"},
+		{[]string{"-def", "sum=a + b", "-x", "f(sum)"}, "f(a + b); f((a + b))", "f(a + b)"},
+		{[]string{"-def", "neg=-$x", "-x", "neg * 2"}, "-a * 2; -(a * 2)", "-a * 2"},
+		{[]string{"-def", "deref=*$x", "-x", "deref.f"}, "(*p).f; *p.f", "(*p).f"},
+		{[]string{"-def", "sum=a + b", "-x", "t.sum"}, "t.sum; a + b", "t.sum"},
+		{[]string{"-def", "kb=1024", "-x", "x.kb * kb"}, "x.kb * 1024; x.kb * kb", "x.kb * 1024"},
+		{[]string{"-def", "kb=1024", "-x", "T{kb: kb}"}, "T{kb: 1024}; T{1024: 1024}", "T{kb: 1024}"},
+		{[]string{"-def", "kb=1024", "-x", "kb: for { break kb }"}, "{kb: for { break kb }}", 1},
+		{[]string{"-def", "kb=1024", "-x", "s[kb:]"}, "s[1024:]; s[kb:]", "s[1024:]"},
+		{[]string{"-def", "kb=1024", "-x", "switch { case kb: }"}, "switch { case 1024: }", 1},
+		{[]string{"-def", "foo", "-x", "foo"}, "foo", wantErr("-def foo: want name=pattern")},
+		{[]string{"-def", "a.b=c", "-x", "a"}, "a", wantErr(`-def a.b=c: "a.b" is not a valid name`)},
+		{[]string{"-def", `ab=a \| b`, "-x", "ab"}, "a", wantErr(`-def ab=a \| b: cannot use alternatives`)},
+
+		// alternatives
+		{[]string{"-x", `$x.Lock() \| $x.RLock()`}, "a.Lock(); b.RLock(); c.Unlock()", 2},
+		{[]string{"-x", `a \| b`}, "a; b; c", 2},
+		{[]string{"-x", "a | b"}, "a; b; a | b", "a | b"},
+		{[]string{"-x", "$x | $y"}, "a | b; a || b; a + b", "a | b"},
+		{[]string{"-x", `f(a | b)`}, "f(a | b)", 1},
+		{[]string{"-x", "switch { case a | b: }"}, "switch { case a | b: }", 1},
+		{[]string{"-x", `a; b \| c`}, "{a; b}; {c}", 2},
+		{[]string{"-x", `^ a \| b $`}, "{a}; {b}; {b; c}", 2},
+		{[]string{"-x", `$x = nil \| $x := nil`}, "a = nil; b := nil; c = d", 2},
+		{[]string{"-x", `foo($x) \| bar($x)`, "-s", "baz($x)"}, "foo(a); bar(b)", wantSrc("baz(a); baz(b)")},
+		{[]string{"-x", `foo($x) \| bar($y)`, "-s", "baz($x)"}, "foo(a)", wantErr("-s baz($x): $x was not captured")},
+		{[]string{"-x", "foo($x)", "-s", `bar($x) \| baz($x)`}, "foo(a)", wantErr(`-s bar($x) \| baz($x): cannot use alternatives`)},
+		{[]string{"-x", "foo($x)", "-g", `$x \| $y`}, "foo(a)", 1},
+		{[]string{"-x", "foo($x)", "-v", `a \| b`}, "foo(a); foo(b); foo(c)", 1},
+		{[]string{"-x", `a \|`}, "a", wantErr("cannot parse expr: empty source code")},
+
+		{[]string{"-x", "$x $op $y"}, "a + b; c == d; -e", 2},
+		{[]string{"-x", "$x $op $x"}, "a + a; a + b; b < b", 2},
+		{[]string{"-x", "$x $op $y", "-a", "$op:rx(\"==|!=\")"}, "a == b; c != d; e < f", 2},
+		{[]string{"-x", "f($x $_ $y, $z)"}, "f(a*b, c); f(a, b)", "f(a*b, c)"},
+		{[]string{"-x", "f($op $x)"}, "f(-a); f(!b); f(*c); f(d)", 3},
+		{[]string{"-x", "f($op $x.y)"}, "f(-a.y); f(-a)", "f(-a.y)"},
+		{[]string{"-x", "$_ = $op $_"}, "a = &b; a = b", "a = &b"},
+		{[]string{"-x", "f($op $x, $op $y)"}, "f(-a, -b); f(-a, !b)", "f(-a, -b)"},
+		{[]string{"-x", "$x $op $y", "-s", "$y $op $x"}, "a + b; c < d", wantSrc("b + a; d < c")},
+		{[]string{"-x", "f($op $x)", "-s", "g($op $x)"}, "f(-a); f(*b)", wantSrc("g(-a); g(*b)")},
+		{[]string{"-x", "var $x $t"}, "var a int", 1},
 		{[]string{"-x", "$x++; $x--"}, "n; a++; b++; b--", "b++; b--"},
 		{[]string{"-x", "$*_; b; $*_"}, "{a; b; c; d}", "a; b; c; d"},
 		{[]string{"-x", "{$*_; $x}"}, "{a; b; c}", 1},
@@ -449,6 +1489,26 @@ func TestMatch(t *testing.T) {
 		{[]string{"-x", "$*x; b; $*y"}, "a; b; c", 1},
 		{[]string{"-x", "$*x; b; $*x"}, "a; b; c", 0},
 
+		// as few or as many nodes as possible
+		{[]string{"-x", "foo($*x, a, $*y)", "-s", "bar($*x)"}, "foo(a, a, a); foo(a)", wantSrc("bar(); bar()")},
+		{[]string{"-x", "foo($*x, a, $*y)", "-s", "bar($*y)"}, "foo(a, a, a); foo(a)", wantSrc("bar(a, a); bar()")},
+		{[]string{"-x", "foo($*+x, a, $*y)", "-s", "bar($*x)"}, "foo(a, a, a); foo(a)", wantSrc("bar(a, a); bar()")},
+		{[]string{"-x", "foo($*x, $*y)", "-s", "bar($*x)"}, "foo(a, b); foo()", wantSrc("bar(); bar()")},
+		{[]string{"-x", "foo($*x, $*y)", "-s", "bar($*y)"}, "foo(a, b); foo()", wantSrc("bar(a, b); bar()")},
+		{[]string{"-x", "foo($*+x, $*y)", "-s", "bar($*x)"}, "foo(a, b); foo()", wantSrc("bar(a, b); bar()")},
+		{[]string{"-x", "foo($*+x, b, $*+x)"}, "foo(a, b, a); foo(a, b, c)", 1},
+		{[]string{"-x", "foo($*+x)", "-s", "bar($x)"}, "foo(a)", wantErr("-s bar($x): $x was captured as $*+x")},
+
+		// zero or one nodes
+		{[]string{"-x", "foo($?x)"}, "foo(); foo(a); foo(a, b)", 2},
+		{[]string{"-x", "foo(a, $?x)"}, "foo(a); foo(a, b); foo(a, b, c)", 2},
+		{[]string{"-x", "foo($?x, $?y)"}, "foo(); foo(a); foo(a, b); foo(a, b, c)", 3},
+		{[]string{"-x", "foo($?x, b, $?x)"}, "foo(a, b, a); foo(b); foo(a, b, c)", 2},
+		{[]string{"-x", "{a; $?_; c}"}, "{a; c}; {a; b; c}; {a; b; b; c}", 2},
+		{[]string{"-x", "for $?_; $c; $?_ {}"}, "for a {}; for i(); a; p() {}", 2},
+		{[]string{"-x", "foo($?x)", "-s", "bar($?x)"}, "foo(); foo(a)", wantSrc("bar(); bar(a)")},
+		{[]string{"-x", "foo($?x)", "-s", "bar($x)"}, "foo(a)", wantErr("-s bar($x): $x was captured as $?x")},
+
 		// declarations
 		{[]string{"-x", "const $x = $y"}, "const a = b", 1},
 		{[]string{"-x", "const $x = $y"}, "const (a = b)", 1},
@@ -460,6 +1520,59 @@ func TestMatch(t *testing.T) {
 			"func a(i int) int { return i }", 1,
 		},
 
+		// method receivers
+		{[]string{"-x", "func ($r $t) $_() {}"}, "func (t T) m() {}", 1},
+		{[]string{"-x", "func ($r $t) $_() {}"}, "func (t *T) m() {}", 1},
+		{[]string{"-x", "func ($r $t) $_() {}"}, "func (_ T) m() {}", 1},
+		{[]string{"-x", "func ($r $t) $_() {}"}, "func (T) m() {}", 0},
+		{[]string{"-x", "func ($r $t) $_() {}"}, "func m() {}", 0},
+		{[]string{"-x", "func ($*r $t) $_() {}"}, "func (T) m() {}", 1},
+		{[]string{"-x", "func ($*r $t) $_() {}"}, "func (t T) m() {}", 1},
+		{[]string{"-x", "func ($t) $_() {}"}, "func (T) m() {}", 1},
+		{[]string{"-x", "func ($t) $_() {}"}, "func (t T) m() {}", 0},
+		{[]string{"-x", "func (T) $_() {}"}, "func (T) m() {}", 1},
+		{[]string{"-x", "func (_ T) $_() {}"}, "func (T) m() {}", 0},
+		{[]string{"-x", "func ($r *T) $_() { $*_ }", "-x", "$r"}, "func (t *T) m() { t.x = 1 }", 2},
+		{
+			[]string{"-x", "func ($r $t) $m() { $*b }", "-s", "func (self $t) $m() { $*b }"},
+			"package p; func (t T) m() { println(t) }",
+			wantSrc("package p; func (self T) m() { println(t); }"),
+		},
+		{
+			[]string{"-x", "func ($r $t) $_() { $*_ }", "-v", "$r.$_"},
+			"package p; func (t T) m() { println() }; func (t T) n() { t.x = 1 }", 1,
+		},
+
+		// parameter lists
+		{[]string{"-x", "func $f(io.Reader) error { $*_ }"}, "package p; func a(r io.Reader) error {}; func b(io.Reader) error {}", 2},
+		{[]string{"-x", "func $f(io.Reader) error { $*_ }"}, "package p; func a(n int, r io.Reader) error {}", 0},
+		{[]string{"-x", "func $f(r io.Reader) { $*_ }"}, "package p; func a(r io.Reader) {}; func b(io.Reader) {}; func c(s io.Reader) {}", 1},
+		{[]string{"-x", "func $f($*_, io.Reader) { $*_ }"}, "package p; func a(r io.Reader) {}; func b(n int, r io.Reader) {}; func c(r io.Reader, n int) {}", 2},
+		{[]string{"-x", "func($*_) (int, error)"}, "package p; var f func() (n int, err error); var g func(int) (int, error); var h func() error", 2},
+		{[]string{"-x", "func($*p) func($*p)"}, "package p; var f func(int) func(int); var g func(int) func(string)", 1},
+		{[]string{"-x", "struct{$*_}"}, "package p; type T struct{ a int; b string }; type U struct{}", 2},
+		{[]string{"-x", "struct{$*_; b string}"}, "package p; type T struct{ a int; b string }; type U struct{ b string }", 2},
+		{[]string{"-x", "struct{int}"}, "package p; type T struct{ a int }", 0},
+		{
+			[]string{"-x", "func $f($*p) error { $*_ }", "-s", "func $f(context.Context, $*p) error { return nil }"},
+			"package p; func a(r io.Reader) error { return nil }",
+			wantSrc("package p; func a(context.Context, r io.Reader) error { return nil; }"),
+		},
+
+		// constants repeating the previous values
+		{[]string{"-x", "$x $t = iota"}, "package p; const (A int = iota; B; C); const D int = 0", 3},
+		{[]string{"-x", "$x int = 1 << iota"}, "package p; const (A int = 1 << iota; B; C int = 3; D)", 2},
+		{[]string{"-x", "const ($x = iota; $*_)"}, "package p; const (A = iota; B); const (C = 0; D = 1)", 1},
+		{[]string{"-x", "const ($*_; B int = iota; $*_)"}, "package p; const (A int = iota; B); const (B int = 1)", 1},
+		{[]string{"-x", "const (A = iota; $x)"}, "package p; const (A = iota; B)", 1},
+		{[]string{"-x", "const ($*_)"}, "package p; const A = 1; const (B = 2; C = 3)", 2},
+		{
+			[]string{"-x", "const ($x = 0; $*rest)", "-s", "const ($x = iota; $*rest)"},
+			"package p; const (A = 0; B = 1; C = 2)",
+			wantSrc("package p; const ( A = iota; B = 1; C = 2; )"),
+		},
+		{[]string{"-x", "$x $t = 0"}, "package p; const (A, B int = 0, 1; C, D)", 0},
+
 		// value specs
 		{[]string{"-x", "$_ int"}, "var a int", 1},
 		{[]string{"-x", "$_ int"}, "var a bool", 0},
@@ -468,6 +1581,52 @@ func TestMatch(t *testing.T) {
 		{[]string{"-x", "$_ int"}, "var a, b int", 0},
 		{[]string{"-x", "$_ int"}, "func(i int) { println(i) }", 0},
 
+		// import specs
+		{[]string{"-x", `import "fmt"`}, `package p; import ("os"; "fmt")`, `"fmt"`},
+		{[]string{"-x", `import "fmt"`}, `package p; import f "fmt"`, 0},
+		{[]string{"-x", `import $_ "fmt"`}, `package p; import "fmt"; import f "fmt"; import _ "fmt"`, 3},
+		{[]string{"-x", `import $x "fmt"`}, `package p; import "fmt"; import f "fmt"`, `f "fmt"`},
+		{[]string{"-x", `import . "fmt"`}, `package p; import "fmt"; import . "fmt"`, `. "fmt"`},
+		{
+			[]string{"-x", `import $_ "github.com/pkg/..."`},
+			`package p; import ("github.com/pkg"; "github.com/pkg/errors"; "github.com/pkgx")`, 2,
+		},
+		{[]string{"-x", `import ("os"; "fmt")`}, `package p; import ("os"; "fmt")`, 1},
+		{[]string{"-x", `import ("os"; "fmt")`}, `package p; import ("fmt"; "os")`, 0},
+		{
+			[]string{"-x", `import $x "github.com/pkg/errors"`, "-s", `import $x "errors"`},
+			`package p; import ("fmt"; e "github.com/pkg/errors")`,
+			wantSrc(`package p; import ( "fmt"; e "errors"; )`),
+		},
+
+		// generics
+		{[]string{"-x", "Map[$k, $v]"}, "package p; var a Map[int, string]; var b Map[int]", "Map[int, string]"},
+		{[]string{"-x", "Map[$*_]"}, "package p; var a Map[int, string]; var b Map[int]", 2},
+		{[]string{"-x", "Map[$*_, string]"}, "package p; var a Map[int, string]; var b Map[int]", 1},
+		{[]string{"-x", "Map[$x, $x]"}, "package p; var a Map[int, string]; var b Map[int, int]", "Map[int, int]"},
+		{[]string{"-x", "func $f[$t any]($_ $t) $t { $*_ }"}, "package p; func id[T any](x T) T { return x }", 1},
+		{[]string{"-x", "func $f() { $*_ }"}, "package p; func f() {}; func g[T any]() {}", 1},
+		{[]string{"-x", "type $x[$t any] $_"}, "package p; type L[T any] []T; type M int", 1},
+		{[]string{"-x", "type $x $_"}, "package p; type L[T any] []T; type M int", 1},
+		{[]string{"-x", "type $x = $_"}, "package p; type A = int; type M int", 1},
+		{[]string{"-x", "interface{ ~$t }"}, "package p; type C interface{ ~int }", 1},
+		{[]string{"-x", "interface{ ~int | ~$t }"}, "package p; type C interface{ ~int | ~string }", 1},
+		{[]string{"-x", "interface{ $x | $y }"}, "package p; type C interface{ int | ~string }", 1},
+		{[]string{"-x", "id[$t]($x)"}, "package p; var a = id[int](3); var b = id(3)", "id[int](3)"},
+		{
+			[]string{"-x", "$x", "-a", "type(int)", "-a", "!is(basic)"},
+			"package p; func id[T any](x T) T { return x }; var _ = id[int](3)", 0,
+		},
+		{
+			[]string{"-x", "id[$t]($x)", "-a", "type(int)"},
+			"package p; func id[T any](x T) T { return x }; var _ = id[int](3)", 1,
+		},
+		{
+			[]string{"-x", "Map[$k, $v]", "-s", "Map[$v, $k]"},
+			"package p; var a Map[int, string]",
+			wantSrc("package p; var a Map[string, int]"),
+		},
+
 		// entire files
 		{[]string{"-x", "package $_"}, "package p; var a = 1", 0},
 		{[]string{"-x", "package $_; func Foo() { $*_ }"}, "package p; func Foo() {}", 1},
@@ -536,6 +1695,18 @@ func TestMatch(t *testing.T) {
 		{[]string{"-x", "for $*x; b; $*x {}"}, "for b {}", 1},
 		{[]string{"-x", "for $*x; b; $*x {}"}, "for a(); b; a() {}", 1},
 		{[]string{"-x", "for $*x; b; $*x {}"}, "for a(); b; c() {}", 0},
+		{[]string{"-x", "for $*_; $c; $*_ {}"}, "for i := 0; i < n; i++ {}", 1},
+		{[]string{"-x", "for $*_; $c; $*_ {}"}, "for i < n {}", 1},
+		{[]string{"-x", "for $*_; $c; $*_ {}"}, "for {}", 0},
+		{[]string{"-x", "for $_; $c; $_ {}"}, "for i < n {}", 0},
+		{[]string{"-x", "for $*_; $*_; $*_ {}"}, "for i := 0; i < n; i++ {}", 1},
+		{[]string{"-x", "for $*_; $*_; $*_ {}"}, "for i < n {}", 1},
+		{[]string{"-x", "for $*_; $*_; $*_ {}"}, "for {}", 1},
+		{[]string{"-x", "for $*_; $*_; $*_ {}"}, "for range x {}", 0},
+		{[]string{"-x", "for $*i; $*c; $*p {}"}, "for ; ; p() {}", 1},
+		{[]string{"-x", "for $*_; $*c; $*_ {}; for $*c {}"}, "for a := f(); b; {}; for b {}", 1},
+		{[]string{"-x", "for $*_; $*c; $*_ {}; for $*c {}"}, "for a := f(); ; {}; for {}", 1},
+		{[]string{"-x", "for $*_; $*c; $*_ {}; for $*c {}"}, "for a := f(); b; {}; for {}", 0},
 
 		// $*_ matching optional statements (switches)
 		{[]string{"-x", "switch $*_; b {}"}, "switch b := f(); b {}", 1},
@@ -607,7 +1778,7 @@ func TestMatch(t *testing.T) {
 		{[]string{"-x", "switch $_ {}"}, "switch x; y {}", 0},
 		{[]string{"-x", "switch $_; $_ {}"}, "switch x {}", 0},
 		{[]string{"-x", "switch $_; $_ {}"}, "switch x; y {}", 1},
-		{[]string{"-x", "switch { $*_; case $*_: $*a }"}, "switch { case x: y() }", 0},
+		{[]string{"-x", "switch { $*_; case $*_: $*a }"}, "switch { case x: y() }", 1},
 
 		// type switch statement
 		{[]string{"-x", "switch x := y.(z); x {}"}, "switch x := y.(z); x {}", 1},
@@ -622,6 +1793,24 @@ func TestMatch(t *testing.T) {
 		{[]string{"-x", "select {$a; $a}"}, "select {case <-x: a; case <-x: a}", 1},
 		{[]string{"-x", "select {$a; $a}"}, "select {case <-x: a; case <-x: b}", 0},
 		{[]string{"-x", "select {case x := <-y: f(x)}"}, "select {case x := <-y: f(x)}", 1},
+		{[]string{"-x", "select {$*_; default: $*_}"}, "select {case <-x: a; default: b}", 1},
+		{[]string{"-x", "select {$*_; default: $*_}"}, "select {case <-x: a}", 0},
+		{[]string{"-x", "select {$*_; default: $*_}"}, "select {default:}", 1},
+		{[]string{"-x", "select {$*_; case <-y: $*_; $*_}"}, "select {case <-x: a; case <-y: b; default: c}", 1},
+		{[]string{"-x", "select {$*_; case <-y: $*_}"}, "select {case <-y: b; case <-x: a}; select {case <-x: a}", 1},
+		{[]string{"-x", "select {$*_; default: $*_; case <-y: $*_}"}, "select {case <-y: a; case <-x: b; default: c}", 1},
+		{[]string{"-x", "select {$*_; case <-y: b}"}, "select {case <-y: a; case <-x: b}", 0},
+		{[]string{"-x", "select {$*x; case <-y: $*_}"}, "select {case <-y: b; case <-x: a}", 0},
+		{[]string{"-x", "switch {$*_; case y: $*_}"}, "switch {case y: b; case x: a}", 0},
+		{[]string{"-x", "select {$*_}", "-a", "hasdefault"}, "select {case <-x: a; default: b}; select {case <-x: a}", 1},
+		{[]string{"-x", "select {$*_}", "-a", "!hasdefault"}, "select {case <-x: a; default: b}; select {case <-x: a}", 1},
+		{[]string{"-x", "select {$*_}", "-a", "!hasdefault"}, "select {}", 1},
+		{[]string{"-x", "select {$*_}", "-a", "hasdefault"}, "select {default:}", 1},
+		{[]string{"-x", "for { select {$*_} }", "-g", "select {default:}"}, "for { select {default:} }; for { select {default: a} }", 1},
+		{[]string{"-x", "switch $x {$*_; default: $*_}"}, "switch x {case 1: a; default: b}; switch {case y: a}", 1},
+		{[]string{"-x", "switch $x {$_; default: $*_}"}, "switch x {case 1: a; default: b}", 1},
+		{[]string{"-x", "switch $x {$_; default: $*_}"}, "switch x {case 1: a; case 2: b; default: c}", 0},
+		{[]string{"-x", "switch $*_ {$*_}", "-a", "hasdefault"}, "switch x {case 1: a; default: b}; switch {case y: a}", 1},
 
 		// aggressive mode
 		{[]string{"-x", "for range $x {}"}, "for _ = range a {}", 0},
@@ -630,13 +1819,21 @@ func TestMatch(t *testing.T) {
 		{[]string{"-x", "a int"}, "var (a, b int; c bool)", 0},
 		{[]string{"-x", "~ a int"}, "var (a, b uint; c bool)", 0},
 		{[]string{"-x", "~ a int"}, "var (a, b int; c bool)", 1},
-		{[]string{"-x", "~ a int"}, "var (a, b int; c bool)", 1},
+		{[]string{"-x", "~ b int"}, "var (a, b int; c bool)", 1},
+		{[]string{"-x", "~ b int = 2"}, "var (a, b int = 1, 2; c = 3)", 1},
 		{[]string{"-x", "{ x; }"}, "switch { case true: x; }", 0},
 		{[]string{"-x", "~ { x; }"}, "switch { case true: x; }", 1},
 		{[]string{"-x", "a = b"}, "a = b; a := b", 1},
 		{[]string{"-x", "a := b"}, "a = b; a := b", 1},
 		{[]string{"-x", "~ a = b"}, "a = b; a := b; var a = b", 3},
 		{[]string{"-x", "~ a := b"}, "a = b; a := b; var a = b", 3},
+		{[]string{"-norm", "blank", "-x", "for range $x {}"}, "for _ = range a {}", 1},
+		{[]string{"-norm", "decl", "-x", "a int"}, "var (a, b int; c bool)", 1},
+		{[]string{"-norm", "decl", "-x", "for range $x {}"}, "for _ = range a {}", 0},
+		{[]string{"-norm", "block", "-x", "{ x; }"}, "switch { case true: x; }", 1},
+		{[]string{"-norm", "assign", "-x", "a = b"}, "a = b; a := b; var a = b", 3},
+		{[]string{"-norm", "assign,block", "-x", "{ a = b }"}, "switch { case true: a := b }", 1},
+		{[]string{"-norm", "decl", "-x", "a = b"}, "a = b; a := b; var a = b", 1},
 
 		// many cmds
 		{
@@ -659,6 +1856,210 @@ func TestMatch(t *testing.T) {
 			"break; for {}; for { x() }; for { break }",
 			2,
 		},
+		{
+			[]string{"-x", "f($*_)", "-x", "x"},
+			"f(x); f(g(x))",
+			2,
+		},
+		{
+			[]string{"-x", "f($*_)", "-children", "x"},
+			"f(x); f(g(x))",
+			1,
+		},
+		{
+			[]string{"-x", "$_.Lock()", "-children", "$x.$_", "-children", "mu"},
+			"mu.Lock(); s.mu.Lock(); mu.s.Lock()",
+			1,
+		},
+		{
+			[]string{"-x", "f($*_)", "-children", "$*x"},
+			"f(a, b); g(c, d)",
+			"a, b",
+		},
+		{
+			[]string{"-x", "if $_ { $*_ }", "-children", "{ $*_; }", "-children", "$x = $_", "-s", "$x++"},
+			"if c { a = 1; { b = 2 } }; d = 3",
+			wantSrc("if c { a++; { b = 2; }; }; d = 3"),
+		},
+		{
+			[]string{"-x", "break", "-in", "for { $*_ }"},
+			"break; for { if x { break } }; switch { case y: break }",
+			1,
+		},
+		{
+			[]string{"-x", "break", "-notin", "for { $*_ }"},
+			"break; for { if x { break } }; switch { case y: break }",
+			2,
+		},
+		{
+			[]string{"-x", "$m[$_] = $_", "-in", "func ($r *Cache) $_($*_) { $*_ }", "-s", "$r.set($m)"},
+			"package p; func (c *Cache) f() { c.m[1] = 2 }; func g() { m[3] = 4 }",
+			wantSrc("package p; func (c *Cache) f() { c.set(c.m); }; func g() { m[3] = 4; }"),
+		},
+		{
+			[]string{"-x", "$x", "-in", "$x($*_)"},
+			"a(); b(a); c(x)",
+			3,
+		},
+		{
+			[]string{"-x", "x", "-in", "for { $*_ }", "-in", "if $_ { $*_ }"},
+			"for { if a { x } }; if b { for { x } }; for { x }",
+			2,
+		},
+		{
+			[]string{"-x", "$f($*_)", "-u", "$f"},
+			"a(1); b(2); a(3); c.d(); c.d(4)",
+			3,
+		},
+		{
+			[]string{"-x", "$f($*x)", "-u", "*x"},
+			"a(1, 2); b(1, 2); a(); b()",
+			2,
+		},
+		{
+			[]string{"-x", "$f($*_)", "-u", "$f", "-s", "$f()"},
+			"a(1); a(2)",
+			wantSrc("a(); a(2)"),
+		},
+		{
+			[]string{"-x", "$f($*_)", "-u", "$y"},
+			"a(1)", wantErr("-u $y: $y was not captured"),
+		},
+		{
+			[]string{"-x", "$f($*_)", "-(", "-g", "a", "-or", "-g", "b", "-)", "-v", "c"},
+			"f(a); f(b); f(a, c); f(d)",
+			2,
+		},
+		{
+			[]string{"-x", "f($_)", "-or", "-x", "g($*_)", "-v", "c"},
+			"f(a); f(b, c); g(a); g(c)",
+			2,
+		},
+		{
+			[]string{"-x", "f($*_)", "-(", "-x", "a", "-or", "-x", "b", "-)"},
+			"f(b, a); g(a)",
+			2,
+		},
+		{
+			[]string{"-x", "$f($*_)", "-(", "-a", "$f:rx(\"x\")", "-or", "-(", "-g", "a", "-or", "-g", "b", "-)", "-)", "-s", "$f()"},
+			"x(1); y(a); y(b); y(c)",
+			wantSrc("x(); y(); y(); y(c)"),
+		},
+		{
+			[]string{"-x", "a", "-(", "-g", "a"},
+			"a", wantErr("-( without a matching -)"),
+		},
+		{
+			[]string{"-x", "a", "-)"},
+			"a", wantErr("-) without a matching -("),
+		},
+		{
+			[]string{"-x", "a", "-or"},
+			"a", wantErr("-or and -) must follow some commands"),
+		},
+		{
+			[]string{"-x", "a($x)", "-or", "-x", "b()", "-s", "c($x)"},
+			"a(1); b()", wantErr("-s c($x): $x was not captured"),
+		},
+		{
+			[]string{"-x", "f($*_)", "-(", "-x", "a($x)", "-or", "-x", "b($x)", "-)", "-s", "c($x)"},
+			"f(a(1)); f(b(2))", wantSrc("f(c(1)); f(c(2))"),
+		},
+		{
+			[]string{"-x", "$f($*_)", "-(", "-g", "a($x)", "-or", "-g", "b", "-)", "-s", "$x"},
+			"f(a(1))", wantErr("-s $x: $x was not captured"),
+		},
+		{
+			[]string{"-x", "$f($*_)", "-(", "-s", "a()", "-w", "-or", "-g", "b", "-)"},
+			"f(b)", wantErr("-w cannot be used within alternatives"),
+		},
+		{
+			[]string{"-x", "a()", "-or", "-x", "b()", "-limit", "1"},
+			"a(); b()", wantErr("-limit cannot be used within alternatives"),
+		},
+		{
+			[]string{"-x", "$_($*_)", "-outermost"},
+			"f(g(h(x)), y(z)); a(b)",
+			2,
+		},
+		{
+			[]string{"-x", "$_($*_)", "-innermost"},
+			"f(g(h(x)), y(z)); a(b)",
+			3,
+		},
+		{
+			[]string{"-x", "$_($*_)", "-innermost", "-s", "x"},
+			"f(g(h(a)), y(b))",
+			wantSrc("f(g(x), x)"),
+		},
+		{
+			[]string{"-x", "$_($*_)", "-x", "$_", "-outermost"},
+			"f(a); g(b)",
+			2,
+		},
+		{
+			[]string{"-x", "$f()", "-limit", "2"},
+			"a(); b(); c()",
+			2,
+		},
+		{
+			[]string{"-x", "$f()", "-limit", "2", "-g", "c"},
+			"a(); b(); c()",
+			0,
+		},
+		{
+			[]string{"-x", "$f()", "-g", "c", "-limit", "2"},
+			"a(); b(); c()",
+			1,
+		},
+		{
+			[]string{"-x", "$f()", "-limit", "0"},
+			"a(); b(); c()",
+			0,
+		},
+		{
+			[]string{"-x", "$f()", "-limit", "-1"},
+			"a()", wantErr("-limit must not be negative, got -1"),
+		},
+		{
+			[]string{"-x", "$f()", "-sample", "2"},
+			"a(); b(); c()",
+			2,
+		},
+		{
+			[]string{"-x", "$f()", "-sample", "5"},
+			"a(); b(); c()",
+			3,
+		},
+		{
+			[]string{"-x", "$f()", "-sample", "1", "-g", "c"},
+			"a()", wantErr("-sample must be the last command"),
+		},
+		{
+			[]string{"-x", "rows.Close()", "-notfollows", "if err != nil { $*_ }"},
+			"rows.Close(); if err != nil { return }; rows.Close(); if x { rows.Close() }",
+			1,
+		},
+		{
+			[]string{"-x", "$m.Lock()", "-notprecedes", "defer $m.Unlock()"},
+			"package p; func f() { a.Lock(); defer a.Unlock() }; func g() { b.Lock(); b.Unlock() }; func h() { c.Lock(); defer d.Unlock() }",
+			2,
+		},
+		{
+			[]string{"-x", "$m.Lock()", "-precedes", "$m.Unlock()"},
+			"package p; func f() { a.Lock(); if x { a.Unlock() } }; func g() { b.Unlock(); b.Lock() }",
+			1,
+		},
+		{
+			[]string{"-x", "x()", "-follows", "a(); b()"},
+			"package p; func f() { a(); b(); for { x() } }; func g() { a(); c(); b(); x() }; func h() { a(); b(); func() { x() }() }",
+			1,
+		},
+		{
+			[]string{"-x", "use($x)", "-follows", "$x := $_", "-s", "use2($x)"},
+			"package p; func f() { a := 1; use(a); use(b) }",
+			wantSrc("package p; func f() { a := 1; use2(a); use(b); }"),
+		},
 		{
 			[]string{"-x", "for { $*sts }", "-x", "$*sts"},
 			"for { a(); b() }",
@@ -669,6 +2070,35 @@ func TestMatch(t *testing.T) {
 			"for { if x { a(); b() } }",
 			"if x { a(); b(); }",
 		},
+		{
+			[]string{"-x", "foo($x)", "-s", "bar($typo)"},
+			"foo(a)", wantErr("-s bar($typo): $typo was not captured"),
+		},
+		{
+			[]string{"-s", "bar($x)", "-x", "foo($x)"},
+			"foo(a)", wantErr("-s bar($x): $x was not captured"),
+		},
+		{
+			[]string{"-x", "foo($x)", "-v", "bar($y)", "-s", "bar($y)"},
+			"foo(a)", wantErr("-s bar($y): $y was not captured"),
+		},
+		{
+			[]string{"-x", "foo($*args)", "-s", "bar($args)"},
+			"foo(a)", wantErr("-s bar($args): $args was captured as $*args"),
+		},
+		{
+			[]string{"-x", "foo($x)", "-s", "bar($*x)"},
+			"foo(a)", wantErr("-s bar($*x): $*x was captured as $x"),
+		},
+		{
+			[]string{"-x", "foo($x)", "-s", "bar($x, $_)"},
+			"foo(a)", wantErr("-s bar($x, $_): $_ captures nothing"),
+		},
+		{
+			[]string{"-x", "$_($x)", "-g", "$y($x)", "-s", "$y($x, $x)"},
+			`foo(a); bar(b)`,
+			wantSrc(`foo(a, a); bar(b, b)`),
+		},
 		{
 			[]string{"-x", "foo", "-s", "bar"},
 			`foo(); println("foo"); println(foo, foobar)`,
@@ -684,6 +2114,56 @@ func TestMatch(t *testing.T) {
 			`foo(); foo(a, b); bar(x)`,
 			wantSrc(`foo(); foo(); bar(x)`),
 		},
+		{
+			[]string{"-x", "foo($x)", "-s", "$x"},
+			`a = foo(b); foo(c)`,
+			wantSrc(`a = b; c`),
+		},
+		{
+			[]string{"-x", "foo($*x)", "-s", "$*x"},
+			`a = foo(b, c); foo(d, e, f)`,
+			wantErr(`-s $*x: $*x is a list, so it cannot replace a single expression`),
+		},
+		{
+			[]string{"-x", "foo($*x)", "-s", "$*x"},
+			`foo(); bar()`,
+			wantErr(`-s $*x: $*x is a list, so it cannot replace a single expression`),
+		},
+		{
+			[]string{"-x", "foo($*x, $y)", "-s", "bar($*x * $y)"},
+			`foo(a - b, c)`,
+			wantErr(`-s bar($*x * $y): $*x is a list, so it cannot replace a single expression`),
+		},
+		{
+			[]string{"-x", "foo($*x)", "-s", "bar($*x)"},
+			`foo(a - b, c); foo()`,
+			wantSrc(`bar(a-b, c); bar()`),
+		},
+		{
+			[]string{"-x", "foo($*x)", "-s", "[]int{$*x}"},
+			`x = foo(a, b)`,
+			wantSrc(`x = []int{a, b}`),
+		},
+		{
+			[]string{"-x", "var $x $t = $_", "-a", "zeroinit", "-s", "var $x $t"},
+			`package p; func f() { var a int = 0; var b int = 1; _, _ = a, b }`,
+			wantSrc(`package p; func f() { var a int; var b int = 1; _, _ = a, b; }`),
+		},
+		{
+			[]string{"-x", "var $x $t = $_", "-a", "zeroinit", "-s", "var $x $t"},
+			`package p; var a string = ""`,
+			wantSrc(`package p; var a string`),
+		},
+		{
+			[]string{"-x", "$_($x)", "-a", "noopconv", "-s", "$x"},
+			`package p; func f(a int, b int32) { _ = int(a) + int(b); _ = int(3) }`,
+			wantSrc(`package p; func f(a int, b int32) { _ = a + int(b); _ = int(3); }`),
+		},
+		{
+			[]string{"-x", "fmt.Sprintf($_, $*args)", "-a", "fmtconcat", "-s", "$*args"},
+			`package p; import "fmt"; func f(a, b string) string { _ = fmt.Sprintf("%s", a); _ = fmt.Sprintf("%d", 1); return fmt.Sprintf("%s%s", a, b) }`,
+			wantSrc(`package p; import "fmt"; func f(a, b string) string { _ = a; _ = fmt.Sprintf("%d", 1); return a + b; }`),
+		},
 		{
 			[]string{"-x", "a, b", "-s", "c, d"},
 			`foo(); foo(a, b); bar(a, b)`,
@@ -752,6 +2232,47 @@ func TestMatch(t *testing.T) {
 	}
 }
 
+// TestMatchNewGo holds the cases whose sources only type-check with a
+// recent enough version of Go, which are skipped otherwise.
+func TestMatchNewGo(t *testing.T) {
+	tests := []struct {
+		goVersion string
+		args      []string
+		src       string
+		anyWant   interface{}
+	}{
+		{
+			"go1.22",
+			[]string{"-x", "for $*_ { $*_ }", "-a", "range(int)"},
+			"package p; func f(n int, u uint8, s []int) { for i := range n { _ = i }; for range u {}; for range 3 {}; for range s {}; for i := 0; i < n; i++ {} }", 3,
+		},
+		{
+			"go1.23",
+			[]string{"-x", "for $*_ { $*_ }", "-a", "range(func)"},
+			"package p; func f(seq func(func(int) bool)) { for v := range seq { _ = v } }", 1,
+		},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			if !hasReleaseTag(tc.goVersion) {
+				t.Skipf("needs %s", tc.goVersion)
+			}
+			grepTest(t, tc.args, tc.src, tc.anyWant)
+		})
+	}
+}
+
+// hasReleaseTag reports whether the Go version running the tests is at least
+// the given one, like "go1.22".
+func hasReleaseTag(tag string) bool {
+	for _, t := range build.Default.ReleaseTags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
 func grepTest(t *testing.T, args interface{}, src string, anyWant interface{}) {
 	var strs []string
 	switch x := args.(type) {
@@ -783,14 +2304,23 @@ func grepTest(t *testing.T, args interface{}, src string, anyWant interface{}) {
 		m.Info.Defs = make(map[*ast.Ident]types.Object)
 		m.Info.Uses = make(map[*ast.Ident]types.Object)
 		m.Info.Scopes = make(map[ast.Node]*types.Scope)
+		m.Info.Selections = make(map[*ast.SelectorExpr]*types.Selection)
 		config := &types.Config{Importer: importer.Default()}
 		check := types.NewChecker(config, fset, pkg, &m.Info)
 		if err := check.Files([]*ast.File{f}); err != nil {
 			t.Fatal(err)
 		}
+		m.pkg = pkg
 	}
 	m.loader.fset = emptyFset
 	matches := m.matches(cmds, []ast.Node{srcNode})
+	if general := generalCmds(cmds); general != nil {
+		// the fast path for literal patterns must not change the results
+		want := fmt.Sprint(matchesPos(matches))
+		if got := fmt.Sprint(matchesPos(m.matches(general, []ast.Node{srcNode}))); got != want {
+			terr("literal pattern fast path gave %s, general path gave %s", want, got)
+		}
+	}
 	switch want := anyWant.(type) {
 	case wantErr:
 		if err == nil {
@@ -815,7 +2345,7 @@ func grepTest(t *testing.T, args interface{}, src string, anyWant interface{}) {
 			terr("wanted 1 match, got %d", len(matches))
 			return
 		}
-		got := singleLinePrint(matches[0])
+		got := singleLinePrint(matches[0].node)
 		if got != want {
 			terr("wanted %q match, got %q", want, got)
 		}
@@ -833,3 +2363,83 @@ func grepTest(t *testing.T, args interface{}, src string, anyWant interface{}) {
 		panic(fmt.Sprintf("unexpected anyWant type: %T", anyWant))
 	}
 }
+
+// generalCmds returns a copy of cmds without the fast path for literal
+// patterns, or nil if none of them use it or if they modify the source.
+func generalCmds(cmds []exprCmd) []exprCmd {
+	any := false
+	general := make([]exprCmd, len(cmds))
+	for i, cmd := range cmds {
+		switch cmd.name {
+		case "s", "w", "limit", "sample":
+			return nil
+		}
+		any = any || cmd.literal
+		cmd.literal = false
+		general[i] = cmd
+	}
+	if !any {
+		return nil
+	}
+	return general
+}
+
+func matchesPos(subs []submatch) []nodePosHash {
+	hashes := make([]nodePosHash, len(subs))
+	for i, sub := range subs {
+		hashes[i] = posHash(sub.node)
+	}
+	return hashes
+}
+
+func BenchmarkMatch(b *testing.B) {
+	src := `package p
+
+func foo(a, b []int) {
+	for i := range a {
+		b[i] = a[i] + 1
+		if b[i] > 10 {
+			mu.Lock()
+			b[i] = 0
+			mu.Unlock()
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	println(a, b)
+}
+`
+	for i := 0; i < 5; i++ {
+		src += src[len("package p\n"):]
+	}
+	srcNode, err := parseDetectingNode(src)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, pattern := range []string{
+		"mu.Unlock()",
+		"mu.Lock(); b[i] = 0",
+		"$x.Unlock()",
+		"$x.Lock(); $*_; $x.Unlock()",
+	} {
+		m := matcher{}
+		cmds, _, err := m.parseCmds([]string{"-x", pattern})
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, fast := range []bool{true, false} {
+			if !fast && !cmds[0].literal {
+				continue
+			}
+			name, run := pattern, cmds
+			if !fast {
+				name, run = pattern+"/general", generalCmds(cmds)
+			}
+			b.Run(name, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					m.matches(run, []ast.Node{srcNode})
+				}
+			})
+		}
+	}
+}
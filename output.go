@@ -0,0 +1,616 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// jsonMatch is a match as printed via -json.
+type jsonMatch struct {
+	File  string  `json:"file"`
+	Start jsonPos `json:"start"`
+	End   jsonPos `json:"end"`
+	Match string  `json:"match"`
+
+	Rule     string `json:"rule,omitempty"`
+	Message  string `json:"message,omitempty"`
+	Severity string `json:"severity,omitempty"`
+
+	// Captures holds the values of the named wildcards, by name
+	Captures map[string]string `json:"captures,omitempty"`
+
+	// Alternative is which of the alternatives of the pattern matched,
+	// starting at 1, if it had any
+	Alternative int `json:"alternative,omitempty"`
+}
+
+type jsonPos struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+	Offset int `json:"offset"`
+}
+
+func newJSONPos(pos token.Position) jsonPos {
+	return jsonPos{Line: pos.Line, Column: pos.Column, Offset: pos.Offset}
+}
+
+func (m *matcher) jsonMatch(r *rule, sub submatch) jsonMatch {
+	start := m.position(sub.node.Pos())
+	jm := jsonMatch{
+		File:     filepath.ToSlash(start.Filename),
+		Start:    newJSONPos(start),
+		End:      newJSONPos(m.position(sub.node.End())),
+		Match:    singleLinePrint(sub.node),
+		Rule:     r.name,
+		Severity: r.severity,
+
+		Alternative: sub.alt,
+	}
+	if r.message != "" {
+		jm.Message = fillTemplate(r.message, sub.values)
+	}
+	for name, value := range sub.values {
+		if jm.Captures == nil {
+			jm.Captures = make(map[string]string, len(sub.values))
+		}
+		jm.Captures[name] = singleLinePrint(value)
+	}
+	return jm
+}
+
+// printJSON prints matches of a rule as JSON objects, one per line.
+func (m *matcher) printJSON(r *rule, subs []submatch) {
+	enc := json.NewEncoder(m.out)
+	for _, sub := range subs {
+		enc.Encode(m.jsonMatch(r, sub))
+	}
+}
+
+// SARIF 2.1.0 as printed via -format sarif, only with the fields we use.
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+	DefaultConfig    struct {
+		Level string `json:"level"`
+	} `json:"defaultConfiguration"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	RuleIndex int             `json:"ruleIndex"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation struct {
+		ArtifactLocation struct {
+			URI string `json:"uri"`
+		} `json:"artifactLocation"`
+		Region sarifRegion `json:"region"`
+	} `json:"physicalLocation"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn"`
+	EndLine     int `json:"endLine"`
+	EndColumn   int `json:"endColumn"`
+}
+
+// sarifLevels maps the severities of rules to SARIF levels.
+var sarifLevels = map[string]string{
+	"":        "warning",
+	"error":   "error",
+	"warning": "warning",
+	"info":    "note",
+}
+
+// ruleID returns the name of a rule, or "query" for the commands given as
+// arguments, as some formats require rules to have an ID.
+func (r *rule) ruleID() string {
+	if r.name == "" {
+		return "query"
+	}
+	return r.name
+}
+
+// ruleText returns what is printed for a match of a rule in formats which
+// require a message; the rule's message or else the matched source.
+func (r *rule) ruleText(sub submatch) string {
+	if r.message != "" {
+		return fillTemplate(r.message, sub.values)
+	}
+	return singleLinePrint(sub.node)
+}
+
+// printSARIF prints the matches of all rules as a single SARIF log.
+func (m *matcher) printSARIF(rules []*rule) {
+	run := sarifRun{
+		Tool: sarifTool{Driver: sarifDriver{
+			Name:           "gogrep",
+			InformationURI: "https://github.com/mvdan/gogrep",
+			Rules:          []sarifRule{},
+		}},
+		Results: []sarifResult{},
+	}
+	for i, r := range rules {
+		sr := sarifRule{ID: r.ruleID()}
+		sr.ShortDescription.Text = r.message
+		if sr.ShortDescription.Text == "" {
+			sr.ShortDescription.Text = r.ruleID()
+		}
+		sr.DefaultConfig.Level = sarifLevels[r.severity]
+		run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, sr)
+		for _, sub := range r.all {
+			start := m.position(sub.node.Pos())
+			end := m.position(sub.node.End())
+			var loc sarifLocation
+			loc.PhysicalLocation.ArtifactLocation.URI = filepath.ToSlash(start.Filename)
+			loc.PhysicalLocation.Region = sarifRegion{
+				StartLine:   start.Line,
+				StartColumn: start.Column,
+				EndLine:     end.Line,
+				EndColumn:   end.Column,
+			}
+			run.Results = append(run.Results, sarifResult{
+				RuleID:    sr.ID,
+				RuleIndex: i,
+				Level:     sr.DefaultConfig.Level,
+				Message:   sarifMessage{Text: r.ruleText(sub)},
+				Locations: []sarifLocation{loc},
+			})
+		}
+	}
+	enc := json.NewEncoder(m.out)
+	enc.SetIndent("", "  ")
+	enc.Encode(sarifLog{
+		Version: "2.1.0",
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Runs:    []sarifRun{run},
+	})
+}
+
+// checkstyle XML as printed via -format checkstyle.
+type checkstyleLog struct {
+	XMLName xml.Name         `xml:"checkstyle"`
+	Version string           `xml:"version,attr"`
+	Files   []checkstyleFile `xml:"file"`
+}
+
+type checkstyleFile struct {
+	Name   string            `xml:"name,attr"`
+	Errors []checkstyleError `xml:"error"`
+}
+
+type checkstyleError struct {
+	Line     int    `xml:"line,attr"`
+	Column   int    `xml:"column,attr"`
+	Severity string `xml:"severity,attr"`
+	Message  string `xml:"message,attr"`
+	Source   string `xml:"source,attr"`
+}
+
+// printCheckstyle prints the matches of all rules as a checkstyle report,
+// with the files sorted by name and their errors by position.
+func (m *matcher) printCheckstyle(rules []*rule) {
+	byFile := make(map[string][]checkstyleError)
+	for _, r := range rules {
+		severity := r.severity
+		if severity == "" {
+			severity = "warning"
+		}
+		for _, sub := range r.all {
+			pos := m.position(sub.node.Pos())
+			name := filepath.ToSlash(pos.Filename)
+			byFile[name] = append(byFile[name], checkstyleError{
+				Line:     pos.Line,
+				Column:   pos.Column,
+				Severity: severity,
+				Message:  r.ruleText(sub),
+				Source:   "gogrep." + r.ruleID(),
+			})
+		}
+	}
+	report := checkstyleLog{Version: "5.0"}
+	for name, errs := range byFile {
+		sort.SliceStable(errs, func(i, j int) bool {
+			if errs[i].Line != errs[j].Line {
+				return errs[i].Line < errs[j].Line
+			}
+			return errs[i].Column < errs[j].Column
+		})
+		report.Files = append(report.Files, checkstyleFile{Name: name, Errors: errs})
+	}
+	sort.Slice(report.Files, func(i, j int) bool {
+		return report.Files[i].Name < report.Files[j].Name
+	})
+	io.WriteString(m.out, xml.Header)
+	enc := xml.NewEncoder(m.out)
+	enc.Indent("", "  ")
+	enc.Encode(report)
+	io.WriteString(m.out, "\n")
+}
+
+// printVimgrep prints one "file:line:col: text" line per match, as expected
+// by quickfix lists. Matches spanning many lines are cut to their first one.
+func (m *matcher) printVimgrep(subs []submatch) {
+	for _, sub := range subs {
+		fmt.Fprintf(m.out, "%v: %s\n", m.position(sub.node.Pos()), firstLinePrint(sub.node))
+	}
+}
+
+// firstLinePrint is like singleLinePrint, but keeps only the first line of
+// the printed node instead of joining all of them.
+func firstLinePrint(node ast.Node) string {
+	var buf bytes.Buffer
+	restore := hideComments(node)
+	printNode(&buf, emptyFset, node)
+	restore()
+	line := buf.String()
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	return strings.TrimRightFunc(line, unicode.IsSpace)
+}
+
+// source returns the contents of a parsed file, reading it only once. It
+// returns nil if the file can't be read, or if it changed since it was
+// parsed.
+func (m *matcher) source(tf *token.File) []byte {
+	if src, ok := m.sources[tf.Name()]; ok {
+		return src
+	}
+	if m.sources == nil {
+		m.sources = make(map[string][]byte)
+	}
+	src, _ := os.ReadFile(tf.Name())
+	if len(src) != tf.Size() {
+		src = nil
+	}
+	m.sources[tf.Name()] = src
+	return src
+}
+
+// sourceLine returns a line of a file's contents, without its newline nor
+// any trailing space.
+func sourceLine(tf *token.File, src []byte, line int) string {
+	text := src[tf.Offset(tf.LineStart(line)):]
+	if i := bytes.IndexByte(text, '\n'); i >= 0 {
+		text = text[:i]
+	}
+	return strings.TrimRightFunc(string(text), unicode.IsSpace)
+}
+
+// contextPrinter prints the lines given via -A and -B around each match,
+// merging the windows of nearby matches and separating the rest with
+// "--" lines, like grep does.
+type contextPrinter struct {
+	m *matcher
+
+	file *token.File
+	src  []byte
+
+	// printed is the last line printed from file, and pending the last
+	// line of context after a match still to be printed
+	printed, pending int
+
+	// any is whether any line was printed, and newFile whether file
+	// has no printed lines yet
+	any, newFile bool
+}
+
+// before prints the context before a match, along with whatever is left of
+// the context after the previous one.
+func (c *contextPrinter) before(node ast.Node) {
+	tf := c.m.loader.fset.File(node.Pos())
+	if tf != c.file {
+		c.flush()
+		c.file, c.src = tf, c.m.source(tf)
+		c.printed, c.pending = 0, 0
+		c.newFile = true
+	}
+	start := tf.Line(node.Pos())
+	if c.pending >= start {
+		c.pending = start - 1
+	}
+	c.flush()
+	from := start - c.m.before
+	if from <= c.printed {
+		from = c.printed + 1
+	}
+	if from < 1 {
+		from = 1
+	}
+	c.lines(from, start-1)
+	c.separate(start)
+}
+
+// after records that a match was printed, its context after it being left
+// to print until the next match is seen.
+func (c *contextPrinter) after(node ast.Node) {
+	end := c.file.Line(node.End())
+	if end > c.printed {
+		c.printed = end
+	}
+	if end+c.m.after > c.pending {
+		c.pending = end + c.m.after
+	}
+}
+
+// flush prints the pending context after the last match.
+func (c *contextPrinter) flush() {
+	if c.file != nil {
+		c.lines(c.printed+1, c.pending)
+	}
+}
+
+// separate prints a "--" line if the line about to be printed does not
+// follow the last printed one.
+func (c *contextPrinter) separate(line int) {
+	if c.any && (c.newFile || line > c.printed+1) {
+		fmt.Fprintln(c.m.out, "--")
+	}
+	c.any, c.newFile = true, false
+}
+
+func (c *contextPrinter) lines(from, to int) {
+	if c.src == nil {
+		return
+	}
+	if n := c.file.LineCount(); to > n {
+		to = n
+	}
+	name := c.m.position(c.file.LineStart(from)).Filename
+	for line := from; line <= to; line++ {
+		c.separate(line)
+		fmt.Fprintf(c.m.out, "%s%s\n", c.m.contextPosString(name, line),
+			sourceLine(c.file, c.src, line))
+		c.printed = line
+	}
+}
+
+// tmplMatch is a match as given to the template of -format-tmpl.
+type tmplMatch struct {
+	File               string
+	Line, Column       int
+	EndLine, EndColumn int
+	Match              string
+
+	Rule, Message, Severity string
+
+	// Captures holds the values of the named wildcards, by name
+	Captures map[string]string
+
+	// Alternative is which alternative of the pattern matched; see
+	// jsonMatch.Alternative
+	Alternative int
+}
+
+// Capture returns the value of a named wildcard, or the empty string if it
+// was not captured.
+func (tm tmplMatch) Capture(name string) string {
+	return tm.Captures[strings.TrimLeft(strings.TrimPrefix(name, "$"), "*?+")]
+}
+
+// printTemplate prints each match by executing the template given via
+// -format-tmpl, adding a newline if the output doesn't end with one.
+func (m *matcher) printTemplate(r *rule, subs []submatch) {
+	var buf bytes.Buffer
+	for _, sub := range subs {
+		jm := m.jsonMatch(r, sub)
+		buf.Reset()
+		if err := m.formatTmpl.Execute(&buf, tmplMatch{
+			File:      jm.File,
+			Line:      jm.Start.Line,
+			Column:    jm.Start.Column,
+			EndLine:   jm.End.Line,
+			EndColumn: jm.End.Column,
+			Match:     jm.Match,
+			Rule:      jm.Rule,
+			Message:   jm.Message,
+			Severity:  jm.Severity,
+			Captures:  jm.Captures,
+
+			Alternative: jm.Alternative,
+		}); err != nil {
+			fmt.Fprintf(&buf, "<%v>", err)
+		}
+		if b := buf.Bytes(); len(b) == 0 || b[len(b)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+		m.out.Write(buf.Bytes())
+	}
+}
+
+// printFiles prints the names of the files with any matches, sorted and
+// once each, for -l.
+func (m *matcher) printFiles(rules []*rule) {
+	seen := make(map[string]bool)
+	var names []string
+	for _, r := range rules {
+		for _, sub := range r.all {
+			name := m.position(sub.node.Pos()).Filename
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	end := "\n"
+	if m.nulSep {
+		end = "\x00"
+	}
+	for _, name := range names {
+		io.WriteString(m.out, name)
+		io.WriteString(m.out, end)
+	}
+}
+
+// printAST prints the syntax tree of each match via ast.Fprint, followed
+// by the types of its expressions with -types.
+func (m *matcher) printAST(subs []submatch, pkgs []loadPkg) {
+	var buf bytes.Buffer
+	for _, sub := range subs {
+		fmt.Fprintf(m.out, "%v:\n", m.position(sub.node.Pos()))
+		buf.Reset()
+		ast.Fprint(&buf, m.loader.fset, sub.node, astFilter)
+		dump := buf.String()
+		if wd := m.loader.wd; wd != "" {
+			// relative positions, like m.position
+			dump = strings.Replace(dump, wd+string(filepath.Separator), "", -1)
+		}
+		io.WriteString(m.out, dump)
+		if !m.showTypes {
+			continue
+		}
+		fmt.Fprintln(m.out, "types:")
+		inspect(sub.node, func(node ast.Node) bool {
+			expr, ok := node.(ast.Expr)
+			if !ok {
+				return true
+			}
+			if t := typeOf(pkgs, expr); t != nil {
+				pos := m.position(expr.Pos())
+				fmt.Fprintf(m.out, "  %d:%d: %s: %s\n", pos.Line, pos.Column,
+					singleLinePrint(expr), typeString(t))
+			}
+			return true
+		})
+	}
+}
+
+// printTypes prints the type of a match and those of its wildcards, sorted
+// by name, each on its own line. Those which aren't typed expressions are
+// skipped.
+func (m *matcher) printTypes(indent string, sub submatch, pkgs []loadPkg) {
+	if expr, ok := sub.node.(ast.Expr); ok {
+		if t := typeOf(pkgs, expr); t != nil {
+			fmt.Fprintf(m.out, "%s%s: %s\n", indent, singleLinePrint(expr), typeString(t))
+		}
+	}
+	names := make([]string, 0, len(sub.values))
+	for name := range sub.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		expr, ok := sub.values[name].(ast.Expr)
+		if !ok {
+			continue
+		}
+		if t := typeOf(pkgs, expr); t != nil {
+			fmt.Fprintf(m.out, "%s$%s = %s: %s\n", indent, name, singleLinePrint(expr), typeString(t))
+		}
+	}
+}
+
+// astFilter skips the nil fields and the objects of identifiers, which are
+// deprecated and print the declarations they point to.
+func astFilter(name string, value reflect.Value) bool {
+	return name != "Obj" && ast.NotNilFilter(name, value)
+}
+
+// typeOf returns the type of an expression within whichever of the packages
+// it belongs to, or nil if it has none.
+func typeOf(pkgs []loadPkg, expr ast.Expr) types.Type {
+	for _, pkg := range pkgs {
+		if t := pkg.info.TypeOf(expr); t != nil {
+			return t
+		}
+	}
+	return nil
+}
+
+// typeString is like types.TypeString, qualifying names by package name
+// rather than by import path.
+func typeString(t types.Type) string {
+	return types.TypeString(t, (*types.Package).Name)
+}
+
+// printCSV prints the matches of all rules as comma or tab separated
+// values, with a header row. Besides the fixed columns, each wildcard
+// captured by any rule gets a column, sorted by name.
+func (m *matcher) printCSV(rules []*rule, comma rune) {
+	seen := make(map[string]bool)
+	var names []string
+	for _, r := range rules {
+		for _, sub := range r.all {
+			for name := range sub.values {
+				if !seen[name] {
+					seen[name] = true
+					names = append(names, name)
+				}
+			}
+		}
+	}
+	sort.Strings(names)
+	w := csv.NewWriter(m.out)
+	w.Comma = comma
+	header := []string{"file", "line", "col", "rule", "match"}
+	for _, name := range names {
+		header = append(header, "$"+name)
+	}
+	w.Write(header)
+	for _, r := range rules {
+		for _, sub := range r.all {
+			jm := m.jsonMatch(r, sub)
+			record := []string{
+				jm.File,
+				strconv.Itoa(jm.Start.Line),
+				strconv.Itoa(jm.Start.Column),
+				jm.Rule,
+				jm.Match,
+			}
+			for _, name := range names {
+				record = append(record, jm.Captures[name])
+			}
+			w.Write(record)
+		}
+	}
+	w.Flush()
+}
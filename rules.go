@@ -0,0 +1,216 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"os"
+	"strings"
+)
+
+// rule is a list of commands to run, named if it comes from a file given
+// via -f. Each rule has its own matcher, as the wildcards and options of
+// each are separate.
+type rule struct {
+	name string
+	m    *matcher
+	cmds []exprCmd
+
+	// message is a template printed instead of each match, as with -o,
+	// and severity is one of "error", "warning" or "info"
+	message  string
+	severity string
+
+	// sample is the -sample command ending the commands, if any, which
+	// is applied to the matches from all packages at once
+	sample *exprCmd
+
+	all    []submatch
+	perPkg []int // the number of matches in each package
+}
+
+// streaming reports whether the rule's matches are printed as each package
+// is matched, instead of all at once at the end. That is the case with
+// -json, unless the output needs all of the matches, like -count. The
+// packages are then loaded one at a time too, unless a rule needs type
+// information, as the typed loader checks the whole program at once.
+func (r *rule) streaming() bool {
+	return r.m.json && r.sample == nil && r.m.count == "" && len(r.m.collect) == 0
+}
+
+// printName prints the rule's name on its own line, if it has one.
+func (r *rule) printName() {
+	if r.name != "" {
+		fmt.Fprintf(r.m.out, "%s:\n", r.name)
+	}
+}
+
+// loadRules parses the rules in a file. The options given as arguments,
+// like -r or -equal, apply to each rule before its own. Besides commands
+// and options, a rule may have fields like "message: text".
+func (m *matcher) loadRules(path string, opts []string) ([]*rule, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []*rule
+	var args [][]string
+	seen := make(map[string]bool)
+	for i, line := range strings.Split(string(src), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if trimmed == line {
+			name := strings.TrimSuffix(line, ":")
+			switch {
+			case name == line || name == "" || strings.ContainsAny(name, " \t"):
+				return nil, fmt.Errorf("%s:%d: wanted a rule name and a colon", path, i+1)
+			case seen[name]:
+				return nil, fmt.Errorf("%s:%d: rule %s is defined twice", path, i+1, name)
+			}
+			seen[name] = true
+			rules = append(rules, &rule{name: name})
+			args = append(args, append([]string{}, opts...))
+			continue
+		}
+		if len(rules) == 0 {
+			return nil, fmt.Errorf("%s:%d: command outside of a rule", path, i+1)
+		}
+		r := rules[len(rules)-1]
+		if key, value, ok := strings.Cut(trimmed, ":"); ok && !strings.HasPrefix(trimmed, "-") {
+			value = strings.TrimSpace(value)
+			switch key {
+			case "message":
+				r.message = value
+			case "severity":
+				switch value {
+				case "error", "warning", "info":
+				default:
+					return nil, fmt.Errorf("%s:%d: unknown severity %q", path, i+1, value)
+				}
+				r.severity = value
+			default:
+				return nil, fmt.Errorf("%s:%d: unknown rule field %q", path, i+1, key)
+			}
+			continue
+		}
+		if !strings.HasPrefix(trimmed, "-") {
+			return nil, fmt.Errorf("%s:%d: wanted a command, an option or a rule field", path, i+1)
+		}
+		flag, value := trimmed, ""
+		if j := strings.IndexAny(trimmed, " \t"); j > 0 {
+			flag, value = trimmed[:j], strings.TrimSpace(trimmed[j:])
+		}
+		last := len(args) - 1
+		args[last] = append(args[last], flag)
+		if value != "" {
+			args[last] = append(args[last], value)
+		}
+	}
+	for i, r := range rules {
+		r.m = &matcher{out: m.out, in: m.in, ctx: m.ctx, stderr: m.stderr}
+		cmds, paths, err := r.m.parseCmds(args[i])
+		switch {
+		case err != nil:
+			return nil, fmt.Errorf("rule %s: %v", r.name, err)
+		case len(cmds) == 0:
+			return nil, fmt.Errorf("rule %s: need at least one command", r.name)
+		case len(paths) > 0:
+			return nil, fmt.Errorf("rule %s: unexpected argument %q", r.name, paths[0])
+		}
+		if err := r.m.checkTemplate(cmds, r.message); err != nil {
+			return nil, fmt.Errorf("rule %s: message: %v", r.name, err)
+		}
+		r.cmds = cmds
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("%s: no rules found", path)
+	}
+	return rules, nil
+}
+
+// suppressions filters out the matches of a rule suppressed by a comment,
+// or keeps only those if -suppressed was used. See suppressedBy.
+func (m *matcher) suppressions(name string, subs []submatch) []submatch {
+	var kept []submatch
+	for _, sub := range subs {
+		if m.suppressed(name, sub.node) == m.listSuppressed {
+			kept = append(kept, sub)
+		}
+	}
+	return kept
+}
+
+// suppressed reports whether a match of a rule is suppressed by a comment
+// on the line where it starts, or by a directive in the doc comment of the
+// top-level declaration containing it.
+func (m *matcher) suppressed(name string, node ast.Node) bool {
+	if decl := m.enclosingDecl(node); decl != nil {
+		for _, c := range m.directivesOf(decl) {
+			if suppressedBy(c.Text, name) {
+				return true
+			}
+		}
+	}
+	f := m.fileOf(node)
+	if f == nil {
+		return false
+	}
+	line := m.loader.fset.Position(node.Pos()).Line
+	for _, cg := range f.Comments {
+		for _, c := range cg.List {
+			if m.loader.fset.Position(c.Pos()).Line == line && suppressedBy(c.Text, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fileOf returns the file containing a node, if any.
+func (m *matcher) fileOf(node ast.Node) *ast.File {
+	for ; node != nil; node = m.parentOf(node) {
+		if f, ok := node.(*ast.File); ok {
+			return f
+		}
+	}
+	return nil
+}
+
+// suppressedBy reports whether a comment suppresses the matches of a rule,
+// or those of any rule if name is empty. The comment is either
+// "//gogrep:ignore", optionally followed by the names of the rules, or
+// "//nolint:gogrep", where each linter may be followed by a colon and a
+// rule name, as in "//nolint:gogrep:unwrapped,errcheck".
+func suppressedBy(text, name string) bool {
+	if rest := strings.TrimPrefix(text, "//gogrep:ignore"); rest != text {
+		if rest == "" {
+			return true
+		}
+		if rest[0] != ' ' && rest[0] != '\t' {
+			return false
+		}
+		for _, field := range strings.FieldsFunc(rest, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		}) {
+			if field == name {
+				return true
+			}
+		}
+		return false
+	}
+	if rest := strings.TrimPrefix(text, "//nolint:"); rest != text {
+		if i := strings.IndexAny(rest, " \t"); i >= 0 {
+			rest = rest[:i] // an explanation follows
+		}
+		for _, linter := range strings.Split(rest, ",") {
+			if linter == "gogrep" || linter == "gogrep:"+name {
+				return true
+			}
+		}
+	}
+	return false
+}
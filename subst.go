@@ -4,13 +4,18 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"go/ast"
 	"go/token"
+	"io"
 	"reflect"
+	"strings"
 )
 
 func (m *matcher) cmdSubst(cmd exprCmd, subs []submatch) []submatch {
+	var next []submatch
+	quit := false
 	for _, sub := range subs {
 		nodeCopy, _ := m.parseExpr(cmd.src)
 		// since we'll want to set positions within the file's
@@ -18,28 +23,163 @@ func (m *matcher) cmdSubst(cmd exprCmd, subs []submatch) []submatch {
 		scrubPositions(nodeCopy)
 
 		m.fillParents(nodeCopy)
-		m.fillValues(nodeCopy, sub.values)
+		spread := spreadArgs(sub.node)
+		nodeCopy = m.fillValues(nodeCopy, sub.values)
+		keepSpread(nodeCopy, spread)
+		if m.interactive && (quit || !m.confirmSubst(sub.node, nodeCopy, &quit)) {
+			continue
+		}
 		m.substNode(sub.node, nodeCopy)
 		sub.node = nodeCopy
+		next = append(next, sub)
+	}
+	return next
+}
+
+// spreadArgs returns the last arguments of the calls with "..." within a
+// node, along with the position of each "...".
+func spreadArgs(node ast.Node) map[ast.Expr]token.Pos {
+	spread := make(map[ast.Expr]token.Pos)
+	inspect(node, func(node ast.Node) bool {
+		if call, ok := node.(*ast.CallExpr); ok && call.Ellipsis.IsValid() {
+			spread[call.Args[len(call.Args)-1]] = call.Ellipsis
+		}
+		return true
+	})
+	return spread
+}
+
+// keepSpread adds the "..." back to the calls in a substitution which end
+// with an argument that was spread in the matched code. That happens when
+// a trailing "$*x" captures it, such as "f($*x)" matching "f(s...)".
+func keepSpread(node ast.Node, spread map[ast.Expr]token.Pos) {
+	inspect(node, func(node ast.Node) bool {
+		call, ok := node.(*ast.CallExpr)
+		if !ok || call.Ellipsis.IsValid() || len(call.Args) == 0 {
+			return true
+		}
+		if pos, ok := spread[call.Args[len(call.Args)-1]]; ok {
+			call.Ellipsis = pos
+		}
+		return true
+	})
+}
+
+// confirmSubst shows a substitution as a diff hunk and asks whether it
+// should be applied. Answering "q" rejects it and all the following ones.
+func (m *matcher) confirmSubst(oldNode, newNode ast.Node, quit *bool) bool {
+	w := m.errOut()
+	fmt.Fprintf(w, "%v:\n", m.position(oldNode.Pos()))
+	printHunkLines(w, "- ", m.loader.fset, oldNode)
+	printHunkLines(w, "+ ", emptyFset, newNode)
+	for {
+		fmt.Fprint(w, "apply? [y,n,q] ")
+		answer, err := m.inBuf.ReadString('\n')
+		switch strings.TrimSpace(answer) {
+		case "y", "yes":
+			return true
+		case "n", "no":
+			return false
+		case "q", "quit":
+			*quit = true
+			return false
+		}
+		if err != nil { // e.g. EOF; reject the rest
+			fmt.Fprintln(w)
+			*quit = true
+			return false
+		}
 	}
-	return subs
 }
 
-func (m *matcher) fillValues(node ast.Node, values map[string]ast.Node) {
+func printHunkLines(w io.Writer, prefix string, fset *token.FileSet, node ast.Node) {
+	var buf bytes.Buffer
+	printNode(&buf, fset, node)
+	for _, line := range strings.Split(buf.String(), "\n") {
+		fmt.Fprintf(w, "%s%s\n", prefix, line)
+	}
+}
+
+// fillValues replaces the wildcards in node with their values, returning
+// the resulting node. If node is a wildcard itself, its value is returned.
+func (m *matcher) fillValues(node ast.Node, values map[string]ast.Node) ast.Node {
+	if info := m.info(fromWildNode(node)); info.name != "" {
+		return values[info.name]
+	}
 	inspect(node, func(node ast.Node) bool {
+		if id, ok := node.(*ast.Ident); ok && strings.HasPrefix(id.Name, opWildPrefix) {
+			return true // replaced below
+		}
 		id := fromWildNode(node)
 		info := m.info(id)
 		if info.name == "" {
 			return true
 		}
 		prev := values[info.name]
+		if field, ok := node.(*ast.Field); ok {
+			if _, ok := prev.(fieldList); !ok {
+				return true // a type wildcard, replaced below
+			}
+			node = fieldList([]*ast.Field{field})
+		}
+		if spec, ok := node.(*ast.ValueSpec); ok {
+			if _, ok := prev.(specList); !ok {
+				return true // a name wildcard, replaced below
+			}
+			node = specList([]ast.Spec{spec})
+		}
 		switch prev.(type) {
 		case exprList:
 			node = exprList([]ast.Expr{node.(*ast.Ident)})
+		case stmtList:
+			if stmt, ok := node.(ast.Stmt); ok {
+				node = stmtList([]ast.Stmt{stmt})
+			}
 		}
 		m.substNode(node, prev)
+		return false // the wildcard is no longer in the tree
+	})
+	return m.fillOps(node, values)
+}
+
+// fillOps replaces the operator wildcards in node with the operators they
+// captured, returning the resulting node.
+func (m *matcher) fillOps(node ast.Node, values map[string]ast.Node) ast.Node {
+	opOf := func(wild *ast.Ident) token.Token {
+		// ILLEGAL if it was captured as an expression instead
+		id, _ := values[m.info(fromWildName(wild.Name)).name].(*ast.Ident)
+		if id == nil {
+			return token.ILLEGAL
+		}
+		return opTokens[id.Name]
+	}
+	root := node
+	inspect(node, func(node ast.Node) bool {
+		switch x := node.(type) {
+		case *ast.BinaryExpr:
+			if op, left := opWildBinary(x); op != nil {
+				x.X, x.Op = left, opOf(op)
+				m.setParentOf(left, x)
+			}
+		case *ast.CompositeLit:
+			op := opWildUnary(x)
+			if op == nil {
+				break
+			}
+			var newNode ast.Expr = &ast.UnaryExpr{Op: opOf(op), X: x.Elts[0]}
+			if opOf(op) == token.MUL {
+				newNode = &ast.StarExpr{X: x.Elts[0]}
+			}
+			m.setParentOf(x.Elts[0], newNode)
+			if x == root {
+				root = newNode
+			} else {
+				m.substNode(x, newNode)
+			}
+		}
 		return true
 	})
+	return root
 }
 
 func (m *matcher) substNode(oldNode, newNode ast.Node) {
@@ -51,6 +191,12 @@ func (m *matcher) substNode(oldNode, newNode ast.Node) {
 	case **ast.Ident:
 		*x = newNode.(*ast.Ident)
 	case *ast.Expr:
+		if list, ok := newNode.(exprList); ok {
+			joined := joinExprs(list)
+			m.fillParents(joined)
+			m.setParentOf(joined, parent)
+			newNode = joined
+		}
 		*x = newNode.(ast.Expr)
 	case *ast.Stmt:
 		switch y := newNode.(type) {
@@ -63,6 +209,14 @@ func (m *matcher) substNode(oldNode, newNode ast.Node) {
 		default:
 			panic(fmt.Sprintf("cannot replace stmt with %T", y))
 		}
+	case *ast.Decl:
+		*x = newNode.(ast.Decl)
+	case *ast.Spec:
+		if gd, ok := newNode.(*ast.GenDecl); ok && len(gd.Specs) == 1 {
+			// a single import, like "import $x "path""
+			newNode = gd.Specs[0]
+		}
+		*x = newNode.(ast.Spec)
 	case *[]ast.Expr:
 		oldList := oldNode.(exprList)
 		var first, last []ast.Expr
@@ -82,6 +236,40 @@ func (m *matcher) substNode(oldNode, newNode ast.Node) {
 			panic(fmt.Sprintf("cannot replace exprs with %T", y))
 		}
 		*x = append(*x, last...)
+	case *[]ast.Spec:
+		oldList := oldNode.(specList)
+		var first, last []ast.Spec
+		for i, spec := range *x {
+			if spec == oldList[0] {
+				first = (*x)[:i]
+				last = (*x)[i+len(oldList):]
+				break
+			}
+		}
+		switch y := newNode.(type) {
+		case specList:
+			*x = append(first, y...)
+		default:
+			panic(fmt.Sprintf("cannot replace specs with %T", y))
+		}
+		*x = append(*x, last...)
+	case *[]*ast.Field:
+		oldList := oldNode.(fieldList)
+		var first, last []*ast.Field
+		for i, field := range *x {
+			if field == oldList[0] {
+				first = (*x)[:i]
+				last = (*x)[i+len(oldList):]
+				break
+			}
+		}
+		switch y := newNode.(type) {
+		case fieldList:
+			*x = append(first, y...)
+		default:
+			panic(fmt.Sprintf("cannot replace fields with %T", y))
+		}
+		*x = append(*x, last...)
 	case *[]ast.Stmt:
 		oldList := oldNode.(stmtList)
 		var first, last []ast.Stmt
@@ -117,6 +305,10 @@ func (m *matcher) parentOf(node ast.Node) ast.Node {
 	list, ok := node.(nodeList)
 	if ok {
 		node = list.at(0)
+		if _, ok := m.parents[node].(nodeList); ok {
+			// the list is the root node itself
+			return nil
+		}
 	}
 	return m.parents[node]
 }
@@ -132,6 +324,21 @@ func (m *matcher) setParentOf(node, parent ast.Node) {
 	m.parents[node] = parent
 }
 
+// joinExprs joins a list of expressions with "+", so that the "$*args" of a
+// fmtconcat call like fmt.Sprintf("%s%s", a, b) can replace it as "a + b".
+// checkSubsts only allows lists in place of single expressions in that
+// case. An empty list is joined as an empty string.
+func joinExprs(list exprList) ast.Expr {
+	if len(list) == 0 {
+		return &ast.BasicLit{Kind: token.STRING, Value: `""`}
+	}
+	x := list[0]
+	for _, y := range list[1:] {
+		x = &ast.BinaryExpr{X: x, Op: token.ADD, Y: y}
+	}
+	return x
+}
+
 func (m *matcher) nodePtr(node ast.Node) interface{} {
 	list, wantSlice := node.(nodeList)
 	if wantSlice {
@@ -156,7 +363,8 @@ func (m *matcher) nodePtr(node ast.Node) interface{} {
 				}
 				return ifld.Addr().Interface()
 			}
-		case reflect.Interface:
+		case reflect.Interface, reflect.Ptr:
+			// pointer fields like FuncDecl.Name
 			if fld.Interface() == node {
 				return fld.Addr().Interface()
 			}
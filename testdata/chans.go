@@ -0,0 +1,34 @@
+package p1
+
+func sendNoReceiver() {
+	ch := make(chan int)
+	ch <- 1
+}
+
+func sendBuffered() {
+	ch := make(chan int, 1)
+	ch <- 1
+}
+
+func sendWithGo() {
+	ch := make(chan int)
+	go func() { <-ch }()
+	ch <- 1
+}
+
+func sendWithSelect() {
+	ch := make(chan int)
+	select {
+	case ch <- 1:
+	default:
+	}
+}
+
+func sendShadowed(out chan int) {
+	ch := make(chan int)
+	{
+		ch := out
+		ch <- 1
+	}
+	_ = ch
+}
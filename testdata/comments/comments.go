@@ -0,0 +1,18 @@
+package comments
+
+func f() {
+	// TODO: handle the error
+	_ = g()
+
+	h() // TODO(someone): remove
+
+	// this one is fine
+	h()
+
+	/* FIXME: not a TODO */
+	h()
+}
+
+func g() error { return nil }
+
+func h() {}
@@ -0,0 +1,7 @@
+package p
+
+func f(a, b int) bool {
+	return foo(a, b)
+}
+
+func foo(a, b int) bool { return a == b }
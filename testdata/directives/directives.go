@@ -0,0 +1,27 @@
+//go:build !nodirectives
+
+package directives
+
+import _ "embed"
+
+//go:embed directives.go
+var self string
+
+var (
+	// not a directive
+	plain = 1
+
+	//go:embed directives.go
+	selfBytes []byte
+)
+
+//go:noinline
+func noInline() {}
+
+//go:generate echo hello
+type generated struct{}
+
+// Some docs.
+//
+//go:noinline
+func documented() {}
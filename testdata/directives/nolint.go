@@ -0,0 +1,7 @@
+package directives
+
+//nolint:errcheck // always nil
+func unchecked() {}
+
+// nolint, but not a directive
+func checked() {}
@@ -0,0 +1,27 @@
+package docs
+
+// Old does something.
+//
+// Deprecated: use New instead.
+func Old() {}
+
+// New does something, better.
+func New() {}
+
+// TODO(someone): document this.
+func undocumented() {}
+
+type (
+	// Deprecated: use T.
+	OldT int
+
+	// T is a type.
+	T int
+)
+
+/*
+Block is documented with a block comment.
+
+Deprecated: use nothing.
+*/
+var Block int
@@ -0,0 +1,21 @@
+package group
+
+type T struct{}
+
+func (t *T) Close() error {
+	flush()
+	return nil
+}
+
+func flush() {
+	sync()
+	sync()
+}
+
+var x, y = sync(), 3
+
+func TestFlush() {
+	flush()
+}
+
+func sync() int { return 0 }
@@ -0,0 +1,3 @@
+package imports
+
+var _ = "none"
@@ -0,0 +1,8 @@
+package imports
+
+import (
+	"strings"
+	"unicode"
+)
+
+var _ = strings.Repeat(string(unicode.MaxASCII), 2)
@@ -0,0 +1,5 @@
+package imports
+
+import "unicode/utf8"
+
+var _ = utf8.RuneError
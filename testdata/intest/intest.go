@@ -0,0 +1,7 @@
+package intest
+
+func compute() int { return 1 }
+
+func run() {
+	panic(compute())
+}
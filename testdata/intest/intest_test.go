@@ -0,0 +1,9 @@
+package intest
+
+import "testing"
+
+func TestCompute(t *testing.T) {
+	if compute() != 1 {
+		panic("wrong")
+	}
+}
@@ -0,0 +1,35 @@
+package p1
+
+func use(int) {}
+
+func capturedRange(xs []int) {
+	for _, v := range xs {
+		go func() { use(v) }()
+	}
+}
+
+func capturedFor() {
+	for i := 0; i < 3; i++ {
+		defer func() { use(i) }()
+	}
+}
+
+func passedAsParam(xs []int) {
+	for _, v := range xs {
+		go func(v int) { use(v) }(v)
+	}
+}
+
+func shadowed(xs []int) {
+	for _, v := range xs {
+		v := v
+		go func() { use(v) }()
+	}
+}
+
+func outsideLoop(xs []int) {
+	v := 0
+	for range xs {
+		go func() { use(v) }()
+	}
+}
@@ -0,0 +1,37 @@
+package p1
+
+import "io"
+
+func onlyReads(rw io.ReadWriter) {
+	rw.Read(nil)
+}
+
+func readsAndWrites(rw io.ReadWriter) {
+	rw.Read(nil)
+	rw.Write(nil)
+}
+
+func passedOn(rw io.ReadWriter) {
+	io.Copy(rw, rw)
+}
+
+func onlyAsserted(v interface{}) int {
+	switch v := v.(type) {
+	case int:
+		return v
+	}
+	if s, ok := v.(string); ok {
+		return len(s)
+	}
+	return 0
+}
+
+func printed(v interface{}) {
+	println(v)
+}
+
+func unused(rw io.ReadWriter) {}
+
+func notInterface(b []byte) {
+	_ = len(b)
+}
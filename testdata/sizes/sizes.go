@@ -0,0 +1,12 @@
+package sizes
+
+func short() { println() }
+
+func long() {
+	println(1)
+	println(2)
+	println(3)
+}
+
+func empty() {
+}
@@ -0,0 +1,5 @@
+package b
+
+import "scope/a"
+
+func Get() a.Handle { return 0 }
@@ -0,0 +1,7 @@
+package c
+
+import "scope/b"
+
+var h = b.Get()
+
+var n = 3
@@ -0,0 +1,16 @@
+package suppress
+
+func a() {
+	flush() //gogrep:ignore
+	flush() //nolint:gogrep:sync,errcheck // not this rule
+	flush() //nolint:gogrep:flush
+	flush() //gogrep:ignore sync, flush
+	flush()
+}
+
+//gogrep:ignore flush
+func b() {
+	flush()
+}
+
+func flush() {}
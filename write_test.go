@@ -10,6 +10,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -90,3 +91,48 @@ func f() {
 		}
 	}
 }
+
+func TestWriteInteractive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gogrep-write")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "f.go")
+	orig := "package p\n\nfunc f() {\n\tfoo(1)\n\tfoo(2)\n\tfoo(3)\n}\n"
+	if err := ioutil.WriteFile(path, []byte(orig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := matcher{ctx: &build.Default}
+	var buf, prompts bytes.Buffer
+	m.out, m.stderr = &buf, &prompts
+	m.in = strings.NewReader("y\nmaybe\nn\ny\n")
+	args := []string{"-I", "-x", "foo($x)", "-s", "bar($x)", "-w", path}
+	if err := m.fromArgs(args); err != nil {
+		t.Fatalf("didn't want error, but got %q", err)
+	}
+	if buf.Len() > 0 {
+		t.Fatalf("wanted the prompts out of the output, got:\n%s", buf.String())
+	}
+	gotOut := prompts.String()
+	for _, want := range []string{"- foo(1)\n+ bar(1)\n", "- foo(2)\n+ bar(2)\n", "apply? [y,n,q] "} {
+		if !strings.Contains(gotOut, want) {
+			t.Fatalf("output does not contain %q:\n%s", want, gotOut)
+		}
+	}
+	gotBs, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "package p\n\nfunc f() {\n\tbar(1)\n\tfoo(2)\n\tbar(3)\n}\n"
+	if got := string(gotBs); got != want {
+		t.Fatalf("file mismatch:\nwant:\n%sgot:\n%s", want, got)
+	}
+
+	m = matcher{ctx: &build.Default, out: &buf, in: os.Stdin}
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice == 0 {
+		if err := m.fromArgs(args); err == nil {
+			t.Fatalf("wanted error with non-terminal input, got none")
+		}
+	}
+}